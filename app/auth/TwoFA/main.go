@@ -3,7 +3,9 @@ package twofa
 import (
 	"log"
 
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
 	"github.com/pocketbase/pocketbase/models"
 	"github.com/pocketbase/pocketbase/tools/security"
 	"github.com/pquerna/otp/totp"
@@ -199,6 +201,64 @@ func (rec *TwoFAStruct) IsEnabled() bool {
 	return rec.record.enabled
 }
 
+/*
+The TOTP secret, for showing to the user while they set it up
+*/
+func (rec *TwoFAStruct) Secret() string {
+	return rec.record.secret
+}
+
+/*
+The otpauth:// url for a QR code. Only set on a record that was just created
+*/
+func (rec *TwoFAStruct) URL() string {
+	return rec.record.url
+}
+
+/*
+Moves a 2FA record onto a new email
+
+The identifier is built from the email so it has to be updated when the email changes. Does nothing if the record has no 2FA
+*/
+func MigrateIdentifier(dao *daos.Dao, authRecord *models.Record, newEmail string) error {
+	if dao == nil {
+		return NewTwoFAError("No dao was provided")
+	}
+
+	if authRecord == nil || !authRecord.Collection().IsAuth() {
+		return NewTwoFAError("The provided authRecord is not from an auth collection")
+	}
+
+	record, err := dao.FindFirstRecordByData("2fa_secrets", "unid", create2FAIdentifierFromRecord(authRecord))
+	if err != nil || record == nil {
+		return nil
+	}
+
+	record.Set("unid", security.SHA256(authRecord.Id+newEmail+authRecord.Collection().Name))
+
+	if err := dao.SaveRecord(record); err != nil {
+		log.Println(err)
+		return NewTwoFAError("An error occured moving the 2FA record")
+	}
+	return nil
+}
+
+/*
+Stops forcing 2FA setup for the user (the require_2fa user flag), called once they have enabled it
+*/
+func ClearRequired(app *pocketbase.PocketBase, authRecord *models.Record) {
+	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
+		"user_flags", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id},
+	)
+	if err == nil && userFlagsRecord.GetBool("require_2fa") {
+		userFlagsRecord.Set("require_2fa", false)
+		if err := app.Dao().SaveRecord(userFlagsRecord); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 //Extra helper functions:
 
 func create2FAIdentifierFromRecord(record *models.Record) string {
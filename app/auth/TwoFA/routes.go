@@ -6,6 +6,7 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 func Register2FARoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
@@ -27,7 +28,7 @@ func handlePostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
 	case "finish-setup":
 		return finish2FASetup(app, c)
 	}
-	return apis.NewNotFoundError("Method not found", nil)
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
 }
 
 func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
@@ -36,10 +37,12 @@ func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
 	case "state":
 		return get2FAState(app, c)
 	}
-	return apis.NewNotFoundError("Method not found", nil)
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
 }
 
 func enable2FA(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
 	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 
 	if record == nil {
@@ -50,7 +53,7 @@ func enable2FA(app *pocketbase.PocketBase, c echo.Context) error {
 
 	otp, err := Create(app, record)
 	if err != nil {
-		return apis.NewApiError(500, err.Error(), nil)
+		return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
 	}
 
 	res := make(map[string]interface{})
@@ -60,12 +63,14 @@ func enable2FA(app *pocketbase.PocketBase, c echo.Context) error {
 	res["secret"] = otp.record.secret
 	res["url"] = otp.record.url
 	res["state"] = true
-	res["message"] = "Code verification required"
+	res["message"] = i18n.T(locale, "Code verification required")
 
 	return c.JSON(200, res)
 }
 
 func disable2FA(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
 	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 
 	if record == nil {
@@ -76,21 +81,23 @@ func disable2FA(app *pocketbase.PocketBase, c echo.Context) error {
 
 	otp, err := Load(app, record)
 	if err != nil {
-		return apis.NewApiError(500, err.Error(), nil)
+		return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
 	}
 	if err := otp.Disable("", true); err != nil {
-		return apis.NewApiError(500, err.Error(), nil)
+		return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
 	}
 	res := make(map[string]interface{})
 
 	res["code"] = 200
 
 	res["state"] = false
-	res["message"] = "2FA no longer enabled"
+	res["message"] = i18n.T(locale, "2FA no longer enabled")
 	return c.JSON(200, res)
 
 }
 func finish2FASetup(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
 	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 
 	if record == nil {
@@ -101,22 +108,27 @@ func finish2FASetup(app *pocketbase.PocketBase, c echo.Context) error {
 
 	otp, err := Load(app, record)
 	if err != nil {
-		return apis.NewApiError(500, err.Error(), nil)
+		return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
 	}
 	if err := otp.Enable(c.FormValue("code")); err != nil {
-		return apis.NewApiError(500, err.Error(), nil)
+		return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
 	}
+
+	// 2FA is set up now so it no longer needs to be forced
+	ClearRequired(app, record)
 	res := make(map[string]interface{})
 
 	res["code"] = 200
 
 	res["state"] = true
-	res["message"] = "2FA enabled"
+	res["message"] = i18n.T(locale, "2FA enabled")
 	return c.JSON(200, res)
 
 }
 
 func get2FAState(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
 	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 
 	if record == nil {
@@ -132,11 +144,11 @@ func get2FAState(app *pocketbase.PocketBase, c echo.Context) error {
 	_, err := Load(app, record)
 	if err != nil {
 		res["state"] = false
-		res["message"] = "2FA not enabled"
+		res["message"] = i18n.T(locale, "2FA not enabled")
 		return c.JSON(200, res)
 	} else {
 		res["state"] = true
-		res["message"] = "2FA enabled"
+		res["message"] = i18n.T(locale, "2FA enabled")
 		return c.JSON(200, res)
 	}
 }
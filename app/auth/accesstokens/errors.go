@@ -0,0 +1,19 @@
+package accesstokens
+
+import "fmt"
+
+type AccessTokenError struct {
+	Message string
+}
+
+// Error implements the error interface for AccessTokenError
+func (e *AccessTokenError) Error() string {
+	return e.Message
+}
+
+// NewAccessTokenError creates a new AccessTokenError with the given message
+func NewAccessTokenError(format string, a ...interface{}) error {
+	return &AccessTokenError{
+		Message: fmt.Sprintf(format, a...),
+	}
+}
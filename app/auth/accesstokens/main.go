@@ -0,0 +1,176 @@
+package accesstokens
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+/*
+Personal access tokens, for scripts that can't do the email login
+
+Stored in the "access_tokens" collection. Only the hash of the token is stored, the same as the tokens package
+*/
+
+const (
+	ScopeReadPages   = "pages:read"
+	ScopeWritePages  = "pages:write"
+	ScopeUploadFiles = "files:upload"
+
+	// Makes the tokens easy to tell apart from auth tokens (and to find if leaked)
+	tokenPrefix = "noti_pat_"
+)
+
+var (
+	allScopes   = []string{ScopeReadPages, ScopeWritePages, ScopeUploadFiles}
+	maxLifetime = 365 * 24 * time.Hour
+
+	// How often last_used is written for a token, stops a db write on every request
+	lastUsedInterval = 1 * time.Minute
+)
+
+type AccessToken struct {
+	Value  string
+	Record *models.Record
+}
+
+/*
+Creates and saves a new access token for a user
+
+The token value is only available here, it can't be recovered later
+*/
+func Create(app *pocketbase.PocketBase, authRecord *models.Record, name string, scopes []string, lifetime time.Duration) (*AccessToken, error) {
+	if name == "" {
+		return nil, NewAccessTokenError("A token name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, NewAccessTokenError("At least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !isValidScope(scope) {
+			return nil, NewAccessTokenError("Unknown scope %s", scope)
+		}
+	}
+	if lifetime <= 0 || lifetime > maxLifetime {
+		return nil, NewAccessTokenError("Tokens must expire within a year")
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("access_tokens")
+	if err != nil {
+		return nil, NewAccessTokenError("access_tokens Collection was not found. Please create it to use this feature.")
+	}
+
+	value := tokenPrefix + security.RandomString(40)
+
+	record := models.NewRecord(collection)
+	record.Set("user", authRecord.Id)
+	record.Set("collection", authRecord.Collection().Id)
+	record.Set("name", name)
+	record.Set("token", security.SHA256(value))
+	record.Set("scopes", strings.Join(scopes, ","))
+	record.Set("expires", time.Now().UTC().Add(lifetime))
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, NewAccessTokenError("Failed to create token.\n%s", err)
+	}
+
+	return &AccessToken{
+		Value:  value,
+		Record: record,
+	}, nil
+}
+
+/*
+Lists a users access tokens, including expired ones
+*/
+func List(app *pocketbase.PocketBase, authRecord *models.Record) ([]*models.Record, error) {
+	return app.Dao().FindRecordsByFilter(
+		"access_tokens", "user = {:userId} && collection = {:collectionId}",
+		"-created", 0, 0,
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id},
+	)
+}
+
+/*
+Deletes one of a users access tokens
+*/
+func Revoke(app *pocketbase.PocketBase, authRecord *models.Record, tokenId string) error {
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"access_tokens", "id = {:id} && user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"id": tokenId, "userId": authRecord.Id, "collectionId": authRecord.Collection().Id},
+	)
+	if err != nil || record == nil {
+		return NewAccessTokenError("Token not found")
+	}
+
+	return app.Dao().DeleteRecord(record)
+}
+
+/*
+Finds the auth record an access token belongs to
+
+Errors if the token is unknown or expired
+*/
+func Resolve(app *pocketbase.PocketBase, value string) (*models.Record, []string, error) {
+	record, err := app.Dao().FindFirstRecordByData("access_tokens", "token", security.SHA256(value))
+	if err != nil || record == nil {
+		return nil, nil, NewAccessTokenError("Invalid access token")
+	}
+
+	if time.Now().UTC().After(record.GetDateTime("expires").Time()) {
+		return nil, nil, NewAccessTokenError("Access token expired")
+	}
+
+	authRecord, err := app.Dao().FindRecordById(record.GetString("collection"), record.GetString("user"))
+	if err != nil || authRecord == nil {
+		return nil, nil, NewAccessTokenError("Invalid access token")
+	}
+
+	if time.Now().UTC().After(record.GetDateTime("last_used").Time().Add(lastUsedInterval)) {
+		record.Set("last_used", types.NowDateTime())
+		if err := app.Dao().SaveRecord(record); err != nil {
+			app.Logger().Error("Failed to update access token last used", "details", err)
+		}
+	}
+
+	return authRecord, ParseScopes(record.GetString("scopes")), nil
+}
+
+func ParseScopes(scopes string) []string {
+	parsed := []string{}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			parsed = append(parsed, scope)
+		}
+	}
+	return parsed
+}
+
+func IsAccessToken(value string) bool {
+	return strings.HasPrefix(value, tokenPrefix)
+}
+
+//Extra helper functions:
+
+func isValidScope(scope string) bool {
+	for _, s := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package accesstokens
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func RegisterAccessTokenRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.Pre(LoadAccessTokenAuth(app))
+
+	e.Router.GET("/api/collections/:collection/access-tokens/:method", func(c echo.Context) error {
+		return handleGetMethodAssign(c, app)
+	})
+	e.Router.POST("/api/collections/:collection/access-tokens/:method", func(c echo.Context) error {
+		return handlePostMethodAssign(c, app)
+	})
+}
+
+/*
+Loads the auth record for requests using an access token in the Authorization header
+
+Access tokens can only reach the routes their scopes allow
+*/
+func LoadAccessTokenAuth(app *pocketbase.PocketBase) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if !IsAccessToken(token) {
+				return next(c)
+			}
+
+			authRecord, scopes, err := Resolve(app, token)
+			if err != nil {
+				return apis.NewUnauthorizedError(err.Error(), nil)
+			}
+
+			scope := requiredScope(c.Request().Method, c.Request().URL.Path)
+			if scope == "" {
+				return apis.NewForbiddenError("Access tokens can't be used for this route", nil)
+			}
+			if !hasScope(scopes, scope) {
+				return apis.NewForbiddenError("The access token is missing the "+scope+" scope", nil)
+			}
+
+			c.Set(apis.ContextAuthRecordKey, authRecord)
+			c.Set("access_token_scopes", scopes)
+
+			return next(c)
+		}
+	}
+}
+
+func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "list":
+		return listAccessTokens(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handlePostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "create":
+		return createAccessToken(app, c)
+	case "revoke":
+		return revokeAccessToken(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func createAccessToken(app *pocketbase.PocketBase, c echo.Context) error {
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+	if record == nil {
+		return apis.NewForbiddenError("", nil)
+	}
+
+	days, err := strconv.Atoi(c.FormValue("expires_in_days"))
+	if err != nil {
+		return apis.NewBadRequestError("Invalid or missing expiry", nil)
+	}
+
+	token, err := Create(app, record, c.FormValue("name"), ParseScopes(c.FormValue("scopes")), time.Duration(days)*24*time.Hour)
+	if err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["id"] = token.Record.Id
+	res["token"] = token.Value
+	res["expires"] = token.Record.GetDateTime("expires")
+	res["message"] = "Copy the token now, it won't be shown again"
+
+	return c.JSON(200, res)
+}
+
+func listAccessTokens(app *pocketbase.PocketBase, c echo.Context) error {
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+	if record == nil {
+		return apis.NewForbiddenError("", nil)
+	}
+
+	tokenRecords, err := List(app, record)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load access tokens", nil)
+	}
+
+	items := make([]map[string]interface{}, 0, len(tokenRecords))
+	for _, token := range tokenRecords {
+		items = append(items, map[string]interface{}{
+			"id":        token.Id,
+			"name":      token.GetString("name"),
+			"scopes":    ParseScopes(token.GetString("scopes")),
+			"created":   token.Created,
+			"expires":   token.GetDateTime("expires"),
+			"last_used": token.GetDateTime("last_used"),
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["tokens"] = items
+
+	return c.JSON(200, res)
+}
+
+func revokeAccessToken(app *pocketbase.PocketBase, c echo.Context) error {
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+	if record == nil {
+		return apis.NewForbiddenError("", nil)
+	}
+
+	if err := Revoke(app, record, c.FormValue("token")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Token revoked"
+
+	return c.JSON(200, res)
+}
+
+/*
+The scope a route needs, "" if access tokens aren't allowed to use it at all
+*/
+func requiredScope(method string, path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/collections/pages/records"):
+		if method == http.MethodGet {
+			return ScopeReadPages
+		}
+		return ScopeWritePages
+	case path == "/api/page/duplicate":
+		return ScopeWritePages
+	case strings.HasPrefix(path, "/api/collections/files/records"):
+		if method == http.MethodGet {
+			return ScopeReadPages
+		}
+		return ScopeUploadFiles
+	case strings.HasPrefix(path, "/api/files/") && method == http.MethodGet:
+		return ScopeReadPages
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package devices
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+/*
+Fingerprints the devices a user signs in from so new ones can be flagged
+
+Stored in the "known_devices" collection
+*/
+
+type Device struct {
+	Browser     string
+	OS          string
+	IPPrefix    string
+	Fingerprint string
+}
+
+/*
+Builds a device from the user agent and ip of a request
+
+Only the browser/os family and the ip network are used so updates and dhcp don't count as a new device
+*/
+func Identify(userAgent string, ip string) *Device {
+	device := &Device{
+		Browser:  browserFamily(userAgent),
+		OS:       osFamily(userAgent),
+		IPPrefix: ipPrefix(ip),
+	}
+	device.Fingerprint = security.SHA256(device.Browser + "|" + device.OS + "|" + device.IPPrefix)
+	return device
+}
+
+func (device *Device) Description() string {
+	return device.Browser + " on " + device.OS
+}
+
+/*
+Saves the device for the user, or updates its last seen time
+
+Returns true if the device had not been seen before
+*/
+func Remember(app *pocketbase.PocketBase, authRecord *models.Record, device *Device) (bool, error) {
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"known_devices", "user = {:userId} && collection = {:collectionId} && fingerprint = {:fingerprint}",
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id, "fingerprint": device.Fingerprint},
+	)
+
+	isNew := err != nil || record == nil
+
+	if isNew {
+		collection, err := app.Dao().FindCollectionByNameOrId("known_devices")
+		if err != nil {
+			return false, err
+		}
+		record = models.NewRecord(collection)
+		record.Set("user", authRecord.Id)
+		record.Set("collection", authRecord.Collection().Id)
+		record.Set("fingerprint", device.Fingerprint)
+		record.Set("description", device.Description())
+	}
+
+	record.Set("last_seen", time.Now().UTC())
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return false, err
+	}
+
+	return isNew, nil
+}
+
+/*
+Checks if the user has any saved devices
+
+Accounts from before devices were tracked have none, so their first login shouldn't be treated as suspicious
+*/
+func HasKnownDevices(app *pocketbase.PocketBase, authRecord *models.Record) bool {
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"known_devices", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id},
+	)
+	return err == nil && record != nil
+}
+
+/*
+Removes a device so it will be treated as new next time
+*/
+func Forget(app *pocketbase.PocketBase, authRecord *models.Record, fingerprint string) error {
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"known_devices", "user = {:userId} && collection = {:collectionId} && fingerprint = {:fingerprint}",
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id, "fingerprint": fingerprint},
+	)
+	if err != nil {
+		return err
+	}
+	return app.Dao().DeleteRecord(record)
+}
+
+//Extra helper functions:
+
+func browserFamily(userAgent string) string {
+	// Order matters, most browsers include "Chrome" and "Safari" in their ua
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		return "Edge"
+	case strings.Contains(userAgent, "OPR/"), strings.Contains(userAgent, "Opera"):
+		return "Opera"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		return "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		return "Safari"
+	case userAgent == "":
+		return "Unknown browser"
+	}
+	return "Other browser"
+}
+
+func osFamily(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		return "iOS"
+	case strings.Contains(userAgent, "Android"):
+		return "Android"
+	case strings.Contains(userAgent, "Windows"):
+		return "Windows"
+	case strings.Contains(userAgent, "Mac OS"):
+		return "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		return "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		return "Linux"
+	}
+	return "Unknown OS"
+}
+
+/*
+/24 for ipv4 and /48 for ipv6
+*/
+func ipPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
@@ -0,0 +1,243 @@
+package deviceauth
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	grantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	statusPending  = "pending"
+	statusApproved = "approved"
+	statusDenied   = "denied"
+
+	// No vowels so codes can't spell anything
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+var (
+	deviceCodeLifetime = 10 * time.Minute
+	// Seconds the device has to wait between polls
+	pollInterval = 5
+	// Added to the interval every time the device polls too fast (RFC 8628 3.5)
+	slowDownStep = 5
+)
+
+/*
+Issues a device code and user code
+*/
+func requestDeviceCode(app *pocketbase.PocketBase, c echo.Context) error {
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil || !collection.IsAuth() {
+		return apis.NewApiError(500, "Invalid auth collection", nil)
+	}
+
+	deviceCodesCollection, err := app.Dao().FindCollectionByNameOrId("device_codes")
+	if err != nil {
+		app.Logger().Error("device_codes Collection was not found. Please create it to use this feature.")
+		return apis.NewApiError(500, "Internal server error", nil)
+	}
+
+	appURLEnv, found := os.LookupEnv("website_url")
+	if !found {
+		app.Logger().Error("No website url env found")
+		return apis.NewApiError(500, "Internal server error", nil)
+	}
+	verificationURI := strings.TrimSuffix(appURLEnv, "/") + "/device"
+
+	deviceCode := security.RandomString(40)
+	userCode := security.RandomStringWithAlphabet(8, userCodeAlphabet)
+	expires := time.Now().UTC().Add(deviceCodeLifetime)
+
+	record := models.NewRecord(deviceCodesCollection)
+	record.Set("device_code", security.SHA256(deviceCode))
+	record.Set("user_code", security.SHA256(userCode))
+	record.Set("auth_collection_id", collection.Id)
+	record.Set("client_id", c.FormValue("client_id"))
+	record.Set("status", statusPending)
+	record.Set("expires", expires)
+	record.Set("interval", pollInterval)
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return apis.NewApiError(500, "An error occured while trying to save", nil)
+	}
+
+	formattedUserCode := userCode[:4] + "-" + userCode[4:]
+
+	return c.JSON(200, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 formattedUserCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(formattedUserCode),
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  pollInterval,
+	})
+}
+
+/*
+Lets a signed in user approve (or deny) the device showing a user code
+*/
+func approveDeviceCode(app *pocketbase.PocketBase, c echo.Context) error {
+	authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if authRecord == nil {
+		return apis.NewUnauthorizedError("You must be signed in to access this", nil)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil || collection.Id != authRecord.Collection().Id {
+		return apis.NewApiError(500, "Invalid auth collection", nil)
+	}
+
+	record, err := app.Dao().FindFirstRecordByData("device_codes", "user_code", security.SHA256(normalizeUserCode(c.FormValue("user_code"))))
+	if err != nil || record == nil || record.GetString("auth_collection_id") != collection.Id {
+		return apis.NewBadRequestError("Invalid code", nil)
+	}
+
+	if record.GetString("status") != statusPending || time.Now().UTC().After(record.GetDateTime("expires").Time()) {
+		return apis.NewBadRequestError("The code has expired or was already used", nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+
+	if c.FormValue("action") == "deny" {
+		record.Set("status", statusDenied)
+		res["message"] = "The device was denied"
+	} else {
+		record.Set("status", statusApproved)
+		record.Set("user", authRecord.Id)
+		res["message"] = "The device is now signed in"
+	}
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return apis.NewApiError(500, "An error occured while trying to save", nil)
+	}
+
+	return c.JSON(200, res)
+}
+
+/*
+Polled by the device until the user has approved it
+
+Errors are in the RFC 8628 format, once approved the normal record auth response is returned.
+Polling faster than the interval answers slow_down and adds 5 seconds to it, kept in the device_codes interval field
+*/
+func pollDeviceToken(app *pocketbase.PocketBase, c echo.Context) error {
+	if c.FormValue("grant_type") != grantType {
+		return deviceError(c, "unsupported_grant_type")
+	}
+
+	record, err := app.Dao().FindFirstRecordByData("device_codes", "device_code", security.SHA256(c.FormValue("device_code")))
+	if err != nil || record == nil {
+		return deviceError(c, "invalid_grant")
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil || collection.Id != record.GetString("auth_collection_id") {
+		return deviceError(c, "invalid_grant")
+	}
+
+	if time.Now().UTC().After(record.GetDateTime("expires").Time()) {
+		_ = app.Dao().DeleteRecord(record)
+		return deviceError(c, "expired_token")
+	}
+
+	switch record.GetString("status") {
+	case statusDenied:
+		_ = app.Dao().DeleteRecord(record)
+		return deviceError(c, "access_denied")
+	case statusPending:
+		interval := record.GetInt("interval")
+		if interval < pollInterval {
+			interval = pollInterval
+		}
+
+		lastPoll := record.GetDateTime("last_poll").Time()
+		tooFast := time.Since(lastPoll) < time.Duration(interval)*time.Second
+		if tooFast {
+			interval += slowDownStep
+			record.Set("interval", interval)
+		}
+		record.Set("last_poll", time.Now().UTC())
+		if err := app.Dao().SaveRecord(record); err != nil {
+			app.Logger().Error("Failed to update device code last poll", "details", err)
+		}
+
+		if tooFast {
+			return c.JSON(400, map[string]interface{}{
+				"error":    "slow_down",
+				"interval": interval,
+			})
+		}
+		return deviceError(c, "authorization_pending")
+	}
+
+	// A device code can only be exchanged once. Deleting it in one statement means only one poll can win
+	result, err := app.Dao().DB().
+		NewQuery("DELETE FROM device_codes WHERE id = {:id} AND status = {:approved}").
+		Bind(dbx.Params{"id": record.Id, "approved": statusApproved}).
+		Execute()
+	if err != nil {
+		return apis.NewApiError(500, "An error occured processing your request", nil)
+	}
+	if rows, _ := result.RowsAffected(); rows != 1 {
+		return deviceError(c, "invalid_grant")
+	}
+
+	userRecord, err := app.Dao().FindRecordById(collection.Id, record.GetString("user"))
+	if err != nil || userRecord == nil {
+		return deviceError(c, "invalid_grant")
+	}
+
+	return apis.RecordAuthResponse(app, c, userRecord, nil)
+}
+
+/*
+Removes device codes that expired without being used every hour
+*/
+func EnableCleanupCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	if _, err := app.Dao().FindCollectionByNameOrId("device_codes"); err != nil {
+		return nil
+	}
+
+	scheduler.MustAdd("DeviceCodeCleanup", "0 * * * *", func() {
+		_, err := app.Dao().DB().
+			NewQuery("DELETE FROM device_codes WHERE expires < {:now}").
+			Bind(dbx.Params{"now": types.NowDateTime().String()}).
+			Execute()
+		if err != nil {
+			app.Logger().Error("Failed to remove expired device codes", "details", err)
+		}
+	})
+	return nil
+}
+
+//Extra helper functions:
+
+func deviceError(c echo.Context, code string) error {
+	return c.JSON(400, map[string]interface{}{
+		"error": code,
+	})
+}
+
+/*
+Users may type the code in lower case or without the dash
+*/
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
@@ -0,0 +1,33 @@
+package deviceauth
+
+import (
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+/*
+OAuth 2.0 device authorization grant (RFC 8628) for clients without a browser, eg. the cli
+
+  - The device asks for a code
+  - The user enters the user code on the website while signed in
+  - The device polls until it gets an auth response
+*/
+func RegisterDeviceAuthRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.POST("/api/collections/:collection/device-auth/:method", func(c echo.Context) error {
+		return handleMethodAsign(c, app)
+	})
+}
+
+func handleMethodAsign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "code":
+		return requestDeviceCode(app, c)
+	case "approve":
+		return approveDeviceCode(app, c)
+	case "token":
+		return pollDeviceToken(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
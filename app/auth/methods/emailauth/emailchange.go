@@ -0,0 +1,298 @@
+package emailauth
+
+import (
+	"errors"
+	"net/mail"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+	twofa "suddsy.dev/m/v2/app/auth/TwoFA"
+	"suddsy.dev/m/v2/app/auth/tokens"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/emails"
+)
+
+var (
+	emailChangeConfirmLifetime = 1 * time.Hour
+	// The old address can undo the change for longer than it takes to confirm it
+	emailChangeCancelLifetime = 72 * time.Hour
+)
+
+/*
+Starts changing the email of the signed in user
+
+Sends a confirmation token to the new address and a notice with a cancel link to the old one
+*/
+func startEmailChange(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	userRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if userRecord == nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, "You must be signed in to access this"), nil)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil || collection.Id != userRecord.Collection().Id {
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+
+	newEmail := c.FormValue("email")
+	oldEmail := userRecord.Email()
+
+	if !isValidEmail(newEmail) || newEmail == oldEmail {
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
+	}
+
+	if existingRecord, err := getUserRecord(app, collection, newEmail); err == nil || existingRecord != nil {
+		return apis.NewBadRequestError(i18n.T(locale, "A user with that email already exists"), nil)
+	}
+
+	appURLEnv, err := getAppURL(app, locale)
+	if err != nil {
+		return err
+	}
+	replyToAddress, _ := os.LookupEnv("email_reply_to")
+
+	// Only one change can be pending at a time
+	_ = tokens.RemoveTokensByReason(app, collection, emailChangeConfirmReason(userRecord.Id))
+	_ = tokens.RemoveTokensByReason(app, collection, emailChangeCancelReason(userRecord.Id))
+
+	confirmToken, err := tokens.Initialise(newEmail, collection, false).CreateNewToken(emailChangeConfirmReason(userRecord.Id), app)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Problem occured creating a temp auth token"), nil)
+	}
+	if _, err := confirmToken.SaveFor(emailChangeConfirmLifetime); err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
+	}
+
+	cancelToken, err := tokens.Initialise(oldEmail, collection, true).CreateNewToken(emailChangeCancelReason(userRecord.Id), app)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Problem occured creating a temp auth token"), nil)
+	}
+	if _, err := cancelToken.SaveFor(emailChangeCancelLifetime); err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
+	}
+
+	confirmQuery := url.Values{}
+	confirmQuery.Set("token", confirmToken.Value)
+	confirmQuery.Set("email", newEmail)
+	confirmQuery.Set("user", userRecord.Id)
+
+	confirmData := make(map[string]interface{})
+	confirmData["token"] = confirmToken.Value
+	confirmData["subject"] = i18n.T(locale, "Confirm your new email")
+	confirmData["recp"] = newEmail
+	confirmData["recpName"] = userRecord.Username()
+	confirmData["replyTo"] = replyToAddress
+	confirmData["buttonLink"] = appURLEnv + "/auth/email/confirm?" + confirmQuery.Encode()
+
+	cancelQuery := url.Values{}
+	cancelQuery.Set("token", cancelToken.Value)
+	cancelQuery.Set("email", oldEmail)
+	cancelQuery.Set("user", userRecord.Id)
+
+	noticeData := make(map[string]interface{})
+	noticeData["subject"] = i18n.T(locale, "Your email is being changed")
+	noticeData["recp"] = oldEmail
+	noticeData["recpName"] = userRecord.Username()
+	noticeData["replyTo"] = replyToAddress
+	noticeData["newEmail"] = newEmail
+	noticeData["buttonLink"] = appURLEnv + "/auth/email/cancel?" + cancelQuery.Encode()
+
+	confirmEmail, err := emails.RenderEmail(app, "emailChange", locale, confirmData)
+	if err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to write the email data to the html file or load html file", err)
+		return apis.NewApiError(500, i18n.T(locale, "An error occured processing your request"), nil)
+	}
+	noticeEmail, err := emails.RenderEmail(app, "emailChangeNotice", locale, noticeData)
+	if err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to write the email data to the html file or load html file", err)
+		return apis.NewApiError(500, i18n.T(locale, "An error occured processing your request"), nil)
+	}
+
+	err = emails.QueueEmail(app, confirmData["subject"].(string), []mail.Address{
+		{Name: userRecord.Username(), Address: newEmail},
+	}, confirmEmail, emails.PriorityLogin)
+	if err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to queue the email", err)
+		return sendErrorResponse(locale, err)
+	}
+	err = emails.QueueEmail(app, noticeData["subject"].(string), []mail.Address{
+		{Name: userRecord.Username(), Address: oldEmail},
+	}, noticeEmail, emails.PriorityDefault)
+	// The old address bouncing is no reason to stop them moving to a new one
+	if err != nil && !errors.As(err, new(*emails.SuppressedError)) {
+		logDescriptiveErrorToLogs(app, "Failed to queue the email", err)
+		return apis.NewApiError(500, i18n.T(locale, "Problem sending email"), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = i18n.Tf(locale, "Confirmation email sent to: %s", newEmail)
+
+	return c.JSON(200, res)
+}
+
+/*
+Completes an email change using the token sent to the new address
+
+Logs the user out everywhere else by rotating the tokenKey
+*/
+func finishEmailChange(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	newEmail := c.FormValue("email")
+	formToken := c.FormValue("token")
+	userId := c.FormValue("user")
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+
+	if !isValidEmail(newEmail) {
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
+	}
+
+	token := tokens.Initialise(newEmail, collection, false).RebuildToken(formToken, emailChangeConfirmReason(userId))
+
+	if err := token.Verify(app); err != nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
+	}
+
+	userRecord, err := app.Dao().FindRecordById(collection.Id, userId)
+	if err != nil || userRecord == nil {
+		return apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
+	}
+
+	otp, err := twofa.Load(app, userRecord)
+	// A 2FA record that was never confirmed can't be used yet
+	if err == nil && otp != nil && otp.IsEnabled() {
+		if err := otp.AuthWith(c.FormValue("2fa")); err != nil {
+			return apis.NewUnauthorizedError(i18n.T(locale, "Invalid 2fa code"), nil)
+		}
+	}
+
+	if existingRecord, err := getUserRecord(app, collection, newEmail); err == nil || existingRecord != nil {
+		return apis.NewBadRequestError(i18n.T(locale, "A user with that email already exists"), nil)
+	}
+
+	if err := applyEmailChange(app, userRecord, newEmail); err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to change a users email", err)
+		return apis.NewApiError(500, i18n.T(locale, "A problem occured while changing your email"), nil)
+	}
+
+	_ = token.RemoveToken(app)
+
+	return apis.RecordAuthResponse(app, c, userRecord, nil)
+}
+
+/*
+Used from the link sent to the old address
+
+Cancels a pending change, or puts the old email back if the change was already confirmed
+*/
+func cancelEmailChange(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	oldEmail := c.FormValue("email")
+	formToken := c.FormValue("token")
+	userId := c.FormValue("user")
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+
+	if !isValidEmail(oldEmail) {
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
+	}
+
+	// Exists is only checked when saving, the user may no longer have this email
+	token := tokens.Initialise(oldEmail, collection, false).RebuildToken(formToken, emailChangeCancelReason(userId))
+
+	if err := token.Verify(app); err != nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
+	}
+
+	userRecord, err := app.Dao().FindRecordById(collection.Id, userId)
+	if err != nil || userRecord == nil {
+		return apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
+	}
+
+	_ = tokens.RemoveTokensByReason(app, collection, emailChangeConfirmReason(userRecord.Id))
+
+	if userRecord.Email() != oldEmail {
+		if existingRecord, err := getUserRecord(app, collection, oldEmail); err == nil || existingRecord != nil {
+			return apis.NewBadRequestError(i18n.T(locale, "A user with that email already exists"), nil)
+		}
+
+		if err := applyEmailChange(app, userRecord, oldEmail); err != nil {
+			logDescriptiveErrorToLogs(app, "Failed to revert a users email", err)
+			return apis.NewApiError(500, i18n.T(locale, "A problem occured while changing your email"), nil)
+		}
+	}
+
+	_ = token.RemoveToken(app)
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = i18n.T(locale, "The email change has been cancelled")
+
+	return c.JSON(200, res)
+}
+
+/*
+Moves everything tied to the users email onto the new one and saves it
+
+- 2FA identifier
+- tokens
+- email preferences
+- tokenKey is rotated so all existing sessions are logged out
+
+All in one transaction, so a failed save can't leave the 2FA record on an email the account doesn't have
+*/
+func applyEmailChange(app *pocketbase.PocketBase, userRecord *models.Record, newEmail string) error {
+	oldEmail := userRecord.Email()
+	collection := userRecord.Collection()
+
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		// Has to happen before the email is changed as the identifier is built from it
+		if err := twofa.MigrateIdentifier(txDao, userRecord, newEmail); err != nil {
+			return err
+		}
+
+		if err := tokens.MoveUserTokens(txDao, collection, oldEmail, newEmail, emailChangeCancelReason(userRecord.Id)); err != nil {
+			return err
+		}
+
+		if err := emails.MovePreferences(txDao, oldEmail, newEmail); err != nil {
+			return err
+		}
+
+		userRecord.SetEmail(newEmail)
+		userRecord.SetVerified(true)
+		userRecord.Set("tokenKey", security.RandomString(32))
+
+		if err := txDao.SaveRecord(userRecord); err != nil {
+			userRecord.SetEmail(oldEmail)
+			return err
+		}
+		return nil
+	})
+}
+
+func emailChangeConfirmReason(userId string) string {
+	return "emailchange_" + userId
+}
+
+func emailChangeCancelReason(userId string) string {
+	return "emailchangecancel_" + userId
+}
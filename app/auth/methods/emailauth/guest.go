@@ -0,0 +1,46 @@
+package emailauth
+
+import (
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/auth/pow"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/app/user/account"
+)
+
+/*
+Creates a guest account and signs into it
+
+Guests can later sign up with startsignup/finishsignup while signed in to keep everything they made
+*/
+func startGuest(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	if err := pow.VerifyRequest(app, c); err != nil {
+		return err
+	}
+
+	if authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record); authRecord != nil {
+		return apis.NewBadRequestError(i18n.T(locale, "You are already signed in"), nil)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil || !collection.IsAuth() {
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+
+	canCreate, err := app.Dao().CanAccessRecord(nil, apis.RequestInfo(c), collection.CreateRule)
+	if !canCreate {
+		return apis.NewForbiddenError("", err)
+	}
+
+	guestRecord, err := account.CreateGuest(app, collection)
+	if err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to create a guest account", err)
+		return apis.NewApiError(500, i18n.T(locale, "A problem occured while creating your account."), nil)
+	}
+
+	return apis.RecordAuthResponse(app, c, guestRecord, map[string]interface{}{"guest": true})
+}
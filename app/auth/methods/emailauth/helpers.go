@@ -1,11 +1,16 @@
 package emailauth
 
 import (
+	"errors"
 	"net/mail"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
 	"suddsy.dev/m/v2/emails"
 )
 
@@ -17,20 +22,36 @@ func sendEmailWithToken(app *pocketbase.PocketBase, emailData map[string]interfa
 	subject := emailData["subject"].(string)
 	recp := emailData["recp"].(string)
 	recpName := emailData["recpName"].(string)
+	locale := emailData["locale"].(string)
 
-	email, err := emails.LoadEmailDataToHTML(app, "emailAuth", emailData)
+	email, err := emails.RenderEmail(app, "emailAuth", locale, emailData)
 	if err != nil {
 		logDescriptiveErrorToLogs(app, "Failed to write the email data to the html file or load html file", err)
-		return apis.NewApiError(500, "An error occured processing your request", nil)
+		return apis.NewApiError(500, i18n.T(locale, "An error occured processing your request"), nil)
 	}
 
-	go emails.SendCustomEmail(subject, []mail.Address{
+	err = emails.QueueEmail(app, subject, []mail.Address{
 		{Name: recpName, Address: recp},
-	}, email, app)
+	}, email, emails.PriorityLogin)
+	if err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to queue the email", err)
+		return sendErrorResponse(locale, err)
+	}
 
 	return nil
 }
 
+/*
+Suppressed addresses get a message the user can act on, anything else is the generic send error
+*/
+func sendErrorResponse(locale string, err error) error {
+	var suppressedErr *emails.SuppressedError
+	if errors.As(err, &suppressedErr) {
+		return apis.NewBadRequestError(i18n.T(locale, "We can't send emails to this address because earlier emails to it bounced. Please use a different email or contact support"), nil)
+	}
+	return apis.NewApiError(500, i18n.T(locale, "Problem sending email"), nil)
+}
+
 func getUserRecord(app *pocketbase.PocketBase, authCollection *models.Collection, userEmail string) (*models.Record, error) {
 	userRecord, err := app.Dao().FindAuthRecordByEmail(authCollection.Id, userEmail)
 	if err != nil {
@@ -44,3 +65,26 @@ func isValidEmail(email string) bool {
 	_, err := mail.ParseAddress(email)
 	return err == nil
 }
+
+/*
+Loads the website_url env without the trailing /
+
+Errors if it is missing or not a url
+*/
+func getAppURL(app *pocketbase.PocketBase, locale string) (string, error) {
+	appURLEnv, found := os.LookupEnv("website_url")
+	if !found {
+		app.Logger().Error("No website url env found")
+		return "", apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
+	}
+	// Remove the urls trailing /
+	appURLEnv = strings.TrimSuffix(appURLEnv, "/")
+
+	parsedURL, err := url.Parse(appURLEnv)
+	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		app.Logger().Error("App url env invalid type. Not in url format")
+		return "", apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
+	}
+
+	return appURLEnv, nil
+}
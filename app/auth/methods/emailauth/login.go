@@ -1,7 +1,6 @@
 package emailauth
 
 import (
-	"fmt"
 	"net/url"
 	"os"
 	"strings"
@@ -10,29 +9,37 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	twofa "suddsy.dev/m/v2/app/auth/TwoFA"
+	"suddsy.dev/m/v2/app/auth/pow"
 	"suddsy.dev/m/v2/app/auth/tokens"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	if err := pow.VerifyRequest(app, c); err != nil {
+		return err
+	}
+
 	email := c.FormValue("email")
 	collectionIdOrName := c.PathParam("collection")
 
 	if !isValidEmail(email) {
-		return apis.NewBadRequestError("Invalid or missing email", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
 	}
 
 	if !isValidEmail(email) {
-		return apis.NewBadRequestError("Invalid or missing email", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
 	}
 
 	collection, err := app.Dao().FindCollectionByNameOrId(collectionIdOrName)
 	if err != nil {
-		return apis.NewApiError(500, "Invalid auth collection", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
 	}
 
 	userRecord, err := getUserRecord(app, collection, email)
 	if err != nil || userRecord == nil {
-		apis.NewBadRequestError("No user found", nil)
+		apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
 	}
 
 	/*canView, err := app.Dao().CanAccessRecord(userRecord, apis.RequestInfo(c), collection.ViewRule)
@@ -42,13 +49,11 @@ func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
 
 	token, err := tokens.Initialise(email, collection, true).CreateNewToken("emailauthlogin", app)
 	if err != nil {
-		return apis.NewApiError(500, "Problem occured creating a temp auth token", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Problem occured creating a temp auth token"), nil)
 	}
 
-	fmt.Println(token.Value)
-
 	if token.CheckExistingToken() {
-		return apis.NewApiError(500, "A token already exists that hasn't expired", nil)
+		return apis.NewApiError(500, i18n.T(locale, "A token already exists that hasn't expired"), nil)
 	}
 
 	emailData := make(map[string]interface{})
@@ -56,12 +61,12 @@ func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
 	replyToAddress, found := os.LookupEnv("email_reply_to")
 	if !found {
 		app.Logger().Error("No reply to email env found")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 	appURLEnv, found := os.LookupEnv("website_url")
 	if !found {
 		app.Logger().Error("No website url env found")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 	// Remove the urls trailing /
 	appURLEnv = strings.TrimSuffix(appURLEnv, "/")
@@ -69,17 +74,20 @@ func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
 	parsedURL, err := url.Parse(appURLEnv)
 	if err != nil {
 		app.Logger().Error("Error parsing app url env")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 
 	// Check if the URL is valid
 	if parsedURL.Scheme == "" || parsedURL.Host == "" {
 		app.Logger().Error("App url env invalid type. Not in url format")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 
+	emailLocale := i18n.ForRecord(userRecord, c)
+
 	emailData["token"] = token.Value
-	emailData["subject"] = "Login token"
+	emailData["subject"] = i18n.T(emailLocale, "Login token")
+	emailData["locale"] = emailLocale
 	emailData["recp"] = email
 	emailData["replyTo"] = replyToAddress
 
@@ -88,11 +96,11 @@ func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
 	//Save the token to the db
 	_, err = token.Save()
 	if err != nil {
-		return apis.NewApiError(500, "An error occured while trying to save", nil)
+		return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
 	}
 
 	resData := make(map[string]interface{})
-	resData["message"] = "Token email sent to: " + email
+	resData["message"] = i18n.Tf(locale, "Token email sent to: %s", email)
 	resData["code"] = 200
 
 	otp, err := twofa.Load(app, userRecord)
@@ -105,7 +113,9 @@ func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
 
 	err = sendEmailWithToken(app, emailData)
 	if err != nil {
-		return apis.NewApiError(500, "Problem sending email", nil)
+		// The token is useless if the email never goes out
+		_ = token.RemoveToken(app)
+		return err
 	}
 
 	return c.JSON(200, resData)
@@ -113,41 +123,52 @@ func startLogin(app *pocketbase.PocketBase, c echo.Context) error {
 }
 
 func finishLogin(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
 	email := c.FormValue("email")
 	formToken := c.FormValue("token")
 	collectionIdOrName := c.PathParam("collection")
 
 	collection, err := app.Dao().FindCollectionByNameOrId(collectionIdOrName)
 	if err != nil {
-		return apis.NewApiError(500, "Invalid auth collection", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
 	}
 
 	if !isValidEmail(email) {
-		return apis.NewBadRequestError("Invalid or missing email", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
 	}
 
 	token := tokens.Initialise(email, collection, false).RebuildToken(formToken, "emailauthlogin")
 
 	if err := token.Verify(app); err != nil {
-		return apis.NewUnauthorizedError(err.Error(), nil)
+		return apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
 	}
 
 	userRecord, err := getUserRecord(app, collection, email)
 	if err != nil || userRecord == nil {
-		apis.NewBadRequestError("No user found", nil)
+		apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
 	}
 
 	otp, err := twofa.Load(app, userRecord)
-	if err == nil && otp != nil {
+	// A 2FA record that was never confirmed can't be used yet
+	if err == nil && otp != nil && otp.IsEnabled() {
 		err := otp.AuthWith(c.FormValue("2fa"))
 		if err != nil {
-			return apis.NewUnauthorizedError("Invalid 2fa code", nil)
+			return apis.NewUnauthorizedError(i18n.T(locale, "Invalid 2fa code"), nil)
 		}
 	}
 	//End 2FA
 
 	_ = token.RemoveToken(app)
 
-	return apis.RecordAuthResponse(app, c, userRecord, nil)
+	// Secured from a new sign-in email, no session until 2FA is set up
+	if (otp == nil || !otp.IsEnabled()) && requires2FASetup(app, userRecord) {
+		return require2FASetup(app, c, collection, userRecord)
+	}
+
+	return apis.RecordAuthResponse(app, c, userRecord, nil, func(token string) error {
+		checkForNewDevice(app, c, userRecord)
+		return nil
+	})
 
 }
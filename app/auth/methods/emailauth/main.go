@@ -5,12 +5,16 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 func RegisterEmailAuthRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
 	e.Router.POST("/api/collections/:collection/auth-with-sso/:method", func(c echo.Context) error {
 		return handleMethodAsign(c, app)
 	})
+	e.Router.GET("/api/collections/:collection/auth-with-sso/:method", func(c echo.Context) error {
+		return handleGetMethodAsign(c, app)
+	})
 }
 
 func handleMethodAsign(c echo.Context, app *pocketbase.PocketBase) error {
@@ -24,6 +28,30 @@ func handleMethodAsign(c echo.Context, app *pocketbase.PocketBase) error {
 		return startLogin(app, c)
 	case "finishlogin":
 		return finishLogin(app, c)
+	case "guest":
+		return startGuest(app, c)
+	case "securelogin":
+		return secureLogin(app, c)
+	case "start2fasetup":
+		return startForced2FASetup(app, c)
+	case "finish2fasetup":
+		return finishForced2FASetup(app, c)
+	case "startemailchange":
+		return startEmailChange(app, c)
+	case "finishemailchange":
+		return finishEmailChange(app, c)
+	case "cancelemailchange":
+		return cancelEmailChange(app, c)
+	case "confirmoauthlink":
+		return confirmOAuthLink(app, c)
+	}
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
+}
+
+func handleGetMethodAsign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "providers":
+		return listLinkedProviders(app, c)
 	}
-	return apis.NewNotFoundError("Method not found", nil)
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
 }
@@ -0,0 +1,291 @@
+package emailauth
+
+import (
+	"net/mail"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	twofa "suddsy.dev/m/v2/app/auth/TwoFA"
+	"suddsy.dev/m/v2/app/auth/devices"
+	"suddsy.dev/m/v2/app/auth/sessions"
+	"suddsy.dev/m/v2/app/auth/tokens"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/emails"
+)
+
+var (
+	// How long the "this wasn't me" link in a new sign-in email works for
+	secureLoginLinkLifetime = 7 * 24 * time.Hour
+	// How long a login has to set up 2FA once it has been required
+	setup2FALifetime = 15 * time.Minute
+)
+
+/*
+Remembers the device used for a login and emails the user if it hasn't been seen before
+
+Run after the auth response has been built so the session is available
+*/
+func checkForNewDevice(app *pocketbase.PocketBase, c echo.Context, userRecord *models.Record) {
+	device := devices.Identify(c.Request().UserAgent(), c.RealIP())
+
+	hadDevices := devices.HasKnownDevices(app, userRecord)
+
+	isNew, err := devices.Remember(app, userRecord, device)
+	if err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to save the login device", err)
+		return
+	}
+
+	// First tracked login for an account is not suspicious
+	if !isNew || !hadDevices {
+		return
+	}
+
+	sessionId := ""
+	if session, ok := c.Get("session").(*models.Record); ok && session != nil {
+		sessionId = session.Id
+	}
+
+	locale := i18n.ForRecord(userRecord, c)
+
+	go func() {
+		if err := sendNewDeviceEmail(app, userRecord, device, sessionId, locale); err != nil {
+			logDescriptiveErrorToLogs(app, "Failed to send new sign-in email", err)
+		}
+	}()
+}
+
+func sendNewDeviceEmail(app *pocketbase.PocketBase, userRecord *models.Record, device *devices.Device, sessionId string, locale string) error {
+	appURLEnv, err := getAppURL(app, locale)
+	if err != nil {
+		return err
+	}
+	replyToAddress, _ := os.LookupEnv("email_reply_to")
+
+	token, err := tokens.Initialise(userRecord.Email(), userRecord.Collection(), true).CreateNewToken("emailauthsecure", app)
+	if err != nil {
+		return err
+	}
+	if _, err := token.SaveFor(secureLoginLinkLifetime); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("token", token.Value)
+	query.Set("email", userRecord.Email())
+	query.Set("session", sessionId)
+	query.Set("device", device.Fingerprint)
+
+	emailData := make(map[string]interface{})
+	emailData["subject"] = i18n.T(locale, "New sign-in")
+	emailData["recp"] = userRecord.Email()
+	emailData["recpName"] = userRecord.Username()
+	emailData["replyTo"] = replyToAddress
+	emailData["device"] = device.Description()
+	emailData["ip"] = device.IPPrefix
+	emailData["time"] = time.Now().UTC().Format(time.RFC1123)
+	emailData["buttonLink"] = appURLEnv + "/auth/secure?" + query.Encode()
+
+	email, err := emails.RenderEmail(app, "newDevice", locale, emailData)
+	if err != nil {
+		return err
+	}
+
+	return emails.QueueEmail(app, emailData["subject"].(string), []mail.Address{
+		{Name: userRecord.Username(), Address: userRecord.Email()},
+	}, email, emails.PriorityLogin)
+}
+
+/*
+Used from the link in a new sign-in email
+
+Revokes the session that was created by the login, forgets the device and requires 2FA to be set up on the next login
+*/
+func secureLogin(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	email := c.FormValue("email")
+	formToken := c.FormValue("token")
+	collectionIdOrName := c.PathParam("collection")
+
+	collection, err := app.Dao().FindCollectionByNameOrId(collectionIdOrName)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+
+	if !isValidEmail(email) {
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
+	}
+
+	token := tokens.Initialise(email, collection, true).RebuildToken(formToken, "emailauthsecure")
+
+	if err := token.Verify(app); err != nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
+	}
+
+	userRecord, err := getUserRecord(app, collection, email)
+	if err != nil || userRecord == nil {
+		return apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
+	}
+
+	if sessionId := c.FormValue("session"); sessionId != "" {
+		if err := sessions.Revoke(app, userRecord, sessionId); err != nil {
+			logDescriptiveErrorToLogs(app, "Failed to revoke session from new sign-in email", err)
+		}
+	}
+
+	if fingerprint := c.FormValue("device"); fingerprint != "" {
+		_ = devices.Forget(app, userRecord, fingerprint)
+	}
+
+	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
+		"user_flags", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": userRecord.Id, "collectionId": collection.Id},
+	)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Unable to find relation records"), nil)
+	}
+
+	userFlagsRecord.Set("require_2fa", true)
+
+	if err := app.Dao().SaveRecord(userFlagsRecord); err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
+	}
+
+	_ = token.RemoveToken(app)
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = i18n.T(locale, "The sign-in has been revoked. You will need to set up 2FA the next time you login")
+
+	return c.JSON(200, res)
+}
+
+/*
+Answers a login that has to set up 2FA first with a 403 and a setup_token instead of a session
+
+The setup_token only works with start2fasetup and finish2fasetup
+*/
+func require2FASetup(app *pocketbase.PocketBase, c echo.Context, collection *models.Collection, userRecord *models.Record) error {
+	locale := i18n.FromRequest(c)
+
+	token, err := tokens.Initialise(userRecord.Email(), collection, true).CreateNewToken("emailauth2fasetup", app)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Problem occured creating a temp auth token"), nil)
+	}
+	if _, err := token.SaveFor(setup2FALifetime); err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 403
+	res["message"] = i18n.T(locale, "You need to set up 2FA before you can sign in")
+	res["2fa_setup_required"] = true
+	res["setup_token"] = token.Value
+
+	return c.JSON(403, res)
+}
+
+/*
+Creates the 2FA secret for a login that was sent a setup_token
+
+Takes the email and token (the setup_token) form values
+*/
+func startForced2FASetup(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	userRecord, _, err := verify2FASetupToken(app, c)
+	if err != nil {
+		return err
+	}
+
+	// Replace any setup that was started and never finished
+	if otp, err := twofa.Load(app, userRecord); err == nil && otp != nil {
+		if otp.IsEnabled() {
+			return apis.NewBadRequestError(i18n.T(locale, "The 2FA record is already enabled"), nil)
+		}
+		if err := otp.Disable("", true); err != nil {
+			return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
+		}
+	}
+
+	otp, err := twofa.Create(app, userRecord)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, err.Error()), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["secret"] = otp.Secret()
+	res["url"] = otp.URL()
+	res["message"] = i18n.T(locale, "Code verification required")
+
+	return c.JSON(200, res)
+}
+
+/*
+Enables 2FA with the code form value and finishes the login
+*/
+func finishForced2FASetup(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	userRecord, token, err := verify2FASetupToken(app, c)
+	if err != nil {
+		return err
+	}
+
+	otp, err := twofa.Load(app, userRecord)
+	if err != nil || otp == nil {
+		return apis.NewBadRequestError(i18n.T(locale, "2FA not enabled"), nil)
+	}
+	if err := otp.Enable(c.FormValue("code")); err != nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, "Invalid 2fa code"), nil)
+	}
+
+	twofa.ClearRequired(app, userRecord)
+	_ = token.RemoveToken(app)
+
+	return apis.RecordAuthResponse(app, c, userRecord, nil, func(token string) error {
+		checkForNewDevice(app, c, userRecord)
+		return nil
+	})
+}
+
+func verify2FASetupToken(app *pocketbase.PocketBase, c echo.Context) (*models.Record, *tokens.Token, error) {
+	locale := i18n.FromRequest(c)
+
+	email := c.FormValue("email")
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil {
+		return nil, nil, apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+	if !isValidEmail(email) {
+		return nil, nil, apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
+	}
+
+	token := tokens.Initialise(email, collection, true).RebuildToken(c.FormValue("token"), "emailauth2fasetup")
+	if err := token.Verify(app); err != nil {
+		return nil, nil, apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
+	}
+
+	userRecord, err := getUserRecord(app, collection, email)
+	if err != nil || userRecord == nil {
+		return nil, nil, apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
+	}
+
+	return userRecord, token, nil
+}
+
+func requires2FASetup(app *pocketbase.PocketBase, userRecord *models.Record) bool {
+	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
+		"user_flags", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": userRecord.Id, "collectionId": userRecord.Collection().Id},
+	)
+	return err == nil && userFlagsRecord.GetBool("require_2fa")
+}
@@ -6,18 +6,20 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tools/security"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 func EnableFromOAuthUnlink(app *pocketbase.PocketBase, e *core.RecordUnlinkExternalAuthEvent) error {
 	authRecord := e.Record
 	collection := e.Record.Collection()
+	locale := i18n.FromRequest(e.HttpContext)
 
 	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
 		"user_flags", "user = {:userId} && collection = {:collectionId}",
 		dbx.Params{"userId": authRecord.Id, "collectionId": collection.Id},
 	)
 	if err != nil {
-		return apis.NewApiError(500, "Unable to find relation records", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Unable to find relation records"), nil)
 	}
 
 	userFlagsRecord.Set("sso", true)
@@ -25,7 +27,7 @@ func EnableFromOAuthUnlink(app *pocketbase.PocketBase, e *core.RecordUnlinkExter
 	randomPassword := security.RandomString(21)
 	authRecord.SetPassword(randomPassword)
 	if !authRecord.ValidatePassword(randomPassword) {
-		return apis.NewApiError(500, "Failed to validate p", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Failed to validate p"), nil)
 	}
 	authRecord.Set("tokenKey", security.RandomString(32))
 
@@ -0,0 +1,246 @@
+package emailauth
+
+import (
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/auth/tokens"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/app/user/account"
+	"suddsy.dev/m/v2/emails"
+)
+
+var oauthLinkLifetime = 1 * time.Hour
+
+/*
+Decides what to do with an OAuth2 login before pocketbase links or creates the account
+
+  - Already linked or linking while signed in: allowed
+  - New account: marked as sso for the account setup
+  - Email matches an existing account: blocked until the owner of that email confirms the link
+*/
+func HandleOAuth2Login(app *pocketbase.PocketBase, e *core.RecordAuthWithOAuth2Event) error {
+	locale := i18n.FromRequest(e.HttpContext)
+
+	if e.Record == nil {
+		e.HttpContext.Set("sso", true)
+		return nil
+	}
+
+	rel, _ := app.Dao().FindFirstExternalAuthByExpr(dbx.HashExp{
+		"collectionId": e.Collection.Id,
+		"provider":     e.ProviderName,
+		"providerId":   e.OAuth2User.Id,
+	})
+	if rel != nil {
+		return nil
+	}
+
+	loggedAuthRecord, _ := e.HttpContext.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if loggedAuthRecord != nil && loggedAuthRecord.Id == e.Record.Id {
+		return nil
+	}
+
+	// Pocketbase only fills the email if the provider says it is verified
+	if e.OAuth2User.Email == "" || !strings.EqualFold(e.OAuth2User.Email, e.Record.Email()) {
+		return apis.NewForbiddenError(i18n.T(locale, "An account with this email already exists. Sign in with your email to link this provider."), nil)
+	}
+
+	if err := sendOAuthLinkEmail(app, e.Record, e.ProviderName, e.OAuth2User.Id, i18n.ForRecord(e.Record, e.HttpContext)); err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to send the oauth link email", err)
+		return apis.NewApiError(500, i18n.T(locale, "An error occured processing your request"), nil)
+	}
+
+	return apis.NewForbiddenError(i18n.T(locale, "An account with this email already exists. Check your email to link this provider to it."), map[string]any{
+		"link": "pending",
+	})
+}
+
+/*
+Finishes off an OAuth2 login
+
+Runs the account setup for accounts pocketbase just created (it doesn't trigger the create request hooks) and keeps the sso flag up to date
+*/
+func HandleOAuth2LoginComplete(app *pocketbase.PocketBase, e *core.RecordAuthWithOAuth2Event) error {
+	if e.IsNewRecord {
+		return account.NewAccountSetup(&core.RecordCreateEvent{
+			BaseCollectionEvent: core.BaseCollectionEvent{Collection: e.Collection},
+			HttpContext:         e.HttpContext,
+			Record:              e.Record,
+		}, app)
+	}
+
+	return setSSOFlag(app, e.Record)
+}
+
+func sendOAuthLinkEmail(app *pocketbase.PocketBase, userRecord *models.Record, provider string, providerId string, locale string) error {
+	appURLEnv, err := getAppURL(app, locale)
+	if err != nil {
+		return err
+	}
+	replyToAddress, _ := os.LookupEnv("email_reply_to")
+
+	token, err := tokens.Initialise(userRecord.Email(), userRecord.Collection(), true).CreateNewToken(oauthLinkReason(provider, providerId), app)
+	if err != nil {
+		return err
+	}
+	if _, err := token.SaveFor(oauthLinkLifetime); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("token", token.Value)
+	query.Set("email", userRecord.Email())
+	query.Set("provider", provider)
+	query.Set("providerId", providerId)
+
+	emailData := make(map[string]interface{})
+	emailData["token"] = token.Value
+	emailData["subject"] = i18n.Tf(locale, "Link your %s account", provider)
+	emailData["recp"] = userRecord.Email()
+	emailData["recpName"] = userRecord.Username()
+	emailData["replyTo"] = replyToAddress
+	emailData["provider"] = provider
+	emailData["buttonLink"] = appURLEnv + "/auth/oauth/link?" + query.Encode()
+
+	email, err := emails.RenderEmail(app, "oauthLink", locale, emailData)
+	if err != nil {
+		return err
+	}
+
+	return emails.QueueEmail(app, emailData["subject"].(string), []mail.Address{
+		{Name: userRecord.Username(), Address: userRecord.Email()},
+	}, email, emails.PriorityLogin)
+}
+
+/*
+Used from the link in the oauth link email
+
+Links the provider to the existing account so the next OAuth2 login signs straight into it
+*/
+func confirmOAuthLink(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	email := c.FormValue("email")
+	formToken := c.FormValue("token")
+	provider := c.FormValue("provider")
+	providerId := c.FormValue("providerId")
+
+	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
+	}
+
+	if !isValidEmail(email) || provider == "" || providerId == "" {
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing data"), nil)
+	}
+
+	token := tokens.Initialise(email, collection, true).RebuildToken(formToken, oauthLinkReason(provider, providerId))
+
+	if err := token.Verify(app); err != nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
+	}
+
+	userRecord, err := getUserRecord(app, collection, email)
+	if err != nil || userRecord == nil {
+		return apis.NewBadRequestError(i18n.T(locale, "No user found"), nil)
+	}
+
+	rel, _ := app.Dao().FindFirstExternalAuthByExpr(dbx.HashExp{
+		"collectionId": collection.Id,
+		"provider":     provider,
+		"providerId":   providerId,
+	})
+	if rel != nil && rel.RecordId != userRecord.Id {
+		return apis.NewBadRequestError(i18n.T(locale, "This provider account is already linked to another user"), nil)
+	}
+
+	if rel == nil {
+		rel = &models.ExternalAuth{
+			CollectionId: collection.Id,
+			RecordId:     userRecord.Id,
+			Provider:     provider,
+			ProviderId:   providerId,
+		}
+		if err := app.Dao().SaveExternalAuth(rel); err != nil {
+			logDescriptiveErrorToLogs(app, "Failed to save the external auth link", err)
+			return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
+		}
+	}
+
+	if err := setSSOFlag(app, userRecord); err != nil {
+		logDescriptiveErrorToLogs(app, "Failed to update the sso flag", err)
+	}
+
+	_ = token.RemoveToken(app)
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = i18n.Tf(locale, "%s has been linked to your account", provider)
+
+	return c.JSON(200, res)
+}
+
+/*
+Lists the OAuth2 providers linked to the signed in user
+*/
+func listLinkedProviders(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	userRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if userRecord == nil {
+		return apis.NewUnauthorizedError(i18n.T(locale, "You must be signed in to access this"), nil)
+	}
+
+	externalAuths, err := app.Dao().FindAllExternalAuthsByRecord(userRecord)
+	if err != nil {
+		return apis.NewApiError(500, i18n.T(locale, "Unable to load linked providers"), nil)
+	}
+
+	providers := make([]map[string]interface{}, 0, len(externalAuths))
+	for _, externalAuth := range externalAuths {
+		providers = append(providers, map[string]interface{}{
+			"provider": externalAuth.Provider,
+			"created":  externalAuth.Created,
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["providers"] = providers
+
+	return c.JSON(200, res)
+}
+
+/*
+Sets the sso flag once an account has a provider linked to it
+*/
+func setSSOFlag(app *pocketbase.PocketBase, userRecord *models.Record) error {
+	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
+		"user_flags", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": userRecord.Id, "collectionId": userRecord.Collection().Id},
+	)
+	if err != nil {
+		return err
+	}
+
+	if userFlagsRecord.GetBool("sso") {
+		return nil
+	}
+
+	userFlagsRecord.Set("sso", true)
+	return app.Dao().SaveRecord(userFlagsRecord)
+}
+
+func oauthLinkReason(provider string, providerId string) string {
+	return "oauthlink_" + provider + "_" + providerId
+}
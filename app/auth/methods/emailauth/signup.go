@@ -12,21 +12,29 @@ import (
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
 	"github.com/pocketbase/pocketbase/tools/security"
+	"suddsy.dev/m/v2/app/auth/pow"
 	"suddsy.dev/m/v2/app/auth/tokens"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/app/user/account"
 )
 
 func startSignup(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	if err := pow.VerifyRequest(app, c); err != nil {
+		return err
+	}
 
 	email := c.FormValue("email")
 	collectionIdOrName := c.PathParam("collection")
 
 	if !isValidEmail(email) {
-		return apis.NewBadRequestError("Invalid or missing email", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing email"), nil)
 	}
 
 	collection, err := app.Dao().FindCollectionByNameOrId(collectionIdOrName)
 	if err != nil {
-		return apis.NewApiError(500, "Invalid auth collection", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
 	}
 
 	existantRecord, err := getUserRecord(app, collection, email)
@@ -35,7 +43,7 @@ func startSignup(app *pocketbase.PocketBase, c echo.Context) error {
 		if !canView {
 			return apis.NewForbiddenError("", err)
 		}
-		return apis.NewApiError(500, "A user with that email already exists", nil)
+		return apis.NewApiError(500, i18n.T(locale, "A user with that email already exists"), nil)
 	}
 
 	canCreate, err := app.Dao().CanAccessRecord(nil, apis.RequestInfo(c), collection.CreateRule)
@@ -45,7 +53,7 @@ func startSignup(app *pocketbase.PocketBase, c echo.Context) error {
 
 	token, err := tokens.Initialise(email, collection, false).CreateNewToken("emailauthsignup", app)
 	if err != nil {
-		return apis.NewApiError(500, "Problem occured creating a temp auth token", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Problem occured creating a temp auth token"), nil)
 	}
 
 	emailData := make(map[string]interface{})
@@ -53,12 +61,12 @@ func startSignup(app *pocketbase.PocketBase, c echo.Context) error {
 	replyToAddress, found := os.LookupEnv("email_reply_to")
 	if !found {
 		app.Logger().Error("No reply to email env found")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 	appURLEnv, found := os.LookupEnv("website_url")
 	if !found {
 		app.Logger().Error("No website url env found")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 	// Remove the urls trailing /
 	appURLEnv = strings.TrimSuffix(appURLEnv, "/")
@@ -66,17 +74,18 @@ func startSignup(app *pocketbase.PocketBase, c echo.Context) error {
 	parsedURL, err := url.Parse(appURLEnv)
 	if err != nil {
 		app.Logger().Error("Error parsing app url env")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 
 	// Check if the URL is valid
 	if parsedURL.Scheme == "" || parsedURL.Host == "" {
 		app.Logger().Error("App url env invalid type. Not in url format")
-		return apis.NewApiError(500, "Internal server error", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Internal server error"), nil)
 	}
 
 	emailData["token"] = token.Value
-	emailData["subject"] = "Signup confirmation"
+	emailData["subject"] = i18n.T(locale, "Signup confirmation")
+	emailData["locale"] = locale
 	emailData["recp"] = email
 	emailData["replyTo"] = replyToAddress
 	emailData["buttonLink"] = appURLEnv + "/auth/signup/confirm?token=" + token.Value + "&email=" + email
@@ -85,15 +94,20 @@ func startSignup(app *pocketbase.PocketBase, c echo.Context) error {
 	//Save the token to the db
 	_, err = token.Save()
 	if err != nil {
-		return apis.NewApiError(500, "An error occured while trying to save", nil)
+		return apis.NewApiError(500, i18n.T(locale, "An error occured while trying to save"), nil)
 	}
 
-	go sendEmailWithToken(app, emailData)
+	if err := sendEmailWithToken(app, emailData); err != nil {
+		_ = token.RemoveToken(app)
+		return err
+	}
 
-	return c.String(200, "Token email sent to: "+email)
+	return c.String(200, i18n.Tf(locale, "Token email sent to: %s", email))
 }
 
 func finishSignup(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
 	email := c.FormValue("email")
 	username := c.FormValue("username")
 	formToken := c.FormValue("token")
@@ -101,17 +115,17 @@ func finishSignup(app *pocketbase.PocketBase, c echo.Context) error {
 
 	collection, err := app.Dao().FindCollectionByNameOrId(collectionIdOrName)
 	if err != nil {
-		return apis.NewApiError(500, "Invalid auth collection", nil)
+		return apis.NewApiError(500, i18n.T(locale, "Invalid auth collection"), nil)
 	}
 
 	if !isValidEmail(email) || len(username) < 3 {
-		return apis.NewBadRequestError("Invalid or missing data", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "Invalid or missing data"), nil)
 	}
 
 	token := tokens.Initialise(email, collection, false).RebuildToken(formToken, "emailauthsignup")
 
 	if err := token.Verify(app); err != nil {
-		return apis.NewUnauthorizedError(err.Error(), nil)
+		return apis.NewUnauthorizedError(i18n.T(locale, err.Error()), nil)
 	}
 
 	userRecord, err := app.Dao().FindFirstRecordByFilter(
@@ -120,17 +134,31 @@ func finishSignup(app *pocketbase.PocketBase, c echo.Context) error {
 	)
 	if userRecord != nil || err == nil {
 		//Resave the token
-		return apis.NewBadRequestError("A user with that email/username has already been registered.", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "A user with that email/username has already been registered."), nil)
 	} else {
 		_ = token.RemoveToken(app)
 	}
 
+	// Guests keep their account (and everything in it) when they sign up
+	if guestRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record); guestRecord != nil && guestRecord.Collection().Id == collection.Id && account.IsGuest(app, guestRecord) {
+		if err := account.UpgradeGuest(app, guestRecord, email, username, locale); err != nil {
+			logDescriptiveErrorToLogs(app, "Failed to upgrade a guest account", err)
+			return apis.NewApiError(500, i18n.T(locale, "A problem occured while creating your account."), nil)
+		}
+
+		return apis.RecordAuthResponse(app, c, guestRecord, nil, func(token string) error {
+			checkForNewDevice(app, c, guestRecord)
+			return nil
+		})
+	}
+
 	//Create the new user
 
 	newUserRecord := models.NewRecord(collection)
 
 	newUserRecord.Set("username", username)
 	newUserRecord.Set("email", email)
+	newUserRecord.Set("locale", locale)
 
 	// Set the users password
 	randomPassword := security.RandomString(33)
@@ -138,7 +166,7 @@ func finishSignup(app *pocketbase.PocketBase, c echo.Context) error {
 	newUserRecord.SetPassword(randomPassword)
 	if !newUserRecord.ValidatePassword(randomPassword) {
 		logDescriptiveErrorToLogs(app, "Failed to validate the random password when creating a new user", nil)
-		return apis.NewApiError(500, "A problem occured while creating your account.", nil)
+		return apis.NewApiError(500, i18n.T(locale, "A problem occured while creating your account."), nil)
 	}
 
 	newUserRecord.Set("tokenKey", randomTokenKey)
@@ -146,11 +174,11 @@ func finishSignup(app *pocketbase.PocketBase, c echo.Context) error {
 	canAccess, err := app.Dao().CanAccessRecord(newUserRecord, apis.RequestInfo(c), newUserRecord.Collection().CreateRule)
 	if !canAccess || err != nil {
 		logDescriptiveErrorToLogs(app, "Create rule not allowing account creation for request", collection.Name)
-		return apis.NewApiError(500, "A problem occured while creating your account.", nil)
+		return apis.NewApiError(500, i18n.T(locale, "A problem occured while creating your account."), nil)
 	}
 
 	if err := app.Dao().SaveRecord(newUserRecord); err != nil {
-		return apis.NewApiError(500, "A problem occured while creating your account.", nil)
+		return apis.NewApiError(500, i18n.T(locale, "A problem occured while creating your account."), nil)
 	}
 	// Create a new instance of RecordCreateEvent
 	event := &core.RecordCreateEvent{
@@ -162,8 +190,11 @@ func finishSignup(app *pocketbase.PocketBase, c echo.Context) error {
 
 	err = app.OnRecordAfterCreateRequest(collection.Id).Trigger(event)
 	if err != nil {
-		return apis.NewApiError(500, "A problem occured while creating your account.", nil)
+		return apis.NewApiError(500, i18n.T(locale, "A problem occured while creating your account."), nil)
 	}
 
-	return apis.RecordAuthResponse(app, c, newUserRecord, nil)
+	return apis.RecordAuthResponse(app, c, newUserRecord, nil, func(token string) error {
+		checkForNewDevice(app, c, newUserRecord)
+		return nil
+	})
 }
@@ -0,0 +1,172 @@
+package oidc
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+var authorizationCodeLifetime = 1 * time.Minute
+
+type authRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func readAuthRequest(c echo.Context) *authRequest {
+	return &authRequest{
+		ResponseType:        c.FormValue("response_type"),
+		ClientId:            c.FormValue("client_id"),
+		RedirectURI:         c.FormValue("redirect_uri"),
+		Scope:               c.FormValue("scope"),
+		State:               c.FormValue("state"),
+		Nonce:               c.FormValue("nonce"),
+		CodeChallenge:       c.FormValue("code_challenge"),
+		CodeChallengeMethod: c.FormValue("code_challenge_method"),
+	}
+}
+
+/*
+The authorization endpoint
+
+Checks the request then sends the browser to the website to sign in with the normal email login. The website posts the same parameters back to finishAuthorize once signed in
+*/
+func startAuthorize(app *pocketbase.PocketBase, c echo.Context) error {
+	request := readAuthRequest(c)
+
+	client, err := findClient(app, request.ClientId)
+	if err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+	// Never redirect to a uri that isn't registered
+	if !isRedirectURIAllowed(client, request.RedirectURI) {
+		return apis.NewBadRequestError("Invalid redirect_uri", nil)
+	}
+
+	if code, description := validateAuthRequest(client, request); code != "" {
+		return c.Redirect(302, buildRedirect(request, url.Values{"error": {code}, "error_description": {description}}))
+	}
+
+	appURLEnv, found := os.LookupEnv("website_url")
+	if !found {
+		app.Logger().Error("No website url env found")
+		return apis.NewApiError(500, "Internal server error", nil)
+	}
+
+	return c.Redirect(302, strings.TrimSuffix(appURLEnv, "/")+"/auth/oidc?"+c.Request().URL.RawQuery)
+}
+
+/*
+Called by the website once the user has signed in and agreed
+
+Returns the url to send the browser back to the client with
+*/
+func finishAuthorize(app *pocketbase.PocketBase, c echo.Context) error {
+	authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if authRecord == nil {
+		return apis.NewUnauthorizedError("You must be signed in to access this", nil)
+	}
+
+	request := readAuthRequest(c)
+
+	client, err := findClient(app, request.ClientId)
+	if err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+	if !isRedirectURIAllowed(client, request.RedirectURI) {
+		return apis.NewBadRequestError("Invalid redirect_uri", nil)
+	}
+
+	if code, description := validateAuthRequest(client, request); code != "" {
+		return c.JSON(200, map[string]interface{}{
+			"redirect": buildRedirect(request, url.Values{"error": {code}, "error_description": {description}}),
+		})
+	}
+
+	if c.FormValue("action") == "deny" {
+		return c.JSON(200, map[string]interface{}{
+			"redirect": buildRedirect(request, url.Values{"error": {"access_denied"}}),
+		})
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("oidc_codes")
+	if err != nil {
+		app.Logger().Error("oidc_codes Collection was not found. Please create it to use this feature.")
+		return apis.NewApiError(500, "Internal server error", nil)
+	}
+
+	code := security.RandomString(40)
+
+	record := models.NewRecord(collection)
+	record.Set("code", security.SHA256(code))
+	record.Set("client_id", request.ClientId)
+	record.Set("user", authRecord.Id)
+	record.Set("auth_collection_id", authRecord.Collection().Id)
+	record.Set("redirect_uri", request.RedirectURI)
+	record.Set("scope", request.Scope)
+	record.Set("nonce", request.Nonce)
+	record.Set("code_challenge", request.CodeChallenge)
+	record.Set("expires", time.Now().UTC().Add(authorizationCodeLifetime))
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return apis.NewApiError(500, "An error occured while trying to save", nil)
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"redirect": buildRedirect(request, url.Values{"code": {code}}),
+	})
+}
+
+//Extra helper functions:
+
+/*
+Returns an oauth error code and description if the request is not allowed
+*/
+func validateAuthRequest(client *models.Record, request *authRequest) (string, string) {
+	if request.ResponseType != "code" {
+		return "unsupported_response_type", "Only the code response type is supported"
+	}
+	if !hasScope(request.Scope, "openid") {
+		return "invalid_scope", "The openid scope is required"
+	}
+	if request.CodeChallenge != "" && request.CodeChallengeMethod != "S256" {
+		return "invalid_request", "Only the S256 code challenge method is supported"
+	}
+	if isPublicClient(client) && request.CodeChallenge == "" {
+		return "invalid_request", "Public clients must use PKCE"
+	}
+	return "", ""
+}
+
+func buildRedirect(request *authRequest, query url.Values) string {
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	separator := "?"
+	if strings.Contains(request.RedirectURI, "?") {
+		separator = "&"
+	}
+	return request.RedirectURI + separator + query.Encode()
+}
+
+func hasScope(scopes string, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package oidc
+
+import (
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+/*
+Finds a registered client by its client id
+*/
+func findClient(app *pocketbase.PocketBase, clientId string) (*models.Record, error) {
+	if clientId == "" {
+		return nil, NewOIDCError("Missing client_id")
+	}
+	record, err := app.Dao().FindFirstRecordByData("oidc_clients", "client_id", clientId)
+	if err != nil || record == nil {
+		return nil, NewOIDCError("Unknown client")
+	}
+	return record, nil
+}
+
+/*
+Redirect uris must match one of the registered ones exactly
+
+Stored one per line
+*/
+func isRedirectURIAllowed(client *models.Record, redirectURI string) bool {
+	if redirectURI == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(client.GetString("redirect_uris"), "\n") {
+		if strings.TrimSpace(allowed) == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Public clients (eg. single page apps) have no secret and must use PKCE instead
+
+The secret is stored as a sha256 hash
+*/
+func authenticateClient(client *models.Record, secret string) bool {
+	if isPublicClient(client) {
+		return true
+	}
+	return secret != "" && security.Equal(security.SHA256(secret), client.GetString("client_secret"))
+}
+
+func isPublicClient(client *models.Record) bool {
+	return client.GetBool("public")
+}
@@ -0,0 +1,19 @@
+package oidc
+
+import "fmt"
+
+type OIDCError struct {
+	Message string
+}
+
+// Error implements the error interface for OIDCError
+func (e *OIDCError) Error() string {
+	return e.Message
+}
+
+// NewOIDCError creates a new OIDCError with the given message
+func NewOIDCError(format string, a ...interface{}) error {
+	return &OIDCError{
+		Message: fmt.Sprintf(format, a...),
+	}
+}
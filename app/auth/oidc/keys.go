@@ -0,0 +1,221 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var (
+	// A new signing key is made after this long
+	keyRotationPeriod = 30 * 24 * time.Hour
+	// Old keys stay in the jwks long enough for tokens signed with them to expire
+	keyRetention = 2 * keyRotationPeriod
+
+	keysCacheLifetime = 5 * time.Minute
+
+	keysMutex    sync.Mutex
+	loadedKeys   []*signingKey
+	keysLoadedAt time.Time
+)
+
+type signingKey struct {
+	id      string
+	key     *rsa.PrivateKey
+	created time.Time
+}
+
+/*
+Loads the signing keys, newest first
+
+Creates the first key if there are none
+*/
+func loadKeys(app *pocketbase.PocketBase) ([]*signingKey, error) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	if len(loadedKeys) > 0 && time.Since(keysLoadedAt) <= keysCacheLifetime {
+		return loadedKeys, nil
+	}
+
+	records, err := app.Dao().FindRecordsByFilter("oidc_keys", "kid != ''", "-created", 0, 0)
+	if err != nil {
+		return nil, NewOIDCError("oidc_keys Collection was not found. Please create it to use this feature.")
+	}
+
+	if len(records) == 0 {
+		record, err := createKeyRecord(app)
+		if err != nil {
+			return nil, err
+		}
+		records = []*models.Record{record}
+	}
+
+	keys := make([]*signingKey, 0, len(records))
+	for _, record := range records {
+		block, _ := pem.Decode([]byte(record.GetString("private_key")))
+		if block == nil {
+			return nil, NewOIDCError("Signing key %s is not valid pem", record.GetString("kid"))
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, NewOIDCError("Signing key %s is not a valid rsa key", record.GetString("kid"))
+		}
+		keys = append(keys, &signingKey{
+			id:      record.GetString("kid"),
+			key:     key,
+			created: record.Created.Time(),
+		})
+	}
+
+	loadedKeys = keys
+	keysLoadedAt = time.Now().UTC()
+
+	return loadedKeys, nil
+}
+
+/*
+The key new tokens are signed with
+*/
+func currentKey(app *pocketbase.PocketBase) (*signingKey, error) {
+	keys, err := loadKeys(app)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+/*
+Adds a new signing key and removes keys past their retention
+*/
+func RotateKeys(app *pocketbase.PocketBase) error {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	if _, err := createKeyRecord(app); err != nil {
+		return err
+	}
+
+	cutoff, _ := types.ParseDateTime(time.Now().UTC().Add(-keyRetention))
+	_, err := app.Dao().DB().
+		NewQuery("DELETE FROM oidc_keys WHERE created < {:cutoff}").
+		Bind(dbx.Params{"cutoff": cutoff.String()}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	// Force a reload next time they are needed
+	loadedKeys = nil
+
+	return nil
+}
+
+/*
+Checks once a day if the current signing key is due to be rotated
+*/
+func EnableKeyRotationCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	scheduler.MustAdd("OIDCKeyRotation", "0 3 * * *", func() {
+		key, err := currentKey(app)
+		if err != nil {
+			app.Logger().Error("Failed to load the oidc signing keys", "details", err)
+			return
+		}
+		if time.Since(key.created) < keyRotationPeriod {
+			return
+		}
+		if err := RotateKeys(app); err != nil {
+			app.Logger().Error("Failed to rotate the oidc signing keys", "details", err)
+		}
+	})
+	return nil
+}
+
+func (key *signingKey) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.key)
+}
+
+func (key *signingKey) publicJWK() map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": key.id,
+		"n":   base64.RawURLEncoding.EncodeToString(key.key.PublicKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.key.PublicKey.E)).Bytes()),
+	}
+}
+
+/*
+Parses a token signed by one of our keys
+*/
+func verifyToken(app *pocketbase.PocketBase, tokenString string) (jwt.MapClaims, error) {
+	keys, err := loadKeys(app)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, NewOIDCError("Unexpected signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range keys {
+			if key.id == kid {
+				return &key.key.PublicKey, nil
+			}
+		}
+		return nil, NewOIDCError("Unknown signing key")
+	})
+	if err != nil || !token.Valid {
+		return nil, NewOIDCError("Invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !claims.VerifyIssuer(getIssuer(app), true) {
+		return nil, NewOIDCError("Invalid token")
+	}
+	return claims, nil
+}
+
+// Must hold keysMutex
+func createKeyRecord(app *pocketbase.PocketBase) (*models.Record, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId("oidc_keys")
+	if err != nil {
+		return nil, NewOIDCError("oidc_keys Collection was not found. Please create it to use this feature.")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, NewOIDCError("Failed to generate a signing key")
+	}
+
+	privateKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	record := models.NewRecord(collection)
+	record.Set("kid", security.RandomString(16))
+	record.Set("private_key", string(privateKey))
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, NewOIDCError("Failed to save the signing key.\n%s", err)
+	}
+	return record, nil
+}
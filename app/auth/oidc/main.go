@@ -0,0 +1,110 @@
+package oidc
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+/*
+OpenID Connect provider so other apps can "Sign in with noti"
+
+Collections used:
+  - oidc_clients: registered relying parties and their redirect uris
+  - oidc_codes: authorization codes waiting to be exchanged
+  - oidc_keys: the rsa signing keys, rotated by a cron
+*/
+func RegisterOIDCRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.GET("/.well-known/openid-configuration", func(c echo.Context) error {
+		return getDiscoveryDocument(app, c)
+	})
+	e.Router.GET("/api/oidc/:method", func(c echo.Context) error {
+		return handleGetMethodAssign(c, app)
+	})
+	e.Router.POST("/api/oidc/:method", func(c echo.Context) error {
+		return handlePostMethodAssign(c, app)
+	})
+}
+
+func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "jwks":
+		return getJWKS(app, c)
+	case "authorize":
+		return startAuthorize(app, c)
+	case "userinfo":
+		return getUserInfo(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handlePostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "authorize":
+		return finishAuthorize(app, c)
+	case "token":
+		return exchangeToken(app, c)
+	case "userinfo":
+		return getUserInfo(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func getDiscoveryDocument(app *pocketbase.PocketBase, c echo.Context) error {
+	issuer := getIssuer(app)
+
+	return c.JSON(200, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/api/oidc/authorize",
+		"token_endpoint":                        issuer + "/api/oidc/token",
+		"userinfo_endpoint":                     issuer + "/api/oidc/userinfo",
+		"jwks_uri":                              issuer + "/api/oidc/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "email", "email_verified", "name", "preferred_username"},
+	})
+}
+
+func getJWKS(app *pocketbase.PocketBase, c echo.Context) error {
+	keys, err := loadKeys(app)
+	if err != nil {
+		app.Logger().Error("Failed to load the oidc signing keys", "details", err)
+		return apis.NewApiError(500, "Internal server error", nil)
+	}
+
+	jwks := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		jwks = append(jwks, key.publicJWK())
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"keys": jwks,
+	})
+}
+
+//Extra helper functions:
+
+/*
+The public url of this server, from the application url in the pocketbase settings
+*/
+func getIssuer(app *pocketbase.PocketBase) string {
+	return strings.TrimSuffix(app.Settings().Meta.AppUrl, "/")
+}
+
+/*
+Errors in the format OAuth2 clients expect
+*/
+func oauthError(c echo.Context, status int, code string, description string) error {
+	return c.JSON(status, map[string]interface{}{
+		"error":             code,
+		"error_description": description,
+	})
+}
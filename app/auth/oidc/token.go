@@ -0,0 +1,153 @@
+package oidc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+var accessTokenLifetime = 1 * time.Hour
+
+/*
+The token endpoint, swaps an authorization code for an id token and access token
+*/
+func exchangeToken(app *pocketbase.PocketBase, c echo.Context) error {
+	if c.FormValue("grant_type") != "authorization_code" {
+		return oauthError(c, 400, "unsupported_grant_type", "Only the authorization_code grant is supported")
+	}
+
+	clientId, clientSecret, ok := c.Request().BasicAuth()
+	if !ok {
+		clientId = c.FormValue("client_id")
+		clientSecret = c.FormValue("client_secret")
+	}
+
+	client, err := findClient(app, clientId)
+	if err != nil || !authenticateClient(client, clientSecret) {
+		return oauthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	codeRecord, err := app.Dao().FindFirstRecordByData("oidc_codes", "code", security.SHA256(c.FormValue("code")))
+	if err != nil || codeRecord == nil {
+		return oauthError(c, 400, "invalid_grant", "Invalid authorization code")
+	}
+
+	// Codes can only be used once, even if the exchange fails
+	if err := app.Dao().DeleteRecord(codeRecord); err != nil {
+		return oauthError(c, 500, "server_error", "An error occured processing your request")
+	}
+
+	if time.Now().UTC().After(codeRecord.GetDateTime("expires").Time()) {
+		return oauthError(c, 400, "invalid_grant", "Authorization code expired")
+	}
+	if codeRecord.GetString("client_id") != clientId || codeRecord.GetString("redirect_uri") != c.FormValue("redirect_uri") {
+		return oauthError(c, 400, "invalid_grant", "Authorization code was not issued to this client")
+	}
+
+	if challenge := codeRecord.GetString("code_challenge"); challenge != "" {
+		verifier := c.FormValue("code_verifier")
+		if verifier == "" || !security.Equal(security.S256Challenge(verifier), challenge) {
+			return oauthError(c, 400, "invalid_grant", "Invalid code_verifier")
+		}
+	}
+
+	userRecord, err := app.Dao().FindRecordById(codeRecord.GetString("auth_collection_id"), codeRecord.GetString("user"))
+	if err != nil || userRecord == nil {
+		return oauthError(c, 400, "invalid_grant", "User not found")
+	}
+
+	key, err := currentKey(app)
+	if err != nil {
+		app.Logger().Error("Failed to load the oidc signing keys", "details", err)
+		return oauthError(c, 500, "server_error", "An error occured processing your request")
+	}
+
+	scope := codeRecord.GetString("scope")
+	now := time.Now().UTC()
+
+	idTokenClaims := userClaims(userRecord, scope)
+	idTokenClaims["iss"] = getIssuer(app)
+	idTokenClaims["aud"] = clientId
+	idTokenClaims["iat"] = now.Unix()
+	idTokenClaims["exp"] = now.Add(accessTokenLifetime).Unix()
+	if nonce := codeRecord.GetString("nonce"); nonce != "" {
+		idTokenClaims["nonce"] = nonce
+	}
+
+	idToken, err := key.sign(idTokenClaims)
+	if err != nil {
+		return oauthError(c, 500, "server_error", "An error occured processing your request")
+	}
+
+	accessToken, err := key.sign(jwt.MapClaims{
+		"iss":          getIssuer(app),
+		"sub":          userRecord.Id,
+		"aud":          clientId,
+		"iat":          now.Unix(),
+		"exp":          now.Add(accessTokenLifetime).Unix(),
+		"scope":        scope,
+		"collectionId": userRecord.Collection().Id,
+		"token_use":    "access",
+	})
+	if err != nil {
+		return oauthError(c, 500, "server_error", "An error occured processing your request")
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	return c.JSON(200, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"id_token":     idToken,
+		"scope":        scope,
+	})
+}
+
+/*
+The userinfo endpoint, returns the claims allowed by the access tokens scope
+*/
+func getUserInfo(app *pocketbase.PocketBase, c echo.Context) error {
+	tokenString := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+
+	claims, err := verifyToken(app, tokenString)
+	if err != nil || claims["token_use"] != "access" {
+		c.Response().Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return oauthError(c, 401, "invalid_token", "Invalid access token")
+	}
+
+	collectionId, _ := claims["collectionId"].(string)
+	userId, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+
+	userRecord, err := app.Dao().FindRecordById(collectionId, userId)
+	if err != nil || userRecord == nil {
+		return oauthError(c, 401, "invalid_token", "User not found")
+	}
+
+	return c.JSON(200, userClaims(userRecord, scope))
+}
+
+//Extra helper functions:
+
+func userClaims(userRecord *models.Record, scope string) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub": userRecord.Id,
+	}
+	if hasScope(scope, "email") {
+		claims["email"] = userRecord.Email()
+		claims["email_verified"] = userRecord.Verified()
+	}
+	if hasScope(scope, "profile") {
+		claims["preferred_username"] = userRecord.Username()
+		if name := userRecord.GetString("name"); name != "" {
+			claims["name"] = name
+		}
+	}
+	return claims
+}
@@ -0,0 +1,19 @@
+package pow
+
+import "fmt"
+
+type PowError struct {
+	Message string
+}
+
+// Error implements the error interface for PowError
+func (e *PowError) Error() string {
+	return e.Message
+}
+
+// NewPowError creates a new PowError with the given message
+func NewPowError(format string, a ...interface{}) error {
+	return &PowError{
+		Message: fmt.Sprintf(format, a...),
+	}
+}
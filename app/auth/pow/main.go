@@ -0,0 +1,279 @@
+package pow
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+/*
+A self hosted proof-of-work challenge for the unauthenticated auth endpoints.
+
+The client fetches a signed challenge, then searches for a nonce where
+sha256(challenge + nonce) starts with at least `difficulty` zero bits.
+
+Enabled with the env POW_CHALLENGE=true
+*/
+
+var (
+	baseDifficulty = 16
+	maxDifficulty  = 24
+
+	// How long an issued challenge can be solved for
+	challengeLifetime = 5 * time.Minute
+
+	// Requests per minute before the difficulty starts to go up
+	loadThreshold = 30
+
+	secret     []byte
+	secretOnce sync.Once
+	usedMutex  sync.Mutex
+	used       = make(map[string]time.Time)
+	loadMutex  sync.Mutex
+	recentHits []time.Time
+)
+
+type Challenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+	Expires    int64  `json:"expires"`
+}
+
+func IsEnabled() bool {
+	val, found := os.LookupEnv("POW_CHALLENGE")
+	return found && val == "true"
+}
+
+/*
+Creates a new signed challenge
+
+The difficulty is worked out from the current load at the time of issue
+*/
+func Issue() *Challenge {
+	difficulty := currentDifficulty()
+	expires := time.Now().UTC().Add(challengeLifetime).Unix()
+
+	payload := security.RandomString(16) + "." + strconv.FormatInt(expires, 10) + "." + strconv.Itoa(difficulty)
+
+	return &Challenge{
+		Challenge:  base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + sign(payload),
+		Difficulty: difficulty,
+		Expires:    expires,
+	}
+}
+
+/*
+Checks the challenge was issued by us, has not expired or been used and that the nonce solves it
+
+A challenge can only be used once. Used challenges are saved to the pow_used collection until they expire
+so they can't be replayed after a restart when pow_secret is set
+*/
+func Verify(app *pocketbase.PocketBase, challenge string, nonce string) error {
+	if challenge == "" || nonce == "" {
+		return NewPowError("Missing proof-of-work challenge")
+	}
+
+	encodedPayload, signature, found := strings.Cut(challenge, ".")
+	if !found {
+		return NewPowError("Invalid proof-of-work challenge")
+	}
+
+	rawPayload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return NewPowError("Invalid proof-of-work challenge")
+	}
+	payload := string(rawPayload)
+
+	if !hmac.Equal([]byte(sign(payload)), []byte(signature)) {
+		return NewPowError("Invalid proof-of-work challenge")
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return NewPowError("Invalid proof-of-work challenge")
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return NewPowError("Invalid proof-of-work challenge")
+	}
+	if time.Now().UTC().After(time.Unix(expires, 0)) {
+		return NewPowError("Proof-of-work challenge expired")
+	}
+
+	difficulty, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return NewPowError("Invalid proof-of-work challenge")
+	}
+
+	if leadingZeroBits(challenge+nonce) < difficulty {
+		return NewPowError("Invalid proof-of-work solution")
+	}
+
+	usedMutex.Lock()
+	defer usedMutex.Unlock()
+
+	removeExpiredChallenges()
+
+	if _, ok := used[challenge]; ok {
+		return NewPowError("Proof-of-work challenge already used")
+	}
+	if err := saveUsedChallenge(app, challenge, time.Unix(expires, 0)); err != nil {
+		return err
+	}
+	used[challenge] = time.Unix(expires, 0)
+
+	return nil
+}
+
+/*
+Removes used challenges that have expired from the pow_used collection every hour
+*/
+func EnableCleanupCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	if _, err := app.Dao().FindCollectionByNameOrId("pow_used"); err != nil {
+		if _, found := os.LookupEnv("pow_secret"); found && IsEnabled() {
+			app.Logger().Error("pow_used Collection was not found. Please create it to use this feature. Solved challenges can be replayed after a restart")
+		}
+		return nil
+	}
+
+	scheduler.MustAdd("PowCleanup", "0 * * * *", func() {
+		_, err := app.Dao().DB().
+			NewQuery("DELETE FROM pow_used WHERE expires < {:now}").
+			Bind(dbx.Params{"now": types.NowDateTime().String()}).
+			Execute()
+		if err != nil {
+			app.Logger().Error("Failed to remove expired proof-of-work challenges", "details", err)
+		}
+	})
+	return nil
+}
+
+/*
+Records a hit against one of the protected endpoints
+
+Used to raise the difficulty when under load
+*/
+func RecordHit() {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	now := time.Now().UTC()
+	recentHits = append(recentHits, now)
+
+	// Drop hits older than a minute
+	cutoff := now.Add(-1 * time.Minute)
+	i := 0
+	for i < len(recentHits) && recentHits[i].Before(cutoff) {
+		i++
+	}
+	recentHits = recentHits[i:]
+}
+
+//Extra helper functions:
+
+/*
+Adds one bit of difficulty for every doubling of the load over the threshold
+*/
+func currentDifficulty() int {
+	loadMutex.Lock()
+	hits := 0
+	cutoff := time.Now().UTC().Add(-1 * time.Minute)
+	for _, hit := range recentHits {
+		if hit.After(cutoff) {
+			hits++
+		}
+	}
+	loadMutex.Unlock()
+
+	difficulty := baseDifficulty
+	for load := hits; load > loadThreshold && difficulty < maxDifficulty; load /= 2 {
+		difficulty++
+	}
+	return difficulty
+}
+
+func leadingZeroBits(value string) int {
+	sum := sha256.Sum256([]byte(value))
+	count := 0
+	for _, b := range sum {
+		if b == 0 {
+			count += 8
+			continue
+		}
+		count += bits.LeadingZeros8(b)
+		break
+	}
+	return count
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, loadSecret())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Must hold usedMutex
+func removeExpiredChallenges() {
+	now := time.Now().UTC()
+	for challenge, expires := range used {
+		if now.After(expires) {
+			delete(used, challenge)
+		}
+	}
+}
+
+/*
+Saves a hash of the challenge. A unique index on pow_used.challenge makes this fail if another instance saw it first
+
+Does nothing if the collection doesn't exist, the in memory list is still checked
+*/
+func saveUsedChallenge(app *pocketbase.PocketBase, challenge string, expires time.Time) error {
+	collection, err := app.Dao().FindCollectionByNameOrId("pow_used")
+	if err != nil {
+		return nil
+	}
+
+	hash := security.SHA256(challenge)
+	if _, err := app.Dao().FindFirstRecordByData("pow_used", "challenge", hash); err == nil {
+		return NewPowError("Proof-of-work challenge already used")
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("challenge", hash)
+	record.Set("expires", expires.UTC())
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return NewPowError("Proof-of-work challenge already used")
+	}
+	return nil
+}
+
+/*
+Uses the pow_secret env if set, so challenges survive a restart. Otherwise a random secret is used
+
+Read on first use rather than at init so the .env file has been loaded by then
+*/
+func loadSecret() []byte {
+	secretOnce.Do(func() {
+		if val, found := os.LookupEnv("pow_secret"); found && val != "" {
+			secret = []byte(val)
+			return
+		}
+		secret = []byte(security.RandomString(32))
+	})
+	return secret
+}
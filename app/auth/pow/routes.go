@@ -0,0 +1,40 @@
+package pow
+
+import (
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func RegisterPowRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.GET("/api/pow/challenge", func(c echo.Context) error {
+		return getChallenge(c)
+	})
+}
+
+func getChallenge(c echo.Context) error {
+	if !IsEnabled() {
+		return apis.NewNotFoundError("Proof-of-work is not enabled", nil)
+	}
+
+	return c.JSON(200, Issue())
+}
+
+/*
+Checks the request includes a solved challenge (form values `pow_challenge` and `pow_nonce`)
+
+Does nothing if proof-of-work is not enabled
+*/
+func VerifyRequest(app *pocketbase.PocketBase, c echo.Context) error {
+	if !IsEnabled() {
+		return nil
+	}
+
+	RecordHit()
+
+	if err := Verify(app, c.FormValue("pow_challenge"), c.FormValue("pow_nonce")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package sessions
+
+import "fmt"
+
+type SessionError struct {
+	Message string
+}
+
+// Error implements the error interface for SessionError
+func (e *SessionError) Error() string {
+	return e.Message
+}
+
+// NewSessionError creates a new SessionError with the given message
+func NewSessionError(format string, a ...interface{}) error {
+	return &SessionError{
+		Message: fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,174 @@
+package sessions
+
+import (
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+/*
+Keeps a record of every auth token handed out so a single device can be logged out
+
+Stored in the "sessions" collection. The token itself is never stored, only its hash
+*/
+
+// How often last_seen is written for a session, stops a db write on every request
+var lastSeenInterval = 1 * time.Minute
+
+/*
+Records the session for a newly issued auth token
+
+If the request was made with an existing session token (eg. an auth refresh) that session is moved onto the new token instead of creating a new one
+*/
+func HandleAuthEvent(app *pocketbase.PocketBase, e *core.RecordAuthEvent) error {
+	if e.Token == "" || e.Record == nil {
+		return nil
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("sessions")
+	if err != nil {
+		// Don't block logins for setups that haven't created the collection
+		app.Logger().Error("sessions Collection was not found. Please create it to use this feature.")
+		return nil
+	}
+
+	session, err := findSessionByToken(app, getRequestToken(e.HttpContext))
+	if err != nil || session == nil || session.GetString("user") != e.Record.Id {
+		session = models.NewRecord(collection)
+		session.Set("user", e.Record.Id)
+		session.Set("collection", e.Record.Collection().Id)
+		session.Set("revoked", false)
+	}
+
+	now := time.Now().UTC()
+
+	session.Set("token", security.SHA256(e.Token))
+	session.Set("user_agent", e.HttpContext.Request().UserAgent())
+	session.Set("ip", e.HttpContext.RealIP())
+	session.Set("last_seen", now)
+	session.Set("expires", now.Add(time.Duration(app.Settings().RecordAuthToken.Duration)*time.Second))
+
+	if err := app.Dao().SaveRecord(session); err != nil {
+		return NewSessionError("Failed to save session.\n%s", err)
+	}
+
+	// Make the session available to anything else handling this login
+	e.HttpContext.Set("session", session)
+
+	return nil
+}
+
+/*
+Rejects requests made with a revoked session token and keeps last_seen up to date
+
+Tokens that have no session (eg. issued before sessions were added) are let through
+*/
+func RequireActiveSession(app *pocketbase.PocketBase) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := getRequestToken(c)
+			if token == "" {
+				return next(c)
+			}
+
+			session, err := findSessionByToken(app, token)
+			if err != nil || session == nil {
+				return next(c)
+			}
+
+			if session.GetBool("revoked") {
+				return apis.NewUnauthorizedError("This session has been revoked", nil)
+			}
+
+			if time.Now().UTC().After(session.GetDateTime("last_seen").Time().Add(lastSeenInterval)) {
+				session.Set("last_seen", time.Now().UTC())
+				session.Set("ip", c.RealIP())
+				if err := app.Dao().SaveRecord(session); err != nil {
+					app.Logger().Error("Failed to update session last seen", "details", err)
+				}
+			}
+
+			c.Set("session", session)
+
+			return next(c)
+		}
+	}
+}
+
+/*
+Lists the active sessions for an auth record, newest first
+*/
+func List(app *pocketbase.PocketBase, authRecord *models.Record) ([]*models.Record, error) {
+	return app.Dao().FindRecordsByFilter(
+		"sessions", "user = {:userId} && collection = {:collectionId} && revoked = false && expires > {:now}",
+		"-last_seen", 0, 0,
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id, "now": types.NowDateTime().String()},
+	)
+}
+
+/*
+Revokes one of an auth records sessions
+
+The session is kept (as revoked) until it expires so the token is rejected
+*/
+func Revoke(app *pocketbase.PocketBase, authRecord *models.Record, sessionId string) error {
+	session, err := app.Dao().FindFirstRecordByFilter(
+		"sessions", "id = {:id} && user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"id": sessionId, "userId": authRecord.Id, "collectionId": authRecord.Collection().Id},
+	)
+	if err != nil || session == nil {
+		return NewSessionError("Session not found")
+	}
+
+	session.Set("revoked", true)
+
+	if err := app.Dao().SaveRecord(session); err != nil {
+		return NewSessionError("Failed to revoke session.\n%s", err)
+	}
+	return nil
+}
+
+/*
+Removes sessions that have expired every hour
+*/
+func EnableCleanupCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	if _, err := app.Dao().FindCollectionByNameOrId("sessions"); err != nil {
+		return nil
+	}
+
+	scheduler.MustAdd("SessionCleanup", "0 * * * *", func() {
+		_, err := app.Dao().DB().
+			NewQuery("DELETE FROM sessions WHERE expires < {:now}").
+			Bind(dbx.Params{"now": types.NowDateTime().String()}).
+			Execute()
+		if err != nil {
+			app.Logger().Error("Failed to remove expired sessions", "details", err)
+		}
+	})
+	return nil
+}
+
+//Extra helper functions:
+
+func getRequestToken(c echo.Context) string {
+	if c == nil {
+		return ""
+	}
+	return strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+}
+
+func findSessionByToken(app *pocketbase.PocketBase, token string) (*models.Record, error) {
+	if token == "" {
+		return nil, NewSessionError("No token provided")
+	}
+	return app.Dao().FindFirstRecordByData("sessions", "token", security.SHA256(token))
+}
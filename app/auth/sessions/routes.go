@@ -0,0 +1,87 @@
+package sessions
+
+import (
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func RegisterSessionRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.Use(RequireActiveSession(app))
+
+	e.Router.GET("/api/collections/:collection/sessions/:method", func(c echo.Context) error {
+		return handleGetMethodAssign(c, app)
+	})
+	e.Router.POST("/api/collections/:collection/sessions/:method", func(c echo.Context) error {
+		return handlePostMethodAssign(c, app)
+	})
+}
+
+func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "list":
+		return listSessions(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handlePostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "revoke":
+		return revokeSession(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func listSessions(app *pocketbase.PocketBase, c echo.Context) error {
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+	if record == nil {
+		return apis.NewForbiddenError("", nil)
+	}
+
+	sessionRecords, err := List(app, record)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load sessions", nil)
+	}
+
+	current, _ := c.Get("session").(*models.Record)
+
+	items := make([]map[string]interface{}, 0, len(sessionRecords))
+	for _, session := range sessionRecords {
+		items = append(items, map[string]interface{}{
+			"id":         session.Id,
+			"user_agent": session.GetString("user_agent"),
+			"ip":         session.GetString("ip"),
+			"created":    session.Created,
+			"last_seen":  session.GetDateTime("last_seen"),
+			"current":    current != nil && current.Id == session.Id,
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["sessions"] = items
+
+	return c.JSON(200, res)
+}
+
+func revokeSession(app *pocketbase.PocketBase, c echo.Context) error {
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+	if record == nil {
+		return apis.NewForbiddenError("", nil)
+	}
+
+	if err := Revoke(app, record, c.FormValue("session")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Session revoked"
+
+	return c.JSON(200, res)
+}
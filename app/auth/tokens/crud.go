@@ -6,6 +6,7 @@ import (
 
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
 	"github.com/pocketbase/pocketbase/models"
 	"github.com/pocketbase/pocketbase/tools/security"
 )
@@ -76,6 +77,17 @@ Writes to db. Sets expirey time to 5 min from now
 Returns an updated token
 */
 func (token *Token) Save() (*Token, error) {
+	return token.SaveFor(5 * time.Minute)
+}
+
+/*
+Saves the token
+
+Writes to db. Sets expirey time to the given lifetime from now
+
+Returns an updated token
+*/
+func (token *Token) SaveFor(lifetime time.Duration) (*Token, error) {
 
 	//Check the user exists
 	record, err := token.User.findUserRecord(token.App)
@@ -88,7 +100,7 @@ func (token *Token) Save() (*Token, error) {
 		return nil, NewTokenError("User %s found in collection %s. When the user is marked as should not exist", token.User.Email, token.User.Collection.Name)
 	}
 
-	tokenExpiryDate := time.Now().UTC().Add(5 * time.Minute)
+	tokenExpiryDate := time.Now().UTC().Add(lifetime)
 
 	collection, err := token.App.Dao().FindCollectionByNameOrId("tokens")
 	if err != nil {
@@ -212,3 +224,29 @@ func (token *Token) CheckExistingToken() bool {
 		return false
 	}
 }
+
+/*
+Removes every token for a reason in an auth collection, no matter which email it belongs to
+
+Used when the email for a token isn't known eg. cancelling an email change
+*/
+func RemoveTokensByReason(app *pocketbase.PocketBase, collection *models.Collection, reason string) error {
+	_, err := app.Dao().DB().
+		NewQuery("DELETE FROM tokens WHERE auth_collection_id = {:collectionId} AND reason = {:reason}").
+		Bind(dbx.Params{"collectionId": collection.Id, "reason": reason}).
+		Execute()
+	return err
+}
+
+/*
+Moves a users tokens onto a new email so they stay valid after an email change
+
+Tokens with the keepReason are left on the old email
+*/
+func MoveUserTokens(dao *daos.Dao, collection *models.Collection, oldEmail string, newEmail string, keepReason string) error {
+	_, err := dao.DB().
+		NewQuery("UPDATE tokens SET user_email = {:newEmail} WHERE user_email = {:oldEmail} AND auth_collection_id = {:collectionId} AND reason != {:keepReason}").
+		Bind(dbx.Params{"newEmail": newEmail, "oldEmail": oldEmail, "collectionId": collection.Id, "keepReason": keepReason}).
+		Execute()
+	return err
+}
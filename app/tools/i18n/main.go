@@ -0,0 +1,189 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+/*
+Message catalogs for the api errors and email subjects
+
+The english message is the key, so a missing translation just falls back to english. Catalogs are the json files in ./locales
+*/
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var catalogs = loadCatalogs()
+
+/*
+The locale used when the user has none and the request doesn't say. Set with the default_locale env
+*/
+func DefaultLocale() string {
+	if val, found := os.LookupEnv("default_locale"); found && val != "" {
+		return normalize(val)
+	}
+	return "en"
+}
+
+/*
+Translates a message into the locale
+
+Falls back to the base language (eg. pt for pt-br), then the default locale, then the message itself
+*/
+func T(locale string, message string) string {
+	for _, candidate := range Candidates(locale) {
+		if catalog, ok := catalogs[candidate]; ok {
+			if translated, ok := catalog[message]; ok && translated != "" {
+				return translated
+			}
+		}
+	}
+	return message
+}
+
+/*
+Translates a message with fmt style args
+*/
+func Tf(locale string, format string, a ...interface{}) string {
+	return fmt.Sprintf(T(locale, format), a...)
+}
+
+/*
+The locales to try in order for a locale, ending with the default locale
+*/
+func Candidates(locale string) []string {
+	locale = normalize(locale)
+	candidates := []string{}
+	if locale != "" {
+		candidates = append(candidates, locale)
+		if base, _, found := strings.Cut(locale, "-"); found {
+			candidates = append(candidates, base)
+		}
+	}
+	if defaultLocale := DefaultLocale(); !contains(candidates, defaultLocale) {
+		candidates = append(candidates, defaultLocale)
+	}
+	return candidates
+}
+
+/*
+Works out the locale for a request
+
+Uses the signed in users locale, then the Accept-Language header, then the default locale
+*/
+func FromRequest(c echo.Context) string {
+	if authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record); authRecord != nil {
+		if locale := authRecord.GetString("locale"); locale != "" {
+			return normalize(locale)
+		}
+	}
+	return fromAcceptLanguage(c.Request().Header.Get("Accept-Language"))
+}
+
+/*
+Works out the locale for a user that isn't signed in yet (eg. sending a login email)
+
+Uses the users locale, falling back to the request
+*/
+func ForRecord(record *models.Record, c echo.Context) string {
+	if record != nil {
+		if locale := record.GetString("locale"); locale != "" {
+			return normalize(locale)
+		}
+	}
+	if c == nil {
+		return DefaultLocale()
+	}
+	return FromRequest(c)
+}
+
+//Extra helper functions:
+
+func loadCatalogs() map[string]map[string]string {
+	loaded := make(map[string]map[string]string)
+
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return loaded
+	}
+
+	for _, file := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			continue
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			continue
+		}
+		loaded[normalize(strings.TrimSuffix(file.Name(), ".json"))] = catalog
+	}
+
+	return loaded
+}
+
+/*
+Picks the highest weighted language we have a catalog for
+*/
+func fromAcceptLanguage(header string) string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+
+	languages := []weighted{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		languages = append(languages, weighted{locale: normalize(tag), q: q})
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+
+	for _, language := range languages {
+		if _, ok := catalogs[language.locale]; ok {
+			return language.locale
+		}
+		if base, _, found := strings.Cut(language.locale, "-"); found {
+			if _, ok := catalogs[base]; ok {
+				return base
+			}
+		}
+	}
+
+	return DefaultLocale()
+}
+
+func normalize(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -7,21 +7,32 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 /*
-These routes can only be accesed by the "admins" collection
+The flags routes can only be accesed by the "admins" collection
+
+The email preferences routes are for the signed in user
 */
 func HandleRegisterRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
 	e.Router.POST("/api/collections/:collection/flags/update", func(c echo.Context) error {
 		return updateFlagsDynamic(c, app)
 	})
+	e.Router.GET("/api/collections/:collection/email-preferences/:method", func(c echo.Context) error {
+		return handleGetPreferencesMethodAssign(c, app)
+	})
+	e.Router.POST("/api/collections/:collection/email-preferences/:method", func(c echo.Context) error {
+		return handlePostPreferencesMethodAssign(c, app)
+	})
 }
 
 func updateFlagsDynamic(c echo.Context, app *pocketbase.PocketBase) error {
+	locale := i18n.FromRequest(c)
+
 	authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 	if authRecord == nil || authRecord.Collection().Name != "admins" {
-		return apis.NewUnauthorizedError("You must be signed in to access this", nil)
+		return apis.NewUnauthorizedError(i18n.T(locale, "You must be signed in to access this"), nil)
 	}
 
 	collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collection"))
@@ -29,7 +40,7 @@ func updateFlagsDynamic(c echo.Context, app *pocketbase.PocketBase) error {
 		return err
 	}
 	if collection.Type != "auth" {
-		return apis.NewNotFoundError("Auth collection not found", nil)
+		return apis.NewNotFoundError(i18n.T(locale, "Auth collection not found"), nil)
 	}
 
 	values, err := c.FormValues()
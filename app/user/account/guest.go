@@ -0,0 +1,190 @@
+package account
+
+import (
+	"net/mail"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/emails"
+)
+
+var (
+	guestQuota         int64 = 2000000
+	guestMaxUploadSize int64 = 1000000
+	// Guests that haven't signed up by then are deleted
+	guestLifetime = 7 * 24 * time.Hour
+)
+
+/*
+Creates a guest account with its own preview page
+
+Guests have no email, tight quotas and expire unless upgraded with UpgradeGuest
+*/
+func CreateGuest(app *pocketbase.PocketBase, collection *models.Collection) (*models.Record, error) {
+	guestRecord := models.NewRecord(collection)
+
+	guestRecord.Set("username", "guest_"+security.RandomStringWithAlphabet(10, "abcdefghijklmnopqrstuvwxyz0123456789"))
+
+	randomPassword := security.RandomString(33)
+	guestRecord.SetPassword(randomPassword)
+	guestRecord.Set("tokenKey", security.RandomString(32))
+
+	userFlagsCollection, err := app.Dao().FindCollectionByNameOrId("user_flags")
+	if err != nil {
+		return nil, err
+	}
+
+	// All or nothing so a failure can't leave a guest without flags, which would never expire
+	err = app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		if err := txDao.SaveRecord(guestRecord); err != nil {
+			return err
+		}
+
+		if _, err := createPreviewPageWith(txDao, guestRecord.Id); err != nil {
+			return err
+		}
+
+		newUserFlagsRecord := models.NewRecord(userFlagsCollection)
+
+		newUserFlagsRecord.Set("user", guestRecord.Id)
+		newUserFlagsRecord.Set("collection", collection.Id)
+		newUserFlagsRecord.Set("maxUploadSize", guestMaxUploadSize)
+		newUserFlagsRecord.Set("quota", guestQuota)
+		newUserFlagsRecord.Set("guest", true)
+		newUserFlagsRecord.Set("guest_expires", time.Now().UTC().Add(guestLifetime))
+
+		return txDao.SaveRecord(newUserFlagsRecord)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return guestRecord, nil
+}
+
+/*
+Checks if an auth record is a guest account
+*/
+func IsGuest(app *pocketbase.PocketBase, authRecord *models.Record) bool {
+	if authRecord == nil {
+		return false
+	}
+	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
+		"user_flags", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": authRecord.Id, "collectionId": authRecord.Collection().Id},
+	)
+	return err == nil && userFlagsRecord.GetBool("guest")
+}
+
+/*
+Turns a guest into a full account in place, so all their pages and files are kept
+
+Sends the welcome email
+*/
+func UpgradeGuest(app *pocketbase.PocketBase, guestRecord *models.Record, email string, username string, locale string) error {
+	userFlagsRecord, err := app.Dao().FindFirstRecordByFilter(
+		"user_flags", "user = {:userId} && collection = {:collectionId}",
+		dbx.Params{"userId": guestRecord.Id, "collectionId": guestRecord.Collection().Id},
+	)
+	if err != nil {
+		return err
+	}
+
+	guestRecord.SetEmail(email)
+	guestRecord.SetUsername(username)
+	guestRecord.SetVerified(true)
+	guestRecord.Set("locale", locale)
+	randomPassword := security.RandomString(33)
+	guestRecord.SetPassword(randomPassword)
+	guestRecord.Set("tokenKey", security.RandomString(32))
+
+	userFlagsRecord.Set("guest", false)
+	userFlagsRecord.Set("guest_expires", nil)
+	userFlagsRecord.Set("maxUploadSize", defaultMaxUploadSize)
+	userFlagsRecord.Set("quota", starterQuota)
+
+	err = app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		if err := txDao.SaveRecord(guestRecord); err != nil {
+			return err
+		}
+		return txDao.SaveRecord(userFlagsRecord)
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		emailData := make(map[string]interface{})
+		emailData["recp"] = guestRecord.Email()
+		emailData["recpName"] = guestRecord.Username()
+
+		email, err := emails.RenderEmail(app, "welcome", locale, emailData)
+		if err != nil {
+			return
+		}
+
+		err = emails.QueueEmail(app, i18n.T(locale, "Welcome"), []mail.Address{
+			{Name: guestRecord.Username(), Address: guestRecord.Email()},
+		}, email, emails.PriorityWelcome)
+		if err != nil {
+			app.Logger().Error("Failed to queue the welcome email", "details", err)
+		}
+	}()
+
+	return nil
+}
+
+/*
+Deletes expired guest accounts, with their pages and flags, every hour
+*/
+func EnableGuestExpiryCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	scheduler.MustAdd("GuestExpiry", "30 * * * *", func() {
+		expiredFlags, err := app.Dao().FindRecordsByFilter(
+			"user_flags", "guest = true && guest_expires != '' && guest_expires < {:now}",
+			"", 0, 0,
+			dbx.Params{"now": types.NowDateTime().String()},
+		)
+		if err != nil {
+			return
+		}
+
+		for _, flags := range expiredFlags {
+			if err := deleteGuest(app, flags); err != nil {
+				app.Logger().Error("Failed to delete expired guest", "details", err)
+			}
+		}
+	})
+	return nil
+}
+
+func deleteGuest(app *pocketbase.PocketBase, flags *models.Record) error {
+	// All or nothing, so a failure can't leave pages or flags behind for a user that is gone
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		pageRecords, err := txDao.FindRecordsByFilter(
+			"pages", "owner = {:userId}", "", 0, 0,
+			dbx.Params{"userId": flags.GetString("user")},
+		)
+		if err == nil {
+			for _, page := range pageRecords {
+				if err := txDao.DeleteRecord(page); err != nil {
+					return err
+				}
+			}
+		}
+
+		if guestRecord, err := txDao.FindRecordById(flags.GetString("collection"), flags.GetString("user")); err == nil {
+			if err := txDao.DeleteRecord(guestRecord); err != nil {
+				return err
+			}
+		}
+
+		return txDao.DeleteRecord(flags)
+	})
+}
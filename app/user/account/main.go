@@ -10,8 +10,10 @@ import (
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
 	"github.com/pocketbase/pocketbase/models"
 	"suddsy.dev/m/v2/app/tools"
+	"suddsy.dev/m/v2/app/tools/i18n"
 	"suddsy.dev/m/v2/emails"
 )
 
@@ -64,15 +66,24 @@ func NewAccountSetup(e *core.RecordCreateEvent, app *pocketbase.PocketBase) erro
 		return err
 	}
 
+	locale := i18n.ForRecord(e.Record, e.HttpContext)
+
 	go func() {
-		email, err := emails.LoadEmailDataToHTML(app, "welcome", nil)
+		emailData := make(map[string]interface{})
+		emailData["recp"] = e.Record.Email()
+		emailData["recpName"] = e.Record.Username()
+
+		email, err := emails.RenderEmail(app, "welcome", locale, emailData)
 		if err != nil {
 			return
 		}
 
-		emails.SendCustomEmail("Welcome", []mail.Address{
+		err = emails.QueueEmail(app, i18n.T(locale, "Welcome"), []mail.Address{
 			{Name: e.Record.Username(), Address: e.Record.Email()},
-		}, email, app)
+		}, email, emails.PriorityWelcome)
+		if err != nil {
+			app.Logger().Error("Failed to queue the welcome email", "details", err)
+		}
 	}()
 
 	return nil
@@ -108,6 +119,13 @@ Creates the welcome page
 - Used to create the first page for a new user
 */
 func CreatePreviewPage(app *pocketbase.PocketBase, user string) (string, error) {
+	return createPreviewPageWith(app.Dao(), user)
+}
+
+/*
+CreatePreviewPage using the given dao, so it can be part of a transaction
+*/
+func createPreviewPageWith(dao *daos.Dao, user string) (string, error) {
 	WorkingDir := tools.GetWorkDir()
 	type Page struct {
 		Content  json.RawMessage `json:"content"`
@@ -129,7 +147,7 @@ func CreatePreviewPage(app *pocketbase.PocketBase, user string) (string, error)
 			return "", nil
 		}
 
-		collection, err := app.Dao().FindCollectionByNameOrId("pages")
+		collection, err := dao.FindCollectionByNameOrId("pages")
 		if err != nil {
 			return "", nil
 		}
@@ -148,8 +166,8 @@ func CreatePreviewPage(app *pocketbase.PocketBase, user string) (string, error)
 		record.Set("icon", previewPage.Icon)
 		record.Set("unsplash", previewPage.Unsplash)
 
-		if err := app.Dao().SaveRecord(record); err != nil {
-			return "", nil
+		if err := dao.SaveRecord(record); err != nil {
+			return "", err
 		}
 		return record.Id, nil
 	}
@@ -0,0 +1,69 @@
+package account
+
+import (
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/emails"
+)
+
+func handleGetPreferencesMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "list":
+		return listEmailPreferences(app, c)
+	}
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
+}
+
+func handlePostPreferencesMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "update":
+		return updateEmailPreference(app, c)
+	}
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
+}
+
+/*
+Returns which email categories the signed in user gets
+*/
+func listEmailPreferences(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if authRecord == nil || authRecord.Email() == "" {
+		return apis.NewUnauthorizedError(i18n.T(locale, "You must be signed in to access this"), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["preferences"] = emails.Preferences(app, authRecord.Email())
+
+	return c.JSON(200, res)
+}
+
+/*
+Turns a category on or off with the category and subscribed form values
+
+Security emails can't be turned off
+*/
+func updateEmailPreference(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if authRecord == nil || authRecord.Email() == "" {
+		return apis.NewUnauthorizedError(i18n.T(locale, "You must be signed in to access this"), nil)
+	}
+
+	subscribed := c.FormValue("subscribed") == "true"
+	if err := emails.SetSubscribed(app, authRecord.Email(), c.FormValue("category"), subscribed); err != nil {
+		return apis.NewBadRequestError(i18n.T(locale, err.Error()), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["preferences"] = emails.Preferences(app, authRecord.Email())
+
+	return c.JSON(200, res)
+}
@@ -0,0 +1,342 @@
+package digests
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/dbutils"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/emails"
+)
+
+const (
+	StatusSending = "sending"
+	StatusSent    = "sent"
+	StatusEmpty   = "empty"
+	StatusFailed  = "failed"
+)
+
+var (
+	digestBatchSize = 200
+	// Pages listed in the email, the rest are counted as "and x more"
+	digestShownPages = 10
+	digestMaxPages   = 100
+
+	digestRunning sync.Mutex
+)
+
+/*
+Sends every user a weekly summary of the pages they edited and the pages shared with them
+
+It goes out on digest_day (default monday) at digest_hour (default 9) in the users timezone field,
+falling back to the digest_timezone env and then UTC. Uses the weeklyDigest template and the digests email preference.
+
+Each user and week is claimed in the email_digests collection before anything is sent,
+so a restart or an overlapping run never sends the same digest twice. Failed digests are retried on the next run. The unique (user, period) index
+this needs is added to the collection when the cron starts
+*/
+func EnableDigestCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	collection, err := app.Dao().FindCollectionByNameOrId("email_digests")
+	if err != nil {
+		app.Logger().Error("email_digests Collection was not found. Please create it to use this feature.")
+		return nil
+	}
+	if err := ensureDigestIndex(app, collection); err != nil {
+		app.Logger().Error("Failed to add the unique (user, period) index to email_digests, a digest could be sent twice when running more than one instance", "details", err)
+	}
+
+	scheduler.MustAdd("EmailDigests", "*/15 * * * *", func() {
+		SendDueDigests(app, time.Now())
+	})
+	return nil
+}
+
+/*
+Sends the digest to everyone whose digest time this week has passed and hasn't had it yet
+*/
+func SendDueDigests(app *pocketbase.PocketBase, now time.Time) {
+	if !digestRunning.TryLock() {
+		return
+	}
+	defer digestRunning.Unlock()
+
+	for offset := 0; ; offset += digestBatchSize {
+		users, err := app.Dao().FindRecordsByFilter("users", "email != ''", "created", digestBatchSize, offset)
+		if err != nil {
+			app.Logger().Error("Failed to load users for the digest", "details", err)
+			return
+		}
+
+		for _, userRecord := range users {
+			if err := sendDigest(app, userRecord, now); err != nil {
+				app.Logger().Error("Failed to send a digest", "user", userRecord.Id, "details", err)
+			}
+		}
+
+		if len(users) < digestBatchSize {
+			return
+		}
+	}
+}
+
+//Extra helper functions:
+
+func sendDigest(app *pocketbase.PocketBase, userRecord *models.Record, now time.Time) error {
+	location := userLocation(userRecord)
+	until := digestTime(now.In(location))
+	since := until.AddDate(0, 0, -7)
+
+	// Not due yet, or the account didn't exist for the whole week
+	if now.Before(until) || userRecord.Created.Time().After(since) {
+		return nil
+	}
+	if emails.IsUnsubscribed(app, userRecord.Email(), emails.CategoryDigests) {
+		return nil
+	}
+
+	year, week := until.ISOWeek()
+	period := fmt.Sprintf("weekly:%d-W%02d", year, week)
+
+	digestRecord, err := claimDigest(app, userRecord, period)
+	if err != nil || digestRecord == nil {
+		return err
+	}
+
+	locale := i18n.ForRecord(userRecord, nil)
+	edited, err := findPages(app, "owner = {:user} && updated >= {:since} && updated < {:until}", userRecord, since, until)
+	if err != nil {
+		return finishDigest(app, digestRecord, StatusFailed, 0, err)
+	}
+	shared := []*models.Record{}
+	if hasSharing(app) {
+		shared, err = findPages(app, "shared_with ~ {:user} && owner != {:user} && updated >= {:since} && updated < {:until}", userRecord, since, until)
+		if err != nil {
+			return finishDigest(app, digestRecord, StatusFailed, 0, err)
+		}
+	}
+
+	total := len(edited) + len(shared)
+	if total == 0 {
+		return finishDigest(app, digestRecord, StatusEmpty, 0, nil)
+	}
+
+	data := make(map[string]interface{})
+	data["recp"] = userRecord.Email()
+	data["recpName"] = userRecord.Username()
+	data["since"] = since.Format("2 Jan 2006")
+	data["until"] = until.Format("2 Jan 2006")
+	data["buttonLink"] = websiteURL(app)
+	data["edited"], data["editedMore"] = pageLinks(app, edited, locale)
+	data["shared"], data["sharedMore"] = pageLinks(app, shared, locale)
+
+	email, err := emails.RenderEmail(app, "weeklyDigest", locale, data)
+	if err != nil {
+		return finishDigest(app, digestRecord, StatusFailed, total, err)
+	}
+
+	err = emails.QueueEmail(app, i18n.T(locale, "Your weekly summary"), []mail.Address{
+		{Name: userRecord.Username(), Address: userRecord.Email()},
+	}, email, emails.PriorityDigest)
+	if err != nil {
+		return finishDigest(app, digestRecord, StatusFailed, total, err)
+	}
+
+	return finishDigest(app, digestRecord, StatusSent, total, nil)
+}
+
+/*
+Saves the email_digests record for the user and week. Returns nil if it is already being sent or was sent
+
+A failed digest is claimed again so it is retried on the next run. Other errors are returned
+so a failing save isn't mistaken for another instance having sent it
+*/
+func claimDigest(app *pocketbase.PocketBase, userRecord *models.Record, period string) (*models.Record, error) {
+	existing, err := app.Dao().FindFirstRecordByFilter(
+		"email_digests", "user = {:user} && period = {:period}",
+		dbx.Params{"user": userRecord.Id, "period": period},
+	)
+	if err == nil {
+		if existing.GetString("status") != StatusFailed {
+			return nil, nil
+		}
+		return reclaimFailedDigest(app, existing)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("email_digests")
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("user", userRecord.Id)
+	record.Set("period", period)
+	record.Set("status", StatusSending)
+	// The unique index on (user, period) makes this fail if another instance got there first
+	if err := app.Dao().SaveRecord(record); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+/*
+Moves a failed digest back to sending in one statement, so only one instance can retry it
+*/
+func reclaimFailedDigest(app *pocketbase.PocketBase, record *models.Record) (*models.Record, error) {
+	result, err := app.Dao().DB().
+		NewQuery("UPDATE email_digests SET status = {:sending}, updated = {:now} WHERE id = {:id} AND status = {:failed}").
+		Bind(dbx.Params{
+			"sending": StatusSending,
+			"failed":  StatusFailed,
+			"now":     types.NowDateTime().String(),
+			"id":      record.Id,
+		}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows != 1 {
+		return nil, nil
+	}
+
+	return app.Dao().FindRecordById("email_digests", record.Id)
+}
+
+/*
+Adds the unique (user, period) index that claimDigest relies on if the collection doesn't have one
+*/
+func ensureDigestIndex(app *pocketbase.PocketBase, collection *models.Collection) error {
+	for _, raw := range collection.Indexes {
+		index := dbutils.ParseIndex(raw)
+		if !index.Unique || len(index.Columns) != 2 {
+			continue
+		}
+		columns := map[string]bool{}
+		for _, column := range index.Columns {
+			columns[strings.Trim(column.Name, "`\"[]")] = true
+		}
+		if columns["user"] && columns["period"] {
+			return nil
+		}
+	}
+
+	collection.Indexes = append(collection.Indexes, "CREATE UNIQUE INDEX `idx_email_digests_user_period` ON `email_digests` (`user`, `period`)")
+	return app.Dao().SaveCollection(collection)
+}
+
+func finishDigest(app *pocketbase.PocketBase, record *models.Record, status string, pages int, cause error) error {
+	record.Set("status", status)
+	record.Set("pages", pages)
+	if status == StatusSent {
+		record.Set("sent_at", types.NowDateTime())
+	}
+	if cause != nil {
+		record.Set("last_error", cause.Error())
+	} else {
+		record.Set("last_error", "")
+	}
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return err
+	}
+	return cause
+}
+
+func findPages(app *pocketbase.PocketBase, filter string, userRecord *models.Record, since time.Time, until time.Time) ([]*models.Record, error) {
+	sinceDate, _ := types.ParseDateTime(since)
+	untilDate, _ := types.ParseDateTime(until)
+
+	return app.Dao().FindRecordsByFilter(
+		"pages", filter, "-updated", digestMaxPages, 0,
+		dbx.Params{"user": userRecord.Id, "since": sinceDate.String(), "until": untilDate.String()},
+	)
+}
+
+/*
+Pages can only be shared with other users if the pages collection has a shared_with relation field
+*/
+func hasSharing(app *pocketbase.PocketBase) bool {
+	collection, err := app.Dao().FindCollectionByNameOrId("pages")
+	return err == nil && collection.Schema.GetFieldByName("shared_with") != nil
+}
+
+func pageLinks(app *pocketbase.PocketBase, pages []*models.Record, locale string) ([]map[string]interface{}, int) {
+	links := []map[string]interface{}{}
+	for i, page := range pages {
+		if i == digestShownPages {
+			break
+		}
+
+		title := page.GetString("title")
+		if title == "" {
+			title = i18n.T(locale, "Untitled page")
+		}
+		links = append(links, map[string]interface{}{
+			"title": title,
+			"link":  websiteURL(app) + "/page/" + page.Id,
+		})
+	}
+	return links, len(pages) - len(links)
+}
+
+/*
+This weeks digest time for the user. Weeks start on monday like ISO weeks
+*/
+func digestTime(localNow time.Time) time.Time {
+	daysSinceMonday := (int(localNow.Weekday()) + 6) % 7
+	monday := time.Date(localNow.Year(), localNow.Month(), localNow.Day()-daysSinceMonday, 0, 0, 0, 0, localNow.Location())
+
+	daysAfterMonday := (int(digestDay()) + 6) % 7
+	return time.Date(monday.Year(), monday.Month(), monday.Day()+daysAfterMonday, digestHour(), 0, 0, 0, localNow.Location())
+}
+
+func userLocation(userRecord *models.Record) *time.Location {
+	if location, err := time.LoadLocation(userRecord.GetString("timezone")); err == nil && userRecord.GetString("timezone") != "" {
+		return location
+	}
+	if timezone, found := os.LookupEnv("digest_timezone"); found {
+		if location, err := time.LoadLocation(timezone); err == nil {
+			return location
+		}
+	}
+	return time.UTC
+}
+
+func digestDay() time.Weekday {
+	day, _ := os.LookupEnv("digest_day")
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if strings.EqualFold(day, weekday.String()) {
+			return weekday
+		}
+	}
+	return time.Monday
+}
+
+func digestHour() int {
+	if value, found := os.LookupEnv("digest_hour"); found {
+		if hour, err := strconv.Atoi(value); err == nil && hour >= 0 && hour < 24 {
+			return hour
+		}
+	}
+	return 9
+}
+
+func websiteURL(app *pocketbase.PocketBase) string {
+	if appURLEnv, found := os.LookupEnv("website_url"); found {
+		return strings.TrimSuffix(appURLEnv, "/")
+	}
+	return strings.TrimSuffix(app.Settings().Meta.AppUrl, "/")
+}
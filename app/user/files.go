@@ -11,6 +11,7 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 /*
@@ -24,38 +25,96 @@ func HandleCreateEvent(e *core.RecordCreateEvent, app *pocketbase.PocketBase) er
 		return apis.NewUnauthorizedError("You must be signed in to access this", nil)
 	}
 
+	_, fs, _ := e.HttpContext.Request().FormFile("file_data")
+	uploadedFileSize := int(fs.Size)
+
+	if err := CheckUploadQuota(app, authRecord, uploadedFileSize, 0, i18n.FromRequest(e.HttpContext)); err != nil {
+		return err
+	}
+
+	// Saved with the upload, the usage hooks add it to user_usage in the same transaction
+	e.Record.Set("size", uploadedFileSize)
+
+	return nil
+}
+
+/*
+Run before a file is updated through the api
+
+The size always comes from the uploaded file, a size sent by the client is rejected.
+A bigger replacement file is checked against the owners quota for the difference
+*/
+func HandleUpdateEvent(e *core.RecordUpdateEvent, app *pocketbase.PocketBase) error {
+	for key := range apis.RequestInfo(e.HttpContext).Data {
+		if strings.TrimRight(key, "+-") == "size" {
+			return apis.NewBadRequestError("The size is set from the uploaded file and can't be changed", nil)
+		}
+	}
+
+	original, err := app.Dao().FindRecordById(e.Record.Collection().Id, e.Record.Id)
+	if err != nil {
+		return apis.NewNotFoundError("", nil)
+	}
+
+	size := original.GetInt("size")
+	if uploaded := e.UploadedFiles["file_data"]; len(uploaded) > 0 {
+		size = int(uploaded[len(uploaded)-1].Size)
+	} else if e.Record.GetString("file_data") == "" {
+		size = 0
+	}
+	e.Record.Set("size", size)
+
+	// Admins editing from the dashboard aren't held to the quota
+	if admin, _ := e.HttpContext.Get(apis.ContextAdminKey).(*models.Admin); admin != nil {
+		return nil
+	}
+
+	// Only the extra size counts when the owner stays the same, user_usage already has the old file
+	alreadyCounted := 0
+	if original.GetString("owner") == e.Record.GetString("owner") {
+		alreadyCounted = original.GetInt("size")
+	}
+	if size <= alreadyCounted {
+		return nil
+	}
+
+	ownerRecord, err := app.Dao().FindRecordById("users", e.Record.GetString("owner"))
+	if err != nil {
+		return apis.NewBadRequestError("The owner of this file was not found", nil)
+	}
+	return CheckUploadQuota(app, ownerRecord, size, -alreadyCounted, i18n.FromRequest(e.HttpContext))
+}
+
+/*
+Checks the user is allowed to upload a file of this size using their user_flags and user_usage
+
+pendingSize is anything already uploaded that isn't counted in user_usage yet (eg. the other attachments of an email).
+It is negative when a file being replaced is already counted. The errors are in the given locale
+*/
+func CheckUploadQuota(app *pocketbase.PocketBase, authRecord *models.Record, uploadedFileSize int, pendingSize int, locale string) error {
 	record, err := app.Dao().FindFirstRecordByFilter(
 		"user_flags", "user = {:userID} && collection = {:collectionID}",
 		dbx.Params{"collectionID": authRecord.Collection().Id, "userID": authRecord.Id},
 	)
 	if err != nil || record.Id == "" {
-		return apis.NewUnauthorizedError("User does not have correct permisions", nil)
+		return apis.NewUnauthorizedError(i18n.T(locale, "User does not have correct permisions"), nil)
 	}
 
-	_, fs, _ := e.HttpContext.Request().FormFile("file_data")
-	uploadedFileSize := int(fs.Size)
-
 	if uploadedFileSize > record.GetInt("maxUploadSize") {
-		return apis.NewBadRequestError("File too large!", nil)
+		return apis.NewBadRequestError(i18n.T(locale, "File too large!"), nil)
 	}
 
-	usageRecord, err := app.Dao().FindRecordById("user_usage", authRecord.Id)
+	usageRecord, err := findUsage(app.Dao(), authRecord.Id)
 	if err == nil {
-		if uploadedFileSize+usageRecord.GetInt("total_size") >= record.GetInt("quota") {
-			return apis.NewForbiddenError("You have reached your storage limit", nil)
+		if uploadedFileSize+pendingSize+usageRecord.GetInt("total_size") >= record.GetInt("quota") {
+			return apis.NewForbiddenError(i18n.T(locale, "You have reached your storage limit"), nil)
 		}
 	} else {
-		if uploadedFileSize >= record.GetInt("quota") {
-			return apis.NewForbiddenError("You have reached your storage limit", nil)
+		if uploadedFileSize+pendingSize >= record.GetInt("quota") {
+			return apis.NewForbiddenError(i18n.T(locale, "You have reached your storage limit"), nil)
 		}
 	}
 
-	e.Record.Set("size", uploadedFileSize)
-
-	if err := app.Dao().SaveRecord(e.Record); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -0,0 +1,369 @@
+package inbound
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/security"
+	nethtml "golang.org/x/net/html"
+)
+
+/*
+The editor.js version the frontend saves pages with
+*/
+const editorVersion = "2.27.2"
+
+type Block struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"type"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type PageContent struct {
+	Time    int64   `json:"time"`
+	Blocks  []Block `json:"blocks"`
+	Version string  `json:"version"`
+}
+
+var (
+	whitespaceRegex = regexp.MustCompile(`\s+`)
+	tagRegex        = regexp.MustCompile(`<[^>]*>`)
+	linkRegex       = regexp.MustCompile(`https?://[^\s<>"]+[^\s<>".,;:!?)\]]`)
+	paragraphRegex  = regexp.MustCompile(`\n\s*\n`)
+	listLineRegex   = regexp.MustCompile(`^\s*([-*•]|\d+[.)])\s+`)
+	orderedRegex    = regexp.MustCompile(`^\s*\d+[.)]\s+`)
+
+	skipTags = map[string]bool{
+		"head": true, "title": true, "style": true, "script": true, "meta": true, "link": true,
+		"noscript": true, "template": true, "iframe": true, "object": true, "svg": true,
+		"form": true, "input": true, "button": true, "select": true, "textarea": true,
+	}
+	blockTags = map[string]bool{
+		"p": true, "div": true, "section": true, "article": true, "header": true, "footer": true,
+		"main": true, "aside": true, "nav": true, "center": true, "body": true, "html": true,
+		"table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+		"blockquote": true, "pre": true, "hr": true, "img": true, "figure": true, "figcaption": true,
+	}
+	inlineFormats = map[string]string{
+		"b": "b", "strong": "b", "i": "i", "em": "i", "u": "u", "mark": "mark", "code": "code",
+	}
+)
+
+/*
+Turns an email's html body into editor.js blocks
+
+images maps the Content-ID of inline attachments to the id of their saved files record
+*/
+func HTMLToBlocks(body string, images map[string]string) []Block {
+	doc, err := nethtml.Parse(strings.NewReader(body))
+	if err != nil {
+		return TextToBlocks(body)
+	}
+
+	writer := &blockWriter{images: images}
+	writer.walk(doc)
+	writer.flush()
+	return writer.blocks
+}
+
+/*
+Turns a plain text email body into editor.js blocks
+
+Blank lines split paragraphs, "- " and "1. " runs become lists and "> " runs become quotes
+*/
+func TextToBlocks(body string) []Block {
+	blocks := []Block{}
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+
+	for _, chunk := range paragraphRegex.Split(body, -1) {
+		lines := strings.Split(strings.Trim(chunk, "\n"), "\n")
+		if strings.TrimSpace(chunk) == "" {
+			continue
+		}
+
+		switch {
+		case allLinesMatch(lines, func(line string) bool { return strings.HasPrefix(line, ">") }):
+			quoted := []string{}
+			for _, line := range lines {
+				quoted = append(quoted, textLine(strings.TrimPrefix(strings.TrimPrefix(line, ">"), " ")))
+			}
+			blocks = append(blocks, newBlock("quote", map[string]interface{}{
+				"text": strings.Join(quoted, "<br>"), "caption": "", "alignment": "left",
+			}))
+		case allLinesMatch(lines, listLineRegex.MatchString):
+			items := []map[string]interface{}{}
+			for _, line := range lines {
+				items = append(items, map[string]interface{}{
+					"content": textLine(listLineRegex.ReplaceAllString(line, "")),
+					"items":   []map[string]interface{}{},
+				})
+			}
+			style := "unordered"
+			if orderedRegex.MatchString(lines[0]) {
+				style = "ordered"
+			}
+			blocks = append(blocks, newBlock("nestedList", map[string]interface{}{"style": style, "items": items}))
+		default:
+			formatted := []string{}
+			for _, line := range lines {
+				formatted = append(formatted, textLine(line))
+			}
+			blocks = append(blocks, newBlock("paragraph", map[string]interface{}{"text": strings.Join(formatted, "<br>")}))
+		}
+	}
+
+	return blocks
+}
+
+/*
+Wraps blocks in the json the pages content field stores
+*/
+func NewPageContent(blocks []Block) PageContent {
+	return PageContent{
+		Time:    time.Now().UnixMilli(),
+		Blocks:  blocks,
+		Version: editorVersion,
+	}
+}
+
+//Extra helper functions:
+
+type blockWriter struct {
+	blocks []Block
+	inline strings.Builder
+	images map[string]string
+}
+
+func (w *blockWriter) walk(n *nethtml.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *blockWriter) node(n *nethtml.Node) {
+	switch n.Type {
+	case nethtml.TextNode:
+		w.inline.WriteString(escapeText(n.Data))
+		return
+	case nethtml.DocumentNode:
+		w.walk(n)
+		return
+	case nethtml.ElementNode:
+	default:
+		return
+	}
+
+	if skipTags[n.Data] {
+		return
+	}
+	if !blockTags[n.Data] {
+		w.inline.WriteString(inlineHTML(n))
+		return
+	}
+
+	w.flush()
+	switch n.Data {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		if text := strings.TrimSpace(inlineChildren(n)); !isEmptyHTML(text) {
+			w.blocks = append(w.blocks, newBlock("header", map[string]interface{}{"text": text, "level": int(n.Data[1] - '0')}))
+		}
+	case "ul", "ol":
+		style := "unordered"
+		if n.Data == "ol" {
+			style = "ordered"
+		}
+		if items := listItems(n); len(items) > 0 {
+			w.blocks = append(w.blocks, newBlock("nestedList", map[string]interface{}{"style": style, "items": items}))
+		}
+	case "blockquote":
+		if text := strings.TrimSpace(inlineChildren(n)); !isEmptyHTML(text) {
+			w.blocks = append(w.blocks, newBlock("quote", map[string]interface{}{"text": text, "caption": "", "alignment": "left"}))
+		}
+	case "pre":
+		if code := textContent(n); strings.TrimSpace(code) != "" {
+			w.blocks = append(w.blocks, newBlock("code", map[string]interface{}{"code": strings.Trim(code, "\n")}))
+		}
+	case "hr":
+		w.blocks = append(w.blocks, newBlock("delimiter", map[string]interface{}{}))
+	case "img":
+		w.image(n)
+	default:
+		w.walk(n)
+	}
+	w.flush()
+}
+
+func (w *blockWriter) image(n *nethtml.Node) {
+	src := attr(n, "src")
+	if strings.HasPrefix(strings.ToLower(src), "cid:") {
+		if fileId, found := w.images[strings.Trim(src[4:], "<>")]; found {
+			w.blocks = append(w.blocks, newBlock("image", map[string]interface{}{"fileId": fileId, "caption": escapeText(attr(n, "alt"))}))
+		}
+		return
+	}
+
+	// Remote images aren't downloaded, they are kept as a link. 1px images are trackers so they are dropped
+	if !isWebLink(src) || attr(n, "width") == "1" || attr(n, "height") == "1" {
+		return
+	}
+	label := strings.TrimSpace(attr(n, "alt"))
+	if label == "" {
+		label = src
+	}
+	w.blocks = append(w.blocks, newBlock("paragraph", map[string]interface{}{
+		"text": `<a href="` + html.EscapeString(src) + `">` + escapeText(label) + `</a>`,
+	}))
+}
+
+func (w *blockWriter) flush() {
+	text := strings.TrimSpace(w.inline.String())
+	w.inline.Reset()
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "<br>"), "<br>")
+	if isEmptyHTML(text) {
+		return
+	}
+	w.blocks = append(w.blocks, newBlock("paragraph", map[string]interface{}{"text": strings.TrimSpace(text)}))
+}
+
+/*
+Renders an element as the small set of inline html editor.js understands
+*/
+func inlineHTML(n *nethtml.Node) string {
+	switch n.Type {
+	case nethtml.TextNode:
+		return escapeText(n.Data)
+	case nethtml.ElementNode:
+	default:
+		return ""
+	}
+
+	if skipTags[n.Data] {
+		return ""
+	}
+
+	switch n.Data {
+	case "br":
+		return "<br>"
+	case "img":
+		return escapeText(attr(n, "alt"))
+	case "a":
+		content := inlineChildren(n)
+		href := attr(n, "href")
+		if !isWebLink(href) && !strings.HasPrefix(strings.ToLower(href), "mailto:") || isEmptyHTML(content) {
+			return content
+		}
+		return `<a href="` + html.EscapeString(href) + `">` + content + `</a>`
+	}
+
+	content := inlineChildren(n)
+	if format, found := inlineFormats[n.Data]; found && !isEmptyHTML(content) {
+		switch format {
+		case "code":
+			return `<code class="inline-code">` + content + `</code>`
+		case "mark":
+			return `<mark class="cdx-marker">` + content + `</mark>`
+		}
+		return "<" + format + ">" + content + "</" + format + ">"
+	}
+	if blockTags[n.Data] {
+		return content + " "
+	}
+	return content
+}
+
+func inlineChildren(n *nethtml.Node) string {
+	var builder strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		builder.WriteString(inlineHTML(c))
+	}
+	return builder.String()
+}
+
+func listItems(list *nethtml.Node) []map[string]interface{} {
+	items := []map[string]interface{}{}
+	for li := list.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != nethtml.ElementNode || li.Data != "li" {
+			continue
+		}
+
+		var content strings.Builder
+		nested := []map[string]interface{}{}
+		for c := li.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == nethtml.ElementNode && (c.Data == "ul" || c.Data == "ol") {
+				nested = append(nested, listItems(c)...)
+			} else {
+				content.WriteString(inlineHTML(c))
+			}
+		}
+		items = append(items, map[string]interface{}{"content": strings.TrimSpace(content.String()), "items": nested})
+	}
+	return items
+}
+
+func textContent(n *nethtml.Node) string {
+	if n.Type == nethtml.TextNode {
+		return html.EscapeString(n.Data)
+	}
+	var builder strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == nethtml.ElementNode && c.Data == "br" {
+			builder.WriteString("\n")
+			continue
+		}
+		builder.WriteString(textContent(c))
+	}
+	return builder.String()
+}
+
+func attr(n *nethtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+func escapeText(text string) string {
+	return html.EscapeString(whitespaceRegex.ReplaceAllString(text, " "))
+}
+
+/*
+Escapes a line of plain text and turns any urls in it into links
+*/
+func textLine(line string) string {
+	line = html.EscapeString(strings.TrimSpace(line))
+	return linkRegex.ReplaceAllStringFunc(line, func(link string) string {
+		return `<a href="` + link + `">` + link + `</a>`
+	})
+}
+
+func isEmptyHTML(text string) bool {
+	text = tagRegex.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, "&nbsp;", "")
+	text = strings.ReplaceAll(text, "\u00a0", "")
+	text = strings.ReplaceAll(text, "\u200c", "")
+	return strings.TrimSpace(text) == ""
+}
+
+func isWebLink(link string) bool {
+	link = strings.ToLower(link)
+	return strings.HasPrefix(link, "https://") || strings.HasPrefix(link, "http://")
+}
+
+func allLinesMatch(lines []string, match func(string) bool) bool {
+	for _, line := range lines {
+		if !match(line) {
+			return false
+		}
+	}
+	return len(lines) > 0
+}
+
+func newBlock(blockType string, data map[string]interface{}) Block {
+	return Block{ID: security.RandomString(10), Type: blockType, Data: data}
+}
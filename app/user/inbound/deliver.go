@@ -0,0 +1,195 @@
+package inbound
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"suddsy.dev/m/v2/app/tools/i18n"
+	"suddsy.dev/m/v2/app/user"
+)
+
+var maxTitleLength = 200
+
+/*
+Creates a new page owned by the user the inbound address belongs to
+
+Attachments are saved as files records on that page with the same quota checks as an upload.
+Ones that don't fit are left out and a note is added to the page saying why
+*/
+func DeliverEmail(app *pocketbase.PocketBase, addressRecord *models.Record, email *InboundEmail) (*models.Record, error) {
+	userRecord, err := app.Dao().FindRecordById("users", addressRecord.GetString("user"))
+	if err != nil {
+		return nil, NewInboundError("The user for this address no longer exists")
+	}
+	locale := i18n.ForRecord(userRecord, nil)
+
+	pagesCollection, err := app.Dao().FindCollectionByNameOrId("pages")
+	if err != nil {
+		return nil, NewInboundError("pages Collection was not found")
+	}
+	filesCollection, err := app.Dao().FindCollectionByNameOrId("files")
+	if err != nil {
+		filesCollection = nil
+		if len(email.Attachments) > 0 {
+			app.Logger().Error("files Collection was not found. Please create it to use this feature. Skipping attachments")
+		}
+	}
+
+	page := models.NewRecord(pagesCollection)
+	err = app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		page.Set("title", pageTitle(email, locale))
+		page.Set("icon", "1f4e7.png")
+		page.Set("owner", userRecord.Id)
+		page.Set("content", NewPageContent([]Block{}))
+		if err := txDao.SaveRecord(page); err != nil {
+			return err
+		}
+
+		images := map[string]string{}
+		savedFiles := []*models.Record{}
+		notes := []Block{}
+		pendingSize := 0
+		for _, attachment := range email.Attachments {
+			if filesCollection == nil {
+				break
+			}
+
+			fileRecord, err := saveAttachment(app, txDao, filesCollection, userRecord, page, attachment, pendingSize, locale)
+			if err != nil {
+				notes = append(notes, newBlock("paragraph", map[string]interface{}{
+					"text": "<i>" + escapeText(i18n.Tf(locale, "%s was not saved: %s", attachment.Name, attachmentErrorMessage(locale, err))) + "</i>",
+				}))
+				continue
+			}
+
+			pendingSize += len(attachment.Content)
+			savedFiles = append(savedFiles, fileRecord)
+			if attachment.ContentID != "" {
+				images[attachment.ContentID] = fileRecord.Id
+			}
+		}
+
+		blocks := []Block{senderBlock(email, locale)}
+		if strings.TrimSpace(email.HTML) != "" {
+			blocks = append(blocks, HTMLToBlocks(email.HTML, images)...)
+		} else {
+			blocks = append(blocks, TextToBlocks(email.Text)...)
+		}
+		blocks = append(blocks, unusedFileBlocks(blocks, savedFiles)...)
+		blocks = append(blocks, notes...)
+
+		page.Set("content", NewPageContent(blocks))
+		return txDao.SaveRecord(page)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+//Extra helper functions:
+
+func saveAttachment(app *pocketbase.PocketBase, txDao *daos.Dao, collection *models.Collection, userRecord *models.Record, page *models.Record, attachment InboundAttachment, pendingSize int, locale string) (*models.Record, error) {
+	size := len(attachment.Content)
+	if err := user.CheckUploadQuota(app, userRecord, size, pendingSize, locale); err != nil {
+		return nil, err
+	}
+
+	file, err := filesystem.NewFileFromBytes(attachment.Content, attachment.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.NewRecord(collection)
+	form := forms.NewRecordUpsert(app, record)
+	form.SetDao(txDao)
+	if err := form.LoadData(map[string]any{
+		"page":  page.Id,
+		"owner": userRecord.Id,
+		"size":  size,
+	}); err != nil {
+		return nil, err
+	}
+	if err := form.AddFiles("file_data", file); err != nil {
+		return nil, err
+	}
+	if err := form.Submit(); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+/*
+Files that the email body didn't show inline are added to the end of the page so they aren't cleaned up as unused
+*/
+func unusedFileBlocks(blocks []Block, savedFiles []*models.Record) []Block {
+	used := map[string]bool{}
+	for _, block := range blocks {
+		if fileId, ok := block.Data["fileId"].(string); ok {
+			used[fileId] = true
+		}
+	}
+
+	fileBlocks := []Block{}
+	for _, fileRecord := range savedFiles {
+		if used[fileRecord.Id] {
+			continue
+		}
+
+		fileName := fileRecord.GetString("file_data")
+		if isImageName(fileName) {
+			fileBlocks = append(fileBlocks, newBlock("image", map[string]interface{}{"fileId": fileRecord.Id, "caption": ""}))
+		} else {
+			fileBlocks = append(fileBlocks, newBlock("simpleEmbeds", map[string]interface{}{"fileId": fileRecord.Id, "fileName": fileName}))
+		}
+	}
+	return fileBlocks
+}
+
+func senderBlock(email *InboundEmail, locale string) Block {
+	sender := email.From.Address
+	if email.From.Name != "" {
+		sender = email.From.Name + " <" + email.From.Address + ">"
+	}
+	return newBlock("paragraph", map[string]interface{}{
+		"text": "<i>" + escapeText(i18n.Tf(locale, "Emailed by %s on %s", sender, email.Date.Format("2 Jan 2006 15:04 MST"))) + "</i>",
+	})
+}
+
+func pageTitle(email *InboundEmail, locale string) string {
+	title := strings.TrimSpace(email.Subject)
+	if title == "" {
+		title = i18n.Tf(locale, "Email from %s", email.From.Address)
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		title = string([]rune(title)[:maxTitleLength])
+	}
+	return title
+}
+
+func attachmentErrorMessage(locale string, err error) string {
+	var apiErr *apis.ApiError
+	if errors.As(err, &apiErr) {
+		return i18n.T(locale, strings.TrimSuffix(apiErr.Message, "."))
+	}
+	return i18n.T(locale, "The file could not be saved")
+}
+
+func isImageName(name string) bool {
+	name = strings.ToLower(name)
+	for _, extension := range []string{".png", ".jpg", ".jpeg", ".gif", ".webp"} {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package inbound
+
+import "fmt"
+
+type InboundError struct {
+	Message string
+}
+
+// Error implements the error interface for InboundError
+func (e *InboundError) Error() string {
+	return e.Message
+}
+
+// NewInboundError creates a new InboundError with the given message
+func NewInboundError(format string, a ...interface{}) error {
+	return &InboundError{
+		Message: fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,210 @@
+package inbound
+
+import (
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/emails"
+)
+
+var mailDropPollInterval = 10 * time.Second
+
+/*
+Headers an mta uses to say who a delivered email was actually for, checked in this order
+*/
+var recipientHeaders = []string{"X-Original-To", "Delivered-To", "Envelope-To", "To", "Cc"}
+
+/*
+Watches inbound_maildrop_dir for emails written by an external mta (eg. a postfix pipe or maildir delivery)
+
+If the directory has a new/ folder (maildir) that is read instead. Each file is one raw email,
+it is deleted once its pages are made and moved to failed/ if it can't be used.
+Bounce reports delivered to bounce_address are added to the email suppression list instead
+*/
+func StartMailDropWatcher(app *pocketbase.PocketBase) {
+	dir, _ := os.LookupEnv("inbound_maildrop_dir")
+	if info, err := os.Stat(filepath.Join(dir, "new")); err == nil && info.IsDir() {
+		dir = filepath.Join(dir, "new")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		app.Logger().Error("Failed to create the inbound mail drop directory", "details", err)
+		return
+	}
+
+	app.Logger().Info("Watching the inbound mail drop", "dir", dir)
+
+	go func() {
+		ticker := time.NewTicker(mailDropPollInterval)
+		defer ticker.Stop()
+
+		for {
+			processMailDrop(app, dir)
+			<-ticker.C
+		}
+	}()
+}
+
+func processMailDrop(app *pocketbase.PocketBase, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		app.Logger().Error("Failed to read the inbound mail drop", "details", err)
+		return
+	}
+
+	for _, entry := range entries {
+		// Dot files are still being written by the mta
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := deliverMailDropFile(app, path); err != nil {
+			app.Logger().Error("Failed to create a page from a mail drop email", "file", entry.Name(), "details", err)
+			moveToFailed(app, dir, path)
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			app.Logger().Error("Failed to remove a delivered mail drop email", "file", entry.Name(), "details", err)
+		}
+	}
+}
+
+func deliverMailDropFile(app *pocketbase.PocketBase, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > int64(maxMessageSize()) {
+		return NewInboundError("Email is bigger than inbound_max_size")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Bounces and complaints for emails we sent go to the suppression list instead of a page
+	if isForBounceAddress(raw) && emails.IsBounceReport(raw) {
+		recorded, err := emails.HandleBounceReport(app, raw)
+		if err != nil && recorded == 0 {
+			return err
+		}
+		app.Logger().Info("Recorded bounces from the mail drop", "count", recorded)
+		return nil
+	}
+
+	recipients, err := mailDropRecipients(app, raw)
+	if err != nil {
+		return err
+	}
+
+	email, err := ParseEmail(raw)
+	if err != nil {
+		return err
+	}
+
+	// One recipient failing doesn't stop the others getting their page, the file only fails if nobody got it
+	delivered := 0
+	var lastErr error
+	for _, addressRecord := range recipients {
+		page, err := DeliverEmail(app, addressRecord, email)
+		if err != nil {
+			app.Logger().Error("Failed to create a page from a mail drop email", "file", filepath.Base(path), "address", addressRecord.Id, "details", err)
+			lastErr = err
+			continue
+		}
+		delivered++
+		app.Logger().Info("Created a page from an inbound email", "page", page.Id, "user", page.GetString("owner"))
+	}
+
+	if delivered == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+//Extra helper functions:
+
+/*
+Works out which inbound addresses a dropped email was for from its headers
+*/
+func mailDropRecipients(app *pocketbase.PocketBase, raw []byte) ([]*models.Record, error) {
+	message, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		return nil, NewInboundError("Invalid email: %s", err.Error())
+	}
+
+	for _, header := range recipientHeaders {
+		recipients := []*models.Record{}
+		seen := map[string]bool{}
+
+		for _, value := range message.Header[header] {
+			addresses, err := mail.ParseAddressList(value)
+			if err != nil {
+				addresses = []*mail.Address{{Address: value}}
+			}
+			for _, address := range addresses {
+				record, err := FindInboundAddress(app, address.Address)
+				if err != nil || seen[record.Id] {
+					continue
+				}
+				seen[record.Id] = true
+				recipients = append(recipients, record)
+			}
+		}
+
+		if len(recipients) > 0 {
+			return recipients, nil
+		}
+	}
+
+	return nil, NewInboundError("Email isn't for any inbound address")
+}
+
+/*
+Checks the same headers as mailDropRecipients for the bounce address
+*/
+func isForBounceAddress(raw []byte) bool {
+	message, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		return false
+	}
+
+	for _, header := range recipientHeaders {
+		for _, value := range message.Header[header] {
+			addresses, err := mail.ParseAddressList(value)
+			if err != nil {
+				addresses = []*mail.Address{{Address: value}}
+			}
+			for _, address := range addresses {
+				if isBounceAddress(address.Address) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func moveToFailed(app *pocketbase.PocketBase, dir string, path string) {
+	failedDir := filepath.Join(filepath.Dir(dir), "failed")
+	if filepath.Base(dir) != "new" {
+		failedDir = filepath.Join(dir, "failed")
+	}
+
+	if err := os.MkdirAll(failedDir, 0o755); err == nil {
+		if err := os.Rename(path, filepath.Join(failedDir, filepath.Base(path))); err == nil {
+			return
+		}
+	}
+
+	app.Logger().Error("Failed to move a mail drop email to failed, removing it", "file", filepath.Base(path))
+	os.Remove(path)
+}
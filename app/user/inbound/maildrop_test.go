@@ -0,0 +1,81 @@
+package inbound
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsForBounceAddress(t *testing.T) {
+	t.Setenv("bounce_address", "bounces@example.com")
+
+	cases := map[string]bool{
+		"To: Bounces <bounces@example.com>\r\n\r\nbody":                  true,
+		"To: someone@example.org\r\nCc: BOUNCES@example.com\r\n\r\nbody": true,
+		"Delivered-To: bounces@example.com\r\n\r\nbody":                  true,
+		"To: someone@example.org\r\n\r\nbounces@example.com":             false,
+		"not a message": false,
+	}
+	for raw, expected := range cases {
+		if found := isForBounceAddress([]byte(raw)); found != expected {
+			t.Errorf("%q: expected %v, got %v", raw, expected, found)
+		}
+	}
+}
+
+func TestMailDropDeliversToEachRecipient(t *testing.T) {
+	app := newTestApp(t)
+	alice, aliceAddress := newTestUser(t, app, "alice", 20000000)
+	bob, bobAddress := newTestUser(t, app, "bob", 20000000)
+
+	// Bob's account is gone so his page can't be made, alice should still get hers
+	if err := app.Dao().DeleteRecord(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1.eml")
+	message := strings.Join([]string{
+		"From: carol@example.org",
+		"To: " + bobAddress + ", " + aliceAddress,
+		"Subject: Shared notes",
+		"",
+		"Hello both",
+	}, "\r\n")
+	if err := os.WriteFile(path, []byte(message), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	processMailDrop(app, dir)
+
+	if pages := ownedPages(t, app, alice.Id); len(pages) != 1 {
+		t.Fatalf("expected alice to get a page, got %d", len(pages))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected the delivered file to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "1.eml")); !os.IsNotExist(err) {
+		t.Error("expected the file not to be moved to failed")
+	}
+}
+
+func TestMailDropFailsWhenNobodyGetsIt(t *testing.T) {
+	app := newTestApp(t)
+	bob, bobAddress := newTestUser(t, app, "bob", 20000000)
+	if err := app.Dao().DeleteRecord(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	message := "From: carol@example.org\r\nTo: " + bobAddress + "\r\nSubject: Notes\r\n\r\nHello\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "1.eml"), []byte(message), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	processMailDrop(app, dir)
+
+	if _, err := os.Stat(filepath.Join(dir, "failed", "1.eml")); err != nil {
+		t.Errorf("expected the file to be moved to failed, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package inbound
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"suddsy.dev/m/v2/app/tools/i18n"
+)
+
+const secretLength = 24
+
+var defaultMaxSize = 25 * 1024 * 1024
+
+/*
+Lets users create pages by sending an email to their own secret address
+
+The address is <secret>@inbound_domain. Mail comes in through the built in smtp listener (inbound_smtp_addr)
+or a mail drop directory that an external mta writes to (inbound_maildrop_dir)
+*/
+func RegisterInboundRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.GET("/api/collections/:collection/inbound/:method", func(c echo.Context) error {
+		return handleGetMethodAssign(c, app)
+	})
+	e.Router.POST("/api/collections/:collection/inbound/:method", func(c echo.Context) error {
+		return handlePostMethodAssign(c, app)
+	})
+}
+
+/*
+Starts whichever of the smtp listener and mail drop watcher are configured
+*/
+func StartInbound(app *pocketbase.PocketBase) {
+	_, smtpEnabled := os.LookupEnv("inbound_smtp_addr")
+	_, dropEnabled := os.LookupEnv("inbound_maildrop_dir")
+	if !smtpEnabled && !dropEnabled {
+		return
+	}
+
+	if _, err := app.Dao().FindCollectionByNameOrId("inbound_addresses"); err != nil {
+		app.Logger().Error("inbound_addresses Collection was not found. Please create it to use this feature.")
+		return
+	}
+
+	if smtpEnabled {
+		if err := StartSMTPServer(app); err != nil {
+			app.Logger().Error("Failed to start the inbound smtp server", "details", err)
+		}
+	}
+	if dropEnabled {
+		StartMailDropWatcher(app)
+	}
+}
+
+func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "address":
+		return getInboundAddress(app, c)
+	}
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
+}
+
+func handlePostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "rotate":
+		return rotateInboundAddress(app, c)
+	case "disable":
+		return disableInboundAddress(app, c)
+	}
+	return apis.NewNotFoundError(i18n.T(i18n.FromRequest(c), "Method not found"), nil)
+}
+
+/*
+Returns the signed in users inbound address, making one the first time
+*/
+func getInboundAddress(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	authRecord, err := inboundAuthRecord(c, locale)
+	if err != nil {
+		return err
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter("inbound_addresses", "user = {:user}", dbx.Params{"user": authRecord.Id})
+	if err != nil {
+		record, err = newInboundAddress(app, authRecord)
+		if err != nil {
+			return err
+		}
+	}
+
+	return inboundAddressResponse(c, record)
+}
+
+/*
+Gives the signed in user a new inbound address. The old one stops working straight away
+*/
+func rotateInboundAddress(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	authRecord, err := inboundAuthRecord(c, locale)
+	if err != nil {
+		return err
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter("inbound_addresses", "user = {:user}", dbx.Params{"user": authRecord.Id})
+	if err != nil {
+		record, err = newInboundAddress(app, authRecord)
+		if err != nil {
+			return err
+		}
+		return inboundAddressResponse(c, record)
+	}
+
+	record.Set("secret", security.RandomStringWithAlphabet(secretLength, "abcdefghijklmnopqrstuvwxyz0123456789"))
+	record.Set("enabled", true)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return err
+	}
+
+	return inboundAddressResponse(c, record)
+}
+
+/*
+Stops the signed in users inbound address from accepting mail until it is rotated
+*/
+func disableInboundAddress(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	authRecord, err := inboundAuthRecord(c, locale)
+	if err != nil {
+		return err
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter("inbound_addresses", "user = {:user}", dbx.Params{"user": authRecord.Id})
+	if err != nil {
+		return apis.NewNotFoundError(i18n.T(locale, "No inbound address found"), nil)
+	}
+
+	record.Set("enabled", false)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return err
+	}
+
+	return inboundAddressResponse(c, record)
+}
+
+/*
+Finds the enabled inbound_addresses record for an email address
+
+Plus addressing works too, so notes+<secret>@domain is the same as <secret>@domain
+*/
+func FindInboundAddress(app *pocketbase.PocketBase, address string) (*models.Record, error) {
+	address = strings.ToLower(strings.Trim(strings.TrimSpace(address), "<>"))
+	localPart, domain, found := strings.Cut(address, "@")
+	if !found {
+		return nil, NewInboundError("Invalid address")
+	}
+
+	if inboundDomain, found := os.LookupEnv("inbound_domain"); found && !strings.EqualFold(domain, inboundDomain) {
+		return nil, NewInboundError("Unknown domain")
+	}
+
+	if _, tag, found := strings.Cut(localPart, "+"); found {
+		localPart = tag
+	}
+	if len(localPart) != secretLength {
+		return nil, NewInboundError("Unknown address")
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"inbound_addresses", "secret = {:secret} && enabled = true",
+		dbx.Params{"secret": localPart},
+	)
+	if err != nil {
+		return nil, NewInboundError("Unknown address")
+	}
+
+	return record, nil
+}
+
+//Extra helper functions:
+
+func inboundAuthRecord(c echo.Context, locale string) (*models.Record, error) {
+	authRecord, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if authRecord == nil || authRecord.Collection().Name != "users" || authRecord.Collection().Name != c.PathParam("collection") {
+		return nil, apis.NewUnauthorizedError(i18n.T(locale, "You must be signed in to access this"), nil)
+	}
+	return authRecord, nil
+}
+
+func newInboundAddress(app *pocketbase.PocketBase, authRecord *models.Record) (*models.Record, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId("inbound_addresses")
+	if err != nil {
+		app.Logger().Error("inbound_addresses Collection was not found. Please create it to use this feature.")
+		return nil, apis.NewNotFoundError("", nil)
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("user", authRecord.Id)
+	record.Set("secret", security.RandomStringWithAlphabet(secretLength, "abcdefghijklmnopqrstuvwxyz0123456789"))
+	record.Set("enabled", true)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func inboundAddressResponse(c echo.Context, record *models.Record) error {
+	domain, _ := os.LookupEnv("inbound_domain")
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["address"] = record.GetString("secret") + "@" + domain
+	res["enabled"] = record.GetBool("enabled")
+
+	return c.JSON(200, res)
+}
+
+/*
+The biggest email that will be accepted in bytes, from the inbound_max_size env
+*/
+func maxMessageSize() int {
+	if value, found := os.LookupEnv("inbound_max_size"); found {
+		if size, err := strconv.Atoi(value); err == nil && size > 0 {
+			return size
+		}
+	}
+	return defaultMaxSize
+}
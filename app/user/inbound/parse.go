@@ -0,0 +1,208 @@
+package inbound
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+/*
+An email that was sent to one of the inbound addresses
+*/
+type InboundEmail struct {
+	Subject     string
+	From        mail.Address
+	Date        time.Time
+	Text        string
+	HTML        string
+	Attachments []InboundAttachment
+}
+
+/*
+A file from an email. Inline files have a ContentID that the html points at with cid: links
+*/
+type InboundAttachment struct {
+	Name        string
+	ContentType string
+	ContentID   string
+	Inline      bool
+	Content     []byte
+}
+
+var (
+	maxMimeDepth   = 10
+	maxAttachments = 20
+
+	wordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+)
+
+/*
+Parses a raw email into its subject, sender, bodies and attachments
+*/
+func ParseEmail(raw []byte) (*InboundEmail, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, NewInboundError("Invalid email: %s", err.Error())
+	}
+
+	email := &InboundEmail{
+		Subject: decodeHeader(message.Header.Get("Subject")),
+		Date:    time.Now().UTC(),
+	}
+	if from, err := message.Header.AddressList("From"); err == nil && len(from) > 0 {
+		email.From = *from[0]
+	}
+	if date, err := message.Header.Date(); err == nil {
+		email.Date = date.UTC()
+	}
+
+	if err := email.readPart(textproto.MIMEHeader(message.Header), message.Body, 0); err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+/*
+Reads a single mime part, going into multipart parts until it finds the bodies and files
+*/
+func (email *InboundEmail) readPart(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxMimeDepth {
+		return NewInboundError("Email is nested too deep")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return NewInboundError("Invalid email: %s", err.Error())
+			}
+			if err := email.readPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return NewInboundError("Invalid email: %s", err.Error())
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	fileName := dispositionParams["filename"]
+	if fileName == "" {
+		fileName = params["name"]
+	}
+	fileName = decodeHeader(fileName)
+
+	isAttachment := disposition == "attachment" || fileName != ""
+	if !isAttachment && (mediaType == "text/plain" || mediaType == "text/html") {
+		text := decodeCharset(params["charset"], content)
+		if mediaType == "text/html" && email.HTML == "" {
+			email.HTML = text
+		} else if mediaType == "text/plain" && email.Text == "" {
+			email.Text = text
+		}
+		return nil
+	}
+
+	if len(email.Attachments) >= maxAttachments {
+		return nil
+	}
+
+	contentID := strings.Trim(header.Get("Content-Id"), "<> ")
+	if fileName == "" {
+		fileName = "attachment"
+		if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+			fileName += extensions[0]
+		}
+	}
+
+	email.Attachments = append(email.Attachments, InboundAttachment{
+		Name:        filepath.Base(fileName),
+		ContentType: mediaType,
+		ContentID:   contentID,
+		Inline:      disposition != "attachment" && contentID != "",
+		Content:     content,
+	})
+
+	return nil
+}
+
+//Extra helper functions:
+
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{reader: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+func decodeCharset(label string, content []byte) string {
+	label = strings.ToLower(label)
+	if label == "" || label == "utf-8" || label == "us-ascii" {
+		return string(content)
+	}
+
+	reader, err := charset.NewReaderLabel(label, bytes.NewReader(content))
+	if err != nil {
+		return string(content)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return string(content)
+	}
+	return string(decoded)
+}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(decoded)
+}
+
+/*
+Drops the whitespace some mail clients leave in base64 bodies, which the go decoder doesn't skip
+*/
+type base64Cleaner struct {
+	reader io.Reader
+}
+
+func (b *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	kept := 0
+	for _, c := range p[:n] {
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			p[kept] = c
+			kept++
+		}
+	}
+	if kept == 0 && n > 0 && err == nil {
+		return b.Read(p)
+	}
+	return kept, err
+}
@@ -0,0 +1,382 @@
+package inbound
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/emails"
+)
+
+var (
+	smtpCommandTimeout = 5 * time.Minute
+	smtpMaxRecipients  = 20
+	smtpMaxConnections = 50
+	smtpMaxErrors      = 10
+)
+
+/*
+Listens for mail on inbound_smtp_addr (eg. :2525) and turns anything sent to an inbound address into a page
+
+STARTTLS is offered when inbound_tls_cert and inbound_tls_key point at a certificate.
+Mail to bounce_address is read as bounce reports for the email suppression list
+*/
+func StartSMTPServer(app *pocketbase.PocketBase) error {
+	addr, _ := os.LookupEnv("inbound_smtp_addr")
+
+	tlsConfig, err := loadInboundTLS()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	hostname, found := os.LookupEnv("inbound_domain")
+	if !found {
+		hostname, _ = os.Hostname()
+	}
+
+	app.Logger().Info("Inbound smtp server started", "addr", listener.Addr().String())
+
+	go func() {
+		slots := make(chan struct{}, smtpMaxConnections)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					continue
+				}
+				app.Logger().Error("Inbound smtp server stopped", "details", err)
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+				go func() {
+					defer func() { <-slots }()
+					session := &smtpSession{app: app, conn: conn, hostname: hostname, tlsConfig: tlsConfig}
+					session.serve()
+				}()
+			default:
+				conn.Write([]byte("421 4.3.2 Too many connections, try again later\r\n"))
+				conn.Close()
+			}
+		}
+	}()
+
+	return nil
+}
+
+/*
+One smtp connection. It only accepts mail for inbound addresses so it can't be used as a relay
+*/
+type smtpSession struct {
+	app       *pocketbase.PocketBase
+	conn      net.Conn
+	text      *textproto.Conn
+	hostname  string
+	tlsConfig *tls.Config
+	isTLS     bool
+
+	helo       string
+	from       string
+	recipients []*models.Record
+	bounces    bool
+	errors     int
+}
+
+func (s *smtpSession) serve() {
+	defer s.conn.Close()
+	s.text = textproto.NewConn(s.conn)
+
+	s.reply(220, s.hostname+" ESMTP noti")
+	for {
+		s.conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, args, _ := strings.Cut(line, " ")
+		args = strings.TrimSpace(args)
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.helo = args
+			s.reset()
+			s.reply(250, s.hostname)
+		case "EHLO":
+			s.helo = args
+			s.reset()
+			s.ehlo()
+		case "STARTTLS":
+			if !s.startTLS() {
+				return
+			}
+		case "MAIL":
+			s.mail(args)
+		case "RCPT":
+			s.rcpt(args)
+		case "DATA":
+			if !s.data() {
+				return
+			}
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			s.reply(250, "2.0.0 OK")
+		case "VRFY":
+			s.reply(252, "2.5.2 Cannot VRFY user")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		default:
+			s.fail(502, "5.5.2 Command not recognized")
+		}
+
+		if s.errors >= smtpMaxErrors {
+			s.reply(421, "4.7.0 Too many errors")
+			return
+		}
+	}
+}
+
+func (s *smtpSession) ehlo() {
+	lines := []string{s.hostname, "SIZE " + strconv.Itoa(maxMessageSize()), "8BITMIME", "ENHANCEDSTATUSCODES"}
+	if s.tlsConfig != nil && !s.isTLS {
+		lines = append(lines, "STARTTLS")
+	}
+
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		s.text.PrintfLine("250%s%s", separator, line)
+	}
+}
+
+func (s *smtpSession) startTLS() bool {
+	if s.tlsConfig == nil || s.isTLS {
+		s.fail(502, "5.5.1 STARTTLS not available")
+		return true
+	}
+
+	s.reply(220, "2.0.0 Ready to start TLS")
+	tlsConn := tls.Server(s.conn, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+
+	s.conn = tlsConn
+	s.text = textproto.NewConn(tlsConn)
+	s.isTLS = true
+	s.helo = ""
+	s.reset()
+	return true
+}
+
+func (s *smtpSession) mail(args string) {
+	if s.helo == "" {
+		s.fail(503, "5.5.1 Send HELO or EHLO first")
+		return
+	}
+	if s.from != "" {
+		s.fail(503, "5.5.1 Sender already given")
+		return
+	}
+
+	from, params, found := cutPath(args, "FROM:")
+	if !found {
+		s.fail(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	for _, param := range strings.Fields(params) {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(key, "SIZE") {
+			if size, err := strconv.Atoi(value); err == nil && size > maxMessageSize() {
+				s.fail(552, "5.3.4 Message too big")
+				return
+			}
+		}
+	}
+
+	// The null sender (<>) is allowed so bounces and auto replies are still accepted
+	if from == "" {
+		from = "<>"
+	}
+	s.from = from
+	s.reply(250, "2.1.0 OK")
+}
+
+func (s *smtpSession) rcpt(args string) {
+	if s.from == "" {
+		s.fail(503, "5.5.1 Send MAIL first")
+		return
+	}
+	if len(s.recipients) >= smtpMaxRecipients {
+		s.fail(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	to, _, found := cutPath(args, "TO:")
+	if !found {
+		s.fail(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	if isBounceAddress(to) {
+		s.bounces = true
+		s.reply(250, "2.1.5 OK")
+		return
+	}
+
+	record, err := FindInboundAddress(s.app, to)
+	if err != nil {
+		s.fail(550, "5.1.1 No such user here")
+		return
+	}
+
+	for _, existing := range s.recipients {
+		if existing.Id == record.Id {
+			s.reply(250, "2.1.5 OK")
+			return
+		}
+	}
+	s.recipients = append(s.recipients, record)
+	s.reply(250, "2.1.5 OK")
+}
+
+/*
+Reads the message and makes the pages. Returns false when the connection should be closed
+*/
+func (s *smtpSession) data() bool {
+	if len(s.recipients) == 0 && !s.bounces {
+		s.fail(503, "5.5.1 Send RCPT first")
+		return true
+	}
+
+	s.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	limit := int64(maxMessageSize())
+	dotReader := s.text.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(dotReader, limit+1))
+	if err != nil {
+		return false
+	}
+	if int64(len(raw)) > limit {
+		// Read the rest so the connection stays in sync
+		if _, err := io.Copy(io.Discard, dotReader); err != nil {
+			return false
+		}
+		s.reset()
+		s.fail(552, "5.3.4 Message too big")
+		return true
+	}
+
+	delivered := 0
+	if s.bounces {
+		// Auto replies to the bounce address are accepted and dropped
+		if emails.IsBounceReport(raw) {
+			if _, err := emails.HandleBounceReport(s.app, raw); err != nil {
+				s.app.Logger().Error("Failed to record bounces from an inbound email", "details", err)
+			}
+		}
+		delivered++
+	}
+
+	email, err := ParseEmail(raw)
+	if err != nil {
+		s.reset()
+		s.fail(554, "5.6.0 "+err.Error())
+		return true
+	}
+
+	for _, addressRecord := range s.recipients {
+		page, err := DeliverEmail(s.app, addressRecord, email)
+		if err != nil {
+			s.app.Logger().Error("Failed to create a page from an inbound email", "details", err)
+			continue
+		}
+		delivered++
+		s.app.Logger().Info("Created a page from an inbound email", "page", page.Id, "user", page.GetString("owner"))
+	}
+
+	s.reset()
+	if delivered == 0 {
+		s.reply(451, "4.3.0 Could not save the message, try again later")
+		return true
+	}
+	s.reply(250, "2.0.0 OK: queued")
+	return true
+}
+
+func (s *smtpSession) reset() {
+	s.from = ""
+	s.recipients = nil
+	s.bounces = false
+}
+
+func (s *smtpSession) reply(code int, message string) {
+	s.text.PrintfLine("%d %s", code, message)
+}
+
+func (s *smtpSession) fail(code int, message string) {
+	s.errors++
+	s.reply(code, message)
+}
+
+//Extra helper functions:
+
+/*
+Splits "FROM:<a@b.c> SIZE=10" into the address and the params after it
+*/
+func cutPath(args string, prefix string) (string, string, bool) {
+	if len(args) < len(prefix) || !strings.EqualFold(args[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	args = strings.TrimSpace(args[len(prefix):])
+
+	if strings.HasPrefix(args, "<") {
+		end := strings.Index(args, ">")
+		if end == -1 {
+			return "", "", false
+		}
+		return args[1:end], strings.TrimSpace(args[end+1:]), true
+	}
+
+	address, params, _ := strings.Cut(args, " ")
+	return address, params, address != ""
+}
+
+func isBounceAddress(address string) bool {
+	bounceAddress, found := os.LookupEnv("bounce_address")
+	return found && bounceAddress != "" && strings.EqualFold(strings.TrimSpace(address), bounceAddress)
+}
+
+func loadInboundTLS() (*tls.Config, error) {
+	certFile, certFound := os.LookupEnv("inbound_tls_cert")
+	keyFile, keyFound := os.LookupEnv("inbound_tls_key")
+	if !certFound || !keyFound {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, NewInboundError("Failed to load the inbound tls certificate: %s", err.Error())
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
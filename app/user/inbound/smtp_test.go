@@ -0,0 +1,401 @@
+package inbound
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+const testInboundDomain = "in.example.com"
+
+/*
+These fail before the database is needed, so they run without an app
+*/
+func TestSMTPCommandOrder(t *testing.T) {
+	client := dialTestServer(t, nil)
+
+	if err := client.Rcpt("someone@" + testInboundDomain); smtpCode(err) != 503 {
+		t.Errorf("expected RCPT before MAIL to fail with 503, got %v", err)
+	}
+	if code := rawCommand(t, client, "DATA"); code != 503 {
+		t.Errorf("expected DATA before RCPT to fail with 503, got %d", code)
+	}
+	if err := client.Mail("bob@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Mail("bob@example.org"); smtpCode(err) != 503 {
+		t.Errorf("expected a second MAIL to fail with 503, got %v", err)
+	}
+}
+
+func TestSMTPDeclaredSizeTooBig(t *testing.T) {
+	t.Setenv("inbound_max_size", "2000")
+	client := dialTestServer(t, nil)
+
+	if code := rawCommand(t, client, "MAIL FROM:<bob@example.org> SIZE=5000"); code != 552 {
+		t.Fatalf("expected 552, got %d", code)
+	}
+
+	if err := client.Mail("bob@example.org"); err != nil {
+		t.Errorf("expected a smaller message to be allowed, got %v", err)
+	}
+}
+
+func TestSMTPUnknownRecipient(t *testing.T) {
+	app := newTestApp(t)
+	client := dialTestServer(t, app)
+
+	if err := client.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{
+		"abcdefghijklmnopqrstuvwx@" + testInboundDomain,
+		"someone@elsewhere.example.com",
+	} {
+		err := client.Rcpt(address)
+		if code := smtpCode(err); code != 550 {
+			t.Errorf("%s: expected 550, got %v", address, err)
+		}
+	}
+}
+
+func TestSMTPDataCreatesPage(t *testing.T) {
+	app := newTestApp(t)
+	userRecord, address := newTestUser(t, app, "alice", 20000000)
+	client := dialTestServer(t, app)
+
+	sendTestMail(t, client, address, strings.Join([]string{
+		"From: Bob <bob@example.org>",
+		"To: " + address,
+		"Subject: Meeting notes",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"First line",
+		"",
+		"Second paragraph",
+	}, "\r\n"))
+
+	pages := ownedPages(t, app, userRecord.Id)
+	if len(pages) != 1 {
+		t.Fatalf("expected one page, got %d", len(pages))
+	}
+	if title := pages[0].GetString("title"); title != "Meeting notes" {
+		t.Errorf("expected the subject as the title, got %q", title)
+	}
+	content := pages[0].GetString("content")
+	for _, text := range []string{"bob@example.org", "First line", "Second paragraph"} {
+		if !strings.Contains(content, text) {
+			t.Errorf("expected the page to contain %q, got %s", text, content)
+		}
+	}
+}
+
+func TestSMTPOversizedMessage(t *testing.T) {
+	t.Setenv("inbound_max_size", "2000")
+
+	app := newTestApp(t)
+	userRecord, address := newTestUser(t, app, "alice", 20000000)
+	client := dialTestServer(t, app)
+
+	if err := client.Mail("bob@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt(address); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(writer, "Subject: Too big\r\n\r\n%s\r\n", strings.Repeat("x", 5000))
+	if code := smtpCode(writer.Close()); code != 552 {
+		t.Fatalf("expected 552, got %d", code)
+	}
+
+	// The connection is still usable afterwards
+	if err := client.Noop(); err != nil {
+		t.Fatalf("expected the session to carry on, got %v", err)
+	}
+	if pages := ownedPages(t, app, userRecord.Id); len(pages) != 0 {
+		t.Errorf("expected no pages, got %d", len(pages))
+	}
+}
+
+func TestSMTPOverQuotaAttachmentIsDropped(t *testing.T) {
+	app := newTestApp(t)
+	userRecord, address := newTestUser(t, app, "alice", 3000)
+	client := dialTestServer(t, app)
+
+	attachment := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 5000)))
+	sendTestMail(t, client, address, strings.Join([]string{
+		"From: bob@example.org",
+		"To: " + address,
+		"Subject: Big attachment",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain",
+		"",
+		"See attached",
+		"--b1",
+		`Content-Type: application/octet-stream; name="big.bin"`,
+		`Content-Disposition: attachment; filename="big.bin"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		attachment,
+		"--b1--",
+	}, "\r\n"))
+
+	pages := ownedPages(t, app, userRecord.Id)
+	if len(pages) != 1 {
+		t.Fatalf("expected the page to still be made, got %d pages", len(pages))
+	}
+	content := pages[0].GetString("content")
+	if !strings.Contains(content, "big.bin was not saved: You have reached your storage limit") {
+		t.Errorf("expected a note about the dropped attachment, got %s", content)
+	}
+
+	files, err := app.Dao().FindRecordsByFilter("files", "owner = {:owner}", "", 0, 0, dbx.Params{"owner": userRecord.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files to be saved, got %d", len(files))
+	}
+}
+
+//Extra helper functions:
+
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+	skipIfSchemaUnmarshalRecurses(t)
+	t.Setenv("inbound_domain", testInboundDomain)
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir()})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.RefreshSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	createCollection(t, app, "pages", []*schema.SchemaField{
+		{Name: "title", Type: schema.FieldTypeText},
+		{Name: "icon", Type: schema.FieldTypeText},
+		{Name: "owner", Type: schema.FieldTypeText},
+		{Name: "content", Type: schema.FieldTypeJson, Options: &schema.JsonOptions{MaxSize: 2000000}},
+	})
+	createCollection(t, app, "files", []*schema.SchemaField{
+		{Name: "page", Type: schema.FieldTypeText},
+		{Name: "owner", Type: schema.FieldTypeText},
+		{Name: "size", Type: schema.FieldTypeNumber},
+		{Name: "file_data", Type: schema.FieldTypeFile, Options: &schema.FileOptions{MaxSelect: 1, MaxSize: 100000000}},
+	})
+	createCollection(t, app, "user_flags", []*schema.SchemaField{
+		{Name: "user", Type: schema.FieldTypeText},
+		{Name: "collection", Type: schema.FieldTypeText},
+		{Name: "maxUploadSize", Type: schema.FieldTypeNumber},
+		{Name: "quota", Type: schema.FieldTypeNumber},
+	})
+	createCollection(t, app, "inbound_addresses", []*schema.SchemaField{
+		{Name: "user", Type: schema.FieldTypeText},
+		{Name: "secret", Type: schema.FieldTypeText},
+		{Name: "enabled", Type: schema.FieldTypeBool},
+	})
+
+	return app
+}
+
+/*
+pocketbase's SchemaField.UnmarshalJSON decodes into a pointer alias of itself to avoid recursing.
+encoding/json v2 (the default with GOEXPERIMENT=jsonv2) still finds the method through the alias
+and recurses until the stack overflows, so anything that loads a collection can't run with it
+*/
+func skipIfSchemaUnmarshalRecurses(t *testing.T) {
+	t.Helper()
+
+	if err := json.Unmarshal([]byte("{}"), &aliasProbe{}); err != nil {
+		t.Skip("pocketbase collections can't be loaded with encoding/json v2, run with GOEXPERIMENT=nojsonv2")
+	}
+}
+
+// Unmarshals the same way as SchemaField, but gives up instead of recursing
+type aliasProbe struct {
+	depth int
+}
+
+func (p *aliasProbe) UnmarshalJSON(data []byte) error {
+	type alias *aliasProbe
+
+	p.depth++
+	if p.depth > 1 {
+		return errors.New("the alias did not stop the recursion")
+	}
+	return json.Unmarshal(data, alias(p))
+}
+
+func createCollection(t *testing.T, app *pocketbase.PocketBase, name string, fields []*schema.SchemaField) {
+	t.Helper()
+
+	collection := &models.Collection{Name: name, Type: models.CollectionTypeBase, Schema: schema.NewSchema(fields...)}
+	if err := app.Dao().SaveCollection(collection); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+A user with the given quota and an enabled inbound address, returns the address
+*/
+func newTestUser(t *testing.T, app *pocketbase.PocketBase, username string, quota int) (*models.Record, string) {
+	t.Helper()
+
+	users, err := app.Dao().FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userRecord := models.NewRecord(users)
+	userRecord.SetUsername(username)
+	userRecord.SetEmail(username + "@example.com")
+	userRecord.SetPassword("password123456")
+	if err := app.Dao().SaveRecord(userRecord); err != nil {
+		t.Fatal(err)
+	}
+
+	flagsCollection, _ := app.Dao().FindCollectionByNameOrId("user_flags")
+	flags := models.NewRecord(flagsCollection)
+	flags.Set("user", userRecord.Id)
+	flags.Set("collection", users.Id)
+	flags.Set("maxUploadSize", 1000000)
+	flags.Set("quota", quota)
+	if err := app.Dao().SaveRecord(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := strings.Repeat(username, secretLength)[:secretLength]
+	addressCollection, _ := app.Dao().FindCollectionByNameOrId("inbound_addresses")
+	address := models.NewRecord(addressCollection)
+	address.Set("user", userRecord.Id)
+	address.Set("secret", secret)
+	address.Set("enabled", true)
+	if err := app.Dao().SaveRecord(address); err != nil {
+		t.Fatal(err)
+	}
+
+	return userRecord, secret + "@" + testInboundDomain
+}
+
+/*
+Serves smtp sessions on a local port and connects a net/smtp client to it
+*/
+func dialTestServer(t *testing.T, app *pocketbase.PocketBase) *smtp.Client {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			session := &smtpSession{app: app, conn: conn, hostname: testInboundDomain}
+			go session.serve()
+		}
+	}()
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func sendTestMail(t *testing.T, client *smtp.Client, to string, message string) {
+	t.Helper()
+
+	if err := client.Mail("bob@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte(message + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("expected the message to be accepted, got %v", err)
+	}
+}
+
+/*
+Sends a command net/smtp has no method for, returns the reply code
+*/
+func rawCommand(t *testing.T, client *smtp.Client, line string) int {
+	t.Helper()
+
+	id, err := client.Text.Cmd("%s", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+
+	code, _, err := client.Text.ReadResponse(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func smtpCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func ownedPages(t *testing.T, app *pocketbase.PocketBase, userId string) []*models.Record {
+	t.Helper()
+
+	pages, err := app.Dao().FindRecordsByFilter("pages", "owner = {:owner}", "", 0, 0, dbx.Params{"owner": userId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pages
+}
@@ -0,0 +1,264 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+var errUsageCollection = errors.New("user_usage Collection was not found. Please create it to use this feature.")
+
+/*
+A user whose user_usage total_size doesn't match their files
+*/
+type UsageDrift struct {
+	User     string `json:"user"`
+	Recorded int    `json:"recorded"`
+	Actual   int    `json:"actual"`
+}
+
+/*
+Adds a new file to its owners user_usage
+
+Run from OnModelBeforeCreate so it uses the same transaction as the file record and upload
+*/
+func HandleFileCreate(e *core.ModelEvent) error {
+	record, ok := e.Model.(*models.Record)
+	if !ok {
+		return nil
+	}
+	return addUsage(e.Dao, record.GetString("owner"), record.GetInt("size"))
+}
+
+/*
+Moves the usage across when a files size or owner changes
+*/
+func HandleFileUpdate(e *core.ModelEvent) error {
+	record, ok := e.Model.(*models.Record)
+	if !ok {
+		return nil
+	}
+	// The stored row rather than OriginalCopy, which isn't refreshed when a record is saved twice
+	original, err := e.Dao.FindRecordById(record.Collection().Id, record.Id)
+	if err != nil {
+		return nil
+	}
+
+	if original.GetString("owner") == record.GetString("owner") {
+		return addUsage(e.Dao, record.GetString("owner"), record.GetInt("size")-original.GetInt("size"))
+	}
+	if err := addUsage(e.Dao, original.GetString("owner"), -original.GetInt("size")); err != nil {
+		return err
+	}
+	return addUsage(e.Dao, record.GetString("owner"), record.GetInt("size"))
+}
+
+/*
+Takes a deleted file off its owners user_usage
+
+This also covers files removed by CheckFilesMatchBlocks and cascades from deleted pages, they all go through DeleteRecord's transaction
+*/
+func HandleFileDelete(e *core.ModelEvent) error {
+	record, ok := e.Model.(*models.Record)
+	if !ok {
+		return nil
+	}
+	return addUsage(e.Dao, record.GetString("owner"), -record.GetInt("size"))
+}
+
+/*
+Works out every users usage from the files collection and compares it to user_usage
+
+Unless dryRun is set the recorded totals are corrected
+*/
+func ReconcileUsage(app *pocketbase.PocketBase, dryRun bool) ([]UsageDrift, error) {
+	column, ok := usageUserColumn(app.Dao())
+	if !ok {
+		return nil, errUsageCollection
+	}
+
+	actual := []struct {
+		Owner string `db:"owner"`
+		Total int    `db:"total"`
+	}{}
+	err := app.Dao().DB().
+		NewQuery("SELECT owner, COALESCE(SUM(size), 0) AS total FROM files WHERE owner != '' GROUP BY owner").
+		All(&actual)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := []struct {
+		User      string `db:"user"`
+		TotalSize int    `db:"total_size"`
+	}{}
+	if err := app.Dao().DB().NewQuery("SELECT [[" + column + "]] AS user, total_size FROM user_usage").All(&recorded); err != nil {
+		return nil, err
+	}
+
+	totals := map[string]int{}
+	for _, usage := range recorded {
+		totals[usage.User] += usage.TotalSize
+	}
+
+	drift := []UsageDrift{}
+	seen := map[string]bool{}
+	for _, usage := range actual {
+		seen[usage.Owner] = true
+		if totals[usage.Owner] != usage.Total {
+			drift = append(drift, UsageDrift{User: usage.Owner, Recorded: totals[usage.Owner], Actual: usage.Total})
+		}
+	}
+	// Users that have no files left but still have usage recorded
+	for userId, total := range totals {
+		if !seen[userId] && total != 0 {
+			drift = append(drift, UsageDrift{User: userId, Recorded: total, Actual: 0})
+		}
+	}
+
+	if dryRun {
+		return drift, nil
+	}
+
+	err = app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		for _, usage := range drift {
+			if err := setUsage(txDao, usage.User, usage.Actual); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return drift, err
+}
+
+/*
+The `usage` command
+
+- usage reconcile: recomputes user_usage from the files collection and prints any drift (--dry-run only prints it)
+*/
+func NewUsageCommand(app *pocketbase.PocketBase) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "usage",
+		Short: "Check the storage usage recorded for each user",
+	}
+
+	var dryRun bool
+	reconcile := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Recomputes user_usage from the files collection and reports any drift",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			drift, err := ReconcileUsage(app, dryRun)
+			if err != nil {
+				return err
+			}
+
+			if len(drift) == 0 {
+				fmt.Println("Usage matches the files collection")
+				return nil
+			}
+			for _, usage := range drift {
+				fmt.Printf("%s: recorded %d bytes, actual %d bytes (%+d)\n", usage.User, usage.Recorded, usage.Actual, usage.Actual-usage.Recorded)
+			}
+			if dryRun {
+				fmt.Printf("%d users have drifted, run without --dry-run to fix them\n", len(drift))
+			} else {
+				fmt.Printf("Fixed %d users\n", len(drift))
+			}
+			return nil
+		},
+	}
+	reconcile.Flags().BoolVar(&dryRun, "dry-run", false, "only report the drift")
+	command.AddCommand(reconcile)
+
+	return command
+}
+
+//Extra helper functions:
+
+/*
+How user_usage records point at their user, either the user relation field or the record id
+
+user_usage collections from before usage tracking have no user field and use the users id as the record id,
+those keep working as they are. Adding the user relation field moves lookups over to it,
+so fill it in on the existing records or run usage reconcile afterwards to make new ones.
+Returns false when usage can't be tracked, eg. there is no collection or it is a view
+*/
+func usageUserColumn(dao *daos.Dao) (string, bool) {
+	collection, err := dao.FindCollectionByNameOrId("user_usage")
+	if err != nil || collection.IsView() {
+		return "", false
+	}
+	if collection.Schema.GetFieldByName("user") == nil {
+		return "id", true
+	}
+	return "user", true
+}
+
+/*
+Finds the user_usage record for a user
+*/
+func findUsage(dao *daos.Dao, userId string) (*models.Record, error) {
+	column, ok := usageUserColumn(dao)
+	if !ok {
+		return nil, errUsageCollection
+	}
+	if column == "id" {
+		return dao.FindRecordById("user_usage", userId)
+	}
+	return dao.FindFirstRecordByFilter("user_usage", "user = {:user}", dbx.Params{"user": userId})
+}
+
+/*
+Changes total_size in one statement so concurrent uploads can't overwrite each other, creating the record on the first upload
+*/
+func addUsage(dao *daos.Dao, userId string, delta int) error {
+	if userId == "" || delta == 0 {
+		return nil
+	}
+	// Uploads still work without usage tracking, the quota just can't see them
+	column, ok := usageUserColumn(dao)
+	if !ok {
+		return nil
+	}
+
+	result, err := dao.DB().
+		NewQuery("UPDATE user_usage SET total_size = MAX(total_size + {:delta}, 0), updated = {:now} WHERE [[" + column + "]] = {:user}").
+		Bind(dbx.Params{"delta": delta, "user": userId, "now": types.NowDateTime().String()}).
+		Execute()
+	if err != nil {
+		return err
+	}
+	// Nothing to take off if they don't have a record, eg. the user is being deleted
+	if rows, _ := result.RowsAffected(); rows > 0 || delta < 0 {
+		return nil
+	}
+
+	return setUsage(dao, userId, delta)
+}
+
+func setUsage(dao *daos.Dao, userId string, total int) error {
+	record, err := findUsage(dao, userId)
+	if err != nil {
+		collection, err := dao.FindCollectionByNameOrId("user_usage")
+		if err != nil || collection.IsView() {
+			return errUsageCollection
+		}
+		record = models.NewRecord(collection)
+		if column, _ := usageUserColumn(dao); column == "id" {
+			record.SetId(userId)
+		} else {
+			record.Set("user", userId)
+		}
+	}
+
+	record.Set("total_size", total)
+	return dao.SaveRecord(record)
+}
@@ -0,0 +1,477 @@
+package emails
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+var (
+	maxBounceBodySize int64 = 10 * 1024 * 1024
+	maxReportDepth          = 5
+)
+
+/*
+Enhanced status codes that start with 5 but usually clear up by themselves, so they only count as soft bounces
+*/
+var softFailureStatuses = map[string]bool{
+	"5.2.2": true, // Mailbox full
+	"5.4.7": true, // Delivery time expired
+}
+
+/*
+Checks if a raw email is a delivery status notification (RFC 3464) or a complaint (RFC 5965 ARF)
+*/
+func IsBounceReport(raw []byte) bool {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/report"
+}
+
+/*
+Reads the bounces or complaints out of a multipart/report email
+
+Delivery status reports give one event per failed recipient, feedback reports give a complaint
+*/
+func ParseBounceReport(raw []byte) ([]BounceEvent, error) {
+	report, err := parseBounceReport(raw)
+	if err != nil {
+		return nil, err
+	}
+	return report.events, nil
+}
+
+/*
+Saves every bounce or complaint in a report email that came in by mail. Returns how many were recorded
+
+Anyone can send a report, so it only counts when the Message-ID of the original email in it matches one in
+the email_outbox and the address was one of its recipients. Reports for mail sent without the outbox are ignored
+*/
+func HandleBounceReport(app *pocketbase.PocketBase, raw []byte) (int, error) {
+	report, err := parseBounceReport(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	sentRecord, err := findSentEmail(app, report.originalMessageId)
+	if err != nil {
+		return 0, err
+	}
+	recipients := sentRecipients(sentRecord)
+
+	events := make([]BounceEvent, 0, len(report.events))
+	for _, event := range report.events {
+		if !recipients[strings.ToLower(event.Email)] {
+			app.Logger().Warn("Ignoring a bounce for an address the original email wasn't sent to", "email", event.Email, "outbox", sentRecord.Id)
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return 0, NewEmailError("The bounce report isn't for a recipient of the original email")
+	}
+
+	return recordBounces(app, events)
+}
+
+//Extra helper functions:
+
+/*
+Accepts bounce and complaint webhooks from a mail provider or mta
+
+The bounce_webhook_secret env has to be sent as the X-Webhook-Secret header or ?secret=.
+The body is either json ({"type": "hard", "email": "..."}, a list of them or {"events": [...]})
+or a raw report email for mail drop setups
+*/
+func bounceWebhook(app *pocketbase.PocketBase, c echo.Context) error {
+	secret, found := os.LookupEnv("bounce_webhook_secret")
+	if !found || secret == "" {
+		return apis.NewNotFoundError("Bounce webhooks are not enabled", nil)
+	}
+
+	supplied := c.Request().Header.Get("X-Webhook-Secret")
+	if supplied == "" {
+		supplied = c.QueryParam("secret")
+	}
+	if subtle.ConstantTimeCompare([]byte(supplied), []byte(secret)) != 1 {
+		return apis.NewUnauthorizedError("Invalid webhook secret", nil)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxBounceBodySize))
+	if err != nil {
+		return apis.NewBadRequestError("Unable to read the request", nil)
+	}
+
+	var events []BounceEvent
+	if strings.Contains(c.Request().Header.Get("Content-Type"), "json") {
+		events, err = parseBounceJSON(body)
+	} else {
+		events, err = ParseBounceReport(body)
+	}
+	if err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	recorded, err := recordBounces(app, events)
+	if err != nil && recorded == 0 {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["recorded"] = recorded
+
+	return c.JSON(200, res)
+}
+
+/*
+Lists suppressed addresses, add ?all=true to include ones that only have soft bounces or were unsuppressed
+*/
+func listSuppressions(app *pocketbase.PocketBase, c echo.Context) error {
+	filter := "suppressed = true"
+	if c.QueryParam("all") == "true" {
+		filter = "id != ''"
+	}
+
+	records, err := app.Dao().FindRecordsByFilter("email_suppressions", filter, "-last_event", 100, 0)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load the suppression list", nil)
+	}
+
+	items := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		items = append(items, map[string]interface{}{
+			"id":           record.Id,
+			"email":        record.GetString("email"),
+			"suppressed":   record.GetBool("suppressed"),
+			"reason":       record.GetString("reason"),
+			"soft_bounces": record.GetInt("soft_bounces"),
+			"status":       record.GetString("status"),
+			"diagnostic":   record.GetString("diagnostic"),
+			"source":       record.GetString("source"),
+			"last_event":   record.GetDateTime("last_event"),
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["suppressions"] = items
+
+	return c.JSON(200, res)
+}
+
+func suppressAddress(app *pocketbase.PocketBase, c echo.Context) error {
+	if err := Suppress(app, c.FormValue("email"), c.FormValue("diagnostic")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Address suppressed"
+
+	return c.JSON(200, res)
+}
+
+func unsuppressAddress(app *pocketbase.PocketBase, c echo.Context) error {
+	if err := Unsuppress(app, c.FormValue("email")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Address unsuppressed"
+
+	return c.JSON(200, res)
+}
+
+func parseBounceReport(raw []byte) (*bounceReport, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, NewEmailError("Invalid email: %s", err.Error())
+	}
+
+	report := &bounceReport{}
+	if err := report.walk(textproto.MIMEHeader(message.Header), message.Body, 0); err != nil {
+		return nil, err
+	}
+	if !report.found {
+		return nil, NewEmailError("Not a delivery status notification or feedback report")
+	}
+
+	return report, nil
+}
+
+/*
+Finds the outbox email a report is about from the Message-ID set when it was sent
+*/
+func findSentEmail(app *pocketbase.PocketBase, messageId string) (*models.Record, error) {
+	messageId = strings.TrimSpace(messageId)
+	if messageId == "" {
+		return nil, NewEmailError("The bounce report doesn't include the original Message-ID")
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"email_outbox", "message_id = {:messageId}",
+		dbx.Params{"messageId": messageId},
+	)
+	if err != nil {
+		return nil, NewEmailError("The bounce report doesn't match an email that was sent")
+	}
+	return record, nil
+}
+
+/*
+Everyone an outbox email went to, lowercased
+*/
+func sentRecipients(record *models.Record) map[string]bool {
+	var recp []mail.Address
+	_ = record.UnmarshalJSONField("recipients", &recp)
+
+	var options MessageOptions
+	_ = record.UnmarshalJSONField("options", &options)
+
+	recipients := map[string]bool{}
+	for _, list := range [][]mail.Address{recp, options.Cc, options.Bcc} {
+		for _, address := range list {
+			recipients[strings.ToLower(address.Address)] = true
+		}
+	}
+	return recipients
+}
+
+/*
+Records each event, carrying on past bad ones. Returns the last error if any failed
+*/
+func recordBounces(app *pocketbase.PocketBase, events []BounceEvent) (int, error) {
+	recorded := 0
+	var lastErr error
+	for _, event := range events {
+		if err := RecordBounce(app, event); err != nil {
+			app.Logger().Error("Failed to record a bounce", "email", event.Email, "details", err)
+			lastErr = err
+			continue
+		}
+		recorded++
+	}
+	return recorded, lastErr
+}
+
+/*
+The generic webhook format. "bounce" with a bounce_type is accepted as well as the plain types
+*/
+func parseBounceJSON(body []byte) ([]BounceEvent, error) {
+	type webhookEvent struct {
+		BounceEvent
+		BounceType string `json:"bounce_type"`
+	}
+
+	var events []webhookEvent
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &events); err != nil {
+			return nil, NewEmailError("Invalid json: %s", err.Error())
+		}
+	default:
+		var wrapper struct {
+			Events []webhookEvent `json:"events"`
+		}
+		if err := json.Unmarshal(trimmed, &wrapper); err != nil {
+			return nil, NewEmailError("Invalid json: %s", err.Error())
+		}
+		events = wrapper.Events
+		if events == nil {
+			var single webhookEvent
+			if err := json.Unmarshal(trimmed, &single); err != nil {
+				return nil, NewEmailError("Invalid json: %s", err.Error())
+			}
+			events = []webhookEvent{single}
+		}
+	}
+
+	parsed := make([]BounceEvent, 0, len(events))
+	for _, event := range events {
+		event.Type = strings.ToLower(event.Type)
+		if event.Type == "bounce" {
+			event.Type = strings.ToLower(event.BounceType)
+			if event.Type == "" {
+				event.Type = BounceHard
+			}
+		}
+		if event.Source == "" {
+			event.Source = "webhook"
+		}
+		parsed = append(parsed, event.BounceEvent)
+	}
+
+	if len(parsed) == 0 {
+		return nil, NewEmailError("No bounce events found")
+	}
+	return parsed, nil
+}
+
+/*
+Collects the events while walking the parts of a report, some mtas nest it inside a multipart/mixed
+*/
+type bounceReport struct {
+	found             bool
+	events            []BounceEvent
+	originalRecipient string
+	originalMessageId string
+	complaints        []BounceEvent
+}
+
+func (r *bounceReport) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxReportDepth {
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return NewEmailError("Invalid report: %s", err.Error())
+			}
+			if err := r.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	case mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status":
+		r.found = true
+		r.events = append(r.events, parseDeliveryStatus(body)...)
+	case mediaType == "message/feedback-report":
+		r.found = true
+		r.parseFeedbackReport(body)
+	case mediaType == "message/rfc822" || mediaType == "text/rfc822-headers" || mediaType == "message/rfc822-headers":
+		// The original message says who the complaint is about when the report doesn't, and which email it was
+		original, _ := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+		if addresses, err := mail.ParseAddressList(original.Get("To")); err == nil && len(addresses) > 0 && r.originalRecipient == "" {
+			r.originalRecipient = addresses[0].Address
+		}
+		if r.originalMessageId == "" {
+			r.originalMessageId = strings.TrimSpace(original.Get("Message-Id"))
+		}
+	}
+
+	if depth == 0 {
+		for _, complaint := range r.complaints {
+			if complaint.Email == "" {
+				complaint.Email = r.originalRecipient
+			}
+			if complaint.Email != "" {
+				r.events = append(r.events, complaint)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *bounceReport) parseFeedbackReport(body io.Reader) {
+	fields, _ := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+
+	complaint := BounceEvent{
+		Type:       BounceComplaint,
+		Diagnostic: fields.Get("Feedback-Type"),
+		Source:     "arf",
+	}
+	recipients := fields.Values("Original-Rcpt-To")
+	if len(recipients) == 0 {
+		r.complaints = append(r.complaints, complaint)
+		return
+	}
+	for _, recipient := range recipients {
+		complaint.Email = strings.Trim(strings.TrimSpace(recipient), "<>")
+		r.complaints = append(r.complaints, complaint)
+	}
+}
+
+/*
+A delivery-status part is the per message fields followed by a block of fields for each recipient
+*/
+func parseDeliveryStatus(body io.Reader) []BounceEvent {
+	reader := textproto.NewReader(bufio.NewReader(body))
+	events := []BounceEvent{}
+
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if recipient := statusRecipient(fields); recipient != "" {
+			if event, ok := deliveryStatusEvent(recipient, fields); ok {
+				events = append(events, event)
+			}
+		}
+		if err != nil {
+			return events
+		}
+	}
+}
+
+func deliveryStatusEvent(recipient string, fields textproto.MIMEHeader) (BounceEvent, bool) {
+	action := strings.ToLower(strings.TrimSpace(fields.Get("Action")))
+	status := strings.TrimSpace(fields.Get("Status"))
+	if fields := strings.Fields(status); len(fields) > 0 {
+		status = fields[0]
+	}
+
+	event := BounceEvent{
+		Email:      recipient,
+		Status:     status,
+		Diagnostic: strings.TrimSpace(fields.Get("Diagnostic-Code")),
+		Source:     "dsn",
+	}
+
+	switch {
+	case action != "failed":
+		// delivered, relayed, expanded and delayed aren't bounces
+		return event, false
+	case strings.HasPrefix(status, "4") || softFailureStatuses[status]:
+		event.Type = BounceSoft
+	default:
+		event.Type = BounceHard
+	}
+	return event, true
+}
+
+/*
+Final-Recipient: rfc822; someone@example.com
+*/
+func statusRecipient(fields textproto.MIMEHeader) string {
+	value := fields.Get("Final-Recipient")
+	if value == "" {
+		value = fields.Get("Original-Recipient")
+	}
+	if value == "" {
+		return ""
+	}
+
+	if _, address, found := strings.Cut(value, ";"); found {
+		value = address
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
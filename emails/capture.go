@@ -0,0 +1,124 @@
+package emails
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+/*
+Local mail capture for development and tests
+
+When EMAIL_CAPTURE=true nothing is sent, messages are kept in memory and shown at /api/mailbox
+
+With DKIM set up the signed raw message is kept too so the signature can be checked
+*/
+
+var (
+	capturedLimit = 200
+
+	captured      []CapturedEmail
+	capturedMutex sync.Mutex
+)
+
+type CapturedEmail struct {
+	Id      string            `json:"id"`
+	From    string            `json:"from"`
+	To      []string          `json:"to"`
+	Cc      []string          `json:"cc"`
+	Bcc     []string          `json:"bcc"`
+	Subject string            `json:"subject"`
+	Headers map[string]string `json:"headers"`
+	HTML    string            `json:"html"`
+	Text    string            `json:"text"`
+	Raw     string            `json:"raw,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+func CaptureEnabled() bool {
+	val, found := os.LookupEnv("EMAIL_CAPTURE")
+	return found && val == "true"
+}
+
+/*
+Keeps a copy of the message, dropping the oldest once the limit is hit
+*/
+func captureEmail(message *mailer.Message, signer *DKIMSigner) {
+	var raw string
+	if signer != nil {
+		// Attachments are readers so they can only be used once, they are left out of the raw copy
+		unsigned, err := buildRawMessage(&mailer.Message{
+			From: message.From, To: message.To, Cc: message.Cc, Subject: message.Subject,
+			HTML: message.HTML, Text: message.Text, Headers: message.Headers,
+		})
+		if err == nil {
+			if signed, err := signer.Sign(unsigned); err == nil {
+				raw = string(signed)
+			}
+		}
+	}
+
+	capturedMutex.Lock()
+	defer capturedMutex.Unlock()
+
+	email := CapturedEmail{
+		Id:      security.RandomString(15),
+		From:    message.From.String(),
+		Subject: message.Subject,
+		Headers: message.Headers,
+		HTML:    message.HTML,
+		Text:    message.Text,
+		Raw:     raw,
+		Created: time.Now().UTC(),
+	}
+	for _, address := range message.To {
+		email.To = append(email.To, address.String())
+	}
+	for _, address := range message.Cc {
+		email.Cc = append(email.Cc, address.String())
+	}
+	for _, address := range message.Bcc {
+		email.Bcc = append(email.Bcc, address.String())
+	}
+
+	captured = append(captured, email)
+	if len(captured) > capturedLimit {
+		captured = captured[len(captured)-capturedLimit:]
+	}
+}
+
+/*
+Lists the captured emails, newest first
+*/
+func CapturedEmails() []CapturedEmail {
+	capturedMutex.Lock()
+	defer capturedMutex.Unlock()
+
+	emails := make([]CapturedEmail, 0, len(captured))
+	for i := len(captured) - 1; i >= 0; i-- {
+		emails = append(emails, captured[i])
+	}
+	return emails
+}
+
+func FindCapturedEmail(id string) (CapturedEmail, bool) {
+	capturedMutex.Lock()
+	defer capturedMutex.Unlock()
+
+	for _, email := range captured {
+		if email.Id == id {
+			return email, true
+		}
+	}
+	return CapturedEmail{}, false
+}
+
+func ClearCapturedEmails() {
+	capturedMutex.Lock()
+	defer capturedMutex.Unlock()
+
+	captured = nil
+}
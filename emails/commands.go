@@ -0,0 +1,197 @@
+package emails
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+/*
+The `dkim` command
+
+- dkim record: prints the TXT record for the configured key
+
+- dkim generate: makes a new key and prints it with its record
+
+- dkim verify <file>: checks the signature on a raw .eml file
+*/
+func NewDKIMCommand(app *pocketbase.PocketBase) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "dkim",
+		Short: "Manage the DKIM key used to sign emails",
+	}
+
+	command.AddCommand(&cobra.Command{
+		Use:   "record",
+		Short: "Prints the DNS TXT record for the configured DKIM key",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			signer, err := configuredSigner(app)
+			if err != nil {
+				return err
+			}
+
+			record, err := signer.DNSRecord()
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(record)
+			return nil
+		},
+	})
+
+	var bits int
+	var selector string
+	var domain string
+	generate := &cobra.Command{
+		Use:   "generate",
+		Short: "Generates a new DKIM private key and prints it with its DNS record",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := rsa.GenerateKey(rand.Reader, bits)
+			if err != nil {
+				return err
+			}
+
+			if domain == "" {
+				domain = senderDomain(app)
+			}
+			signer := &DKIMSigner{Domain: domain, Selector: selector, Key: key}
+
+			record, err := signer.DNSRecord()
+			if err != nil {
+				return err
+			}
+
+			pem.Encode(os.Stdout, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+			fmt.Println()
+			fmt.Println("Set dkim_selector=" + selector + " and dkim_private_key_file to the saved key, then publish:")
+			fmt.Println(record)
+			return nil
+		},
+	}
+	generate.Flags().IntVar(&bits, "bits", 2048, "the RSA key size")
+	generate.Flags().StringVar(&selector, "selector", "noti", "the DKIM selector")
+	generate.Flags().StringVar(&domain, "domain", "", "the signing domain (defaults to the sender address domain)")
+	command.AddCommand(generate)
+
+	command.AddCommand(&cobra.Command{
+		Use:   "verify [file]",
+		Short: "Checks the DKIM signature of a raw email against the configured key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			signer, err := configuredSigner(app)
+			if err != nil {
+				return err
+			}
+
+			message, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			if err := VerifyDKIM(message, &signer.Key.PublicKey); err != nil {
+				return err
+			}
+
+			fmt.Println("DKIM signature is valid")
+			return nil
+		},
+	})
+
+	return command
+}
+
+/*
+The `templates` command
+
+- templates seed: adds the built in templates to custom_emails (--overwrite replaces existing ones)
+
+- templates export [dir]: writes the built in templates out as Markdown files
+*/
+func NewTemplatesCommand(app *pocketbase.PocketBase) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "templates",
+		Short: "Seed or export the built in email templates",
+	}
+
+	var overwrite bool
+	seed := &cobra.Command{
+		Use:   "seed",
+		Short: "Adds the built in email templates to the custom_emails collection",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			seeded, err := SeedDefaultTemplates(app, overwrite)
+			if err != nil {
+				return err
+			}
+
+			if len(seeded) == 0 {
+				fmt.Println("All templates already exist, use --overwrite to replace them")
+				return nil
+			}
+			for _, name := range seeded {
+				fmt.Println("Seeded " + name)
+			}
+			return nil
+		},
+	}
+	seed.Flags().BoolVar(&overwrite, "overwrite", false, "replace templates that already exist")
+	command.AddCommand(seed)
+
+	command.AddCommand(&cobra.Command{
+		Use:   "export [dir]",
+		Short: "Writes the built in email templates to a folder as Markdown",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := "email_templates"
+			if len(args) == 1 {
+				dir = args[0]
+			}
+
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+
+			for _, name := range DefaultTemplateNames() {
+				markdown, _ := DefaultTemplate(name, "")
+				if err := os.WriteFile(filepath.Join(dir, name+".md"), []byte(markdown), 0644); err != nil {
+					return err
+				}
+				fmt.Println("Exported " + filepath.Join(dir, name+".md"))
+			}
+			return nil
+		},
+	})
+
+	return command
+}
+
+//Extra helper functions:
+
+func configuredSigner(app *pocketbase.PocketBase) (*DKIMSigner, error) {
+	signer, err := LoadDKIMSigner(app.Settings().Meta.SenderAddress)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return nil, errors.New("DKIM is not configured. Set dkim_selector and dkim_private_key or dkim_private_key_file")
+	}
+	return signer, nil
+}
+
+func senderDomain(app *pocketbase.PocketBase) string {
+	address := app.Settings().Meta.SenderAddress
+	for i := len(address) - 1; i >= 0; i-- {
+		if address[i] == '@' {
+			return address[i+1:]
+		}
+	}
+	return address
+}
@@ -0,0 +1,131 @@
+package emails
+
+import (
+	"embed"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
+)
+
+/*
+The built in templates, in Markdown, used when custom_emails has no record for an email
+
+Translations can be added as defaults/<name>.<locale>.md
+*/
+//go:embed defaults/*.md
+var defaultTemplates embed.FS
+
+/*
+The names of every built in template
+*/
+func DefaultTemplateNames() []string {
+	entries, _ := defaultTemplates.ReadDir("defaults")
+
+	var names []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".md")
+		if !strings.Contains(name, ".") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+/*
+Returns the built in Markdown for a template in the closest locale
+*/
+func DefaultTemplate(emailName string, locale string) (string, bool) {
+	for _, candidate := range i18n.Candidates(locale) {
+		if data, err := defaultTemplates.ReadFile(path.Join("defaults", emailName+"."+candidate+".md")); err == nil {
+			return string(data), true
+		}
+	}
+
+	data, err := defaultTemplates.ReadFile(path.Join("defaults", emailName+".md"))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+/*
+Writes the built in templates into custom_emails so they can be edited
+
+Existing records are left alone unless overwrite is set. They are seeded without a locale, or by name only
+when the collection has no locale field, the same way findEmailTemplate looks them up
+*/
+func SeedDefaultTemplates(app *pocketbase.PocketBase, overwrite bool) ([]string, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId("custom_emails")
+	if err != nil {
+		return nil, NewEmailError("custom_emails Collection was not found. Please create it to use this feature.")
+	}
+
+	hasLocale := collection.Schema.GetFieldByName("locale") != nil
+
+	var seeded []string
+	for _, name := range DefaultTemplateNames() {
+		markdown, _ := DefaultTemplate(name, "")
+
+		filter := "name = {:name}"
+		if hasLocale {
+			filter += " && locale = ''"
+		}
+		record, err := app.Dao().FindFirstRecordByFilter("custom_emails", filter, dbx.Params{"name": name})
+		if err == nil && !overwrite {
+			continue
+		}
+		if err != nil {
+			record = models.NewRecord(collection)
+			record.Set("name", name)
+			if hasLocale {
+				record.Set("locale", "")
+			}
+		}
+
+		record.Set("email_markdown", markdown)
+		record.Set("email_rich", "")
+		if category, ok := defaultTemplateCategories[name]; ok {
+			record.Set("category", category)
+		} else {
+			record.Set("category", CategorySecurity)
+		}
+
+		if err := app.Dao().SaveRecord(record); err != nil {
+			return seeded, err
+		}
+		seeded = append(seeded, name)
+	}
+
+	return seeded, nil
+}
+
+//Extra helper functions:
+
+/*
+Builds an unsaved custom_emails record from a built in template
+*/
+func defaultTemplateRecord(app *pocketbase.PocketBase, emailName string, locale string) (*models.Record, error) {
+	markdown, found := DefaultTemplate(emailName, locale)
+	if !found {
+		return nil, NewEmailError("No template found for %s", emailName)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("custom_emails")
+	if err != nil {
+		collection = &models.Collection{Name: "custom_emails"}
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("name", emailName)
+	record.Set("locale", "")
+	record.Set("email_markdown", markdown)
+
+	return record, nil
+}
@@ -0,0 +1,328 @@
+package emails
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+DKIM signing (RFC 6376) with rsa-sha256 and relaxed/relaxed canonicalization
+
+Configured with the envs:
+
+- dkim_selector
+
+- dkim_private_key (the PEM) or dkim_private_key_file
+
+- dkim_domain, optional, defaults to the domain of the sender address
+*/
+
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      *rsa.PrivateKey
+}
+
+/*
+The headers that get signed when the message has them
+*/
+var dkimSignedHeaders = []string{
+	"from", "reply-to", "subject", "date", "to", "cc", "message-id",
+	"mime-version", "content-type", "list-unsubscribe", "list-unsubscribe-post",
+}
+
+var (
+	dkimSigner     *DKIMSigner
+	dkimSignerErr  error
+	dkimSignerOnce sync.Once
+
+	dkimWhitespaceRegex = regexp.MustCompile(`[ \t]+`)
+	dkimSignatureRegex  = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+/*
+Loads the signer from the envs once
+
+Returns nil when DKIM isn't configured
+*/
+func LoadDKIMSigner(senderAddress string) (*DKIMSigner, error) {
+	dkimSignerOnce.Do(func() {
+		selector, found := os.LookupEnv("dkim_selector")
+		if !found || selector == "" {
+			return
+		}
+
+		pemData := strings.ReplaceAll(os.Getenv("dkim_private_key"), `\n`, "\n")
+		if path := os.Getenv("dkim_private_key_file"); pemData == "" && path != "" {
+			fileData, err := os.ReadFile(path)
+			if err != nil {
+				dkimSignerErr = err
+				return
+			}
+			pemData = string(fileData)
+		}
+		if pemData == "" {
+			return
+		}
+
+		key, err := ParseDKIMPrivateKey([]byte(pemData))
+		if err != nil {
+			dkimSignerErr = err
+			return
+		}
+
+		dkimSigner = &DKIMSigner{
+			Domain:   os.Getenv("dkim_domain"),
+			Selector: selector,
+			Key:      key,
+		}
+	})
+
+	if dkimSigner == nil || dkimSignerErr != nil {
+		return nil, dkimSignerErr
+	}
+
+	signer := *dkimSigner
+	if signer.Domain == "" {
+		if at := strings.LastIndex(senderAddress, "@"); at != -1 {
+			signer.Domain = senderAddress[at+1:]
+		}
+	}
+
+	return &signer, nil
+}
+
+/*
+Reads a PKCS1 or PKCS8 RSA private key
+*/
+func ParseDKIMPrivateKey(pemData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, NewEmailError("Invalid DKIM private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, NewEmailError("Invalid DKIM private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, NewEmailError("The DKIM private key must be an RSA key")
+	}
+	return key, nil
+}
+
+/*
+Adds a DKIM-Signature header to the front of a raw message
+*/
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	headers, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	var names []string
+	var signedHeaders bytes.Buffer
+	for _, name := range dkimSignedHeaders {
+		if field, ok := lastHeader(headers, name); ok {
+			names = append(names, name)
+			signedHeaders.WriteString(relaxedHeader(field) + "\r\n")
+		}
+	}
+
+	dkimHeader := fmt.Sprintf(
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.Domain, s.Selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	signedHeaders.WriteString(relaxedHeader(dkimHeader))
+
+	digest := sha256.Sum256(signedHeaders.Bytes())
+	signature, err := rsa.SignPKCS1v15(nil, s.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var signed bytes.Buffer
+	signed.WriteString(dkimHeader)
+	signed.WriteString(base64.StdEncoding.EncodeToString(signature))
+	signed.WriteString("\r\n")
+	signed.Write(normalizeLineEndings(message))
+
+	return signed.Bytes(), nil
+}
+
+/*
+The TXT record to publish at <selector>._domainkey.<domain>
+
+Split into 255 character strings as DNS needs
+*/
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	publicKey, err := x509.MarshalPKIXPublicKey(&s.Key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	value := "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKey)
+
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, `"`+value[:255]+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+value+`"`)
+
+	return fmt.Sprintf("%s._domainkey.%s. IN TXT ( %s )", s.Selector, s.Domain, strings.Join(parts, " ")), nil
+}
+
+/*
+Checks the DKIM-Signature on a raw message against the public key
+
+Only relaxed/relaxed rsa-sha256 signatures, like the ones made by Sign, are supported
+*/
+func VerifyDKIM(message []byte, publicKey *rsa.PublicKey) error {
+	headers, body := splitMessage(message)
+
+	dkimHeader, ok := lastHeader(headers, "dkim-signature")
+	if !ok {
+		return NewEmailError("No DKIM-Signature header found")
+	}
+
+	tags := parseDKIMTags(dkimHeader[strings.Index(dkimHeader, ":")+1:])
+	if tags["a"] != "rsa-sha256" || tags["c"] != "relaxed/relaxed" {
+		return NewEmailError("Unsupported DKIM algorithm or canonicalization")
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return NewEmailError("DKIM body hash does not match")
+	}
+
+	var signedHeaders bytes.Buffer
+	// Headers are used from the bottom up when a name is listed more than once
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		matches := allHeaders(headers, name)
+		index := len(matches) - 1 - used[name]
+		used[name]++
+		if index < 0 {
+			continue
+		}
+		signedHeaders.WriteString(relaxedHeader(matches[index]) + "\r\n")
+	}
+	signedHeaders.WriteString(relaxedHeader(dkimSignatureRegex.ReplaceAllString(dkimHeader, "$1$2")))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return NewEmailError("Invalid DKIM signature encoding")
+	}
+
+	digest := sha256.Sum256(signedHeaders.Bytes())
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return NewEmailError("DKIM signature does not match")
+	}
+
+	return nil
+}
+
+//Extra helper functions:
+
+func normalizeLineEndings(message []byte) []byte {
+	message = bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(message, []byte("\n"), []byte("\r\n"))
+}
+
+/*
+Splits a raw message into its header fields (with folding kept) and body
+*/
+func splitMessage(message []byte) ([]string, []byte) {
+	message = normalizeLineEndings(message)
+
+	headerBlock, body, found := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !found {
+		headerBlock, body = message, nil
+	}
+
+	var fields []string
+	for _, line := range strings.Split(string(headerBlock), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	return fields, body
+}
+
+func allHeaders(fields []string, name string) []string {
+	var matches []string
+	for _, field := range fields {
+		fieldName, _, found := strings.Cut(field, ":")
+		if found && strings.EqualFold(strings.TrimSpace(fieldName), name) {
+			matches = append(matches, field)
+		}
+	}
+	return matches
+}
+
+func lastHeader(fields []string, name string) (string, bool) {
+	matches := allHeaders(fields, name)
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[len(matches)-1], true
+}
+
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = dkimWhitespaceRegex.ReplaceAllString(value, " ")
+
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value)
+}
+
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkimWhitespaceRegex.ReplaceAllString(line, " "), " ")
+	}
+
+	// Drop the empty lines at the end
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		key, tagValue, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+		tags[strings.TrimSpace(key)] = strings.Join(strings.Fields(tagValue), "")
+	}
+	return tags
+}
@@ -0,0 +1,72 @@
+package emails
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type EmailError struct {
+	Message string
+}
+
+// Error implements the error interface for EmailError
+func (e *EmailError) Error() string {
+	return e.Message
+}
+
+// NewEmailError creates a new EmailError with the given message
+func NewEmailError(format string, a ...interface{}) error {
+	return &EmailError{
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+/*
+A template parse or execute error with the line it happened on
+
+Line and Column are 0 when go doesn't report them
+*/
+type TemplateError struct {
+	Stage   string `json:"stage"`
+	Field   string `json:"field"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+var templateErrorRegex = regexp.MustCompile(`(?s)^(?:html/)?template: ?[^:]*:(\d+)(?::(\d+))?: (.*)$`)
+
+// Error implements the error interface for TemplateError
+func (e *TemplateError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s %s: %s", e.Stage, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s %s line %d: %s", e.Stage, e.Field, e.Line, e.Message)
+}
+
+// newTemplateError pulls the line and column out of a go template error
+func newTemplateError(stage string, field string, err error) error {
+	templateErr := &TemplateError{Stage: stage, Field: field, Message: err.Error()}
+
+	if match := templateErrorRegex.FindStringSubmatch(err.Error()); match != nil {
+		templateErr.Line, _ = strconv.Atoi(match[1])
+		templateErr.Column, _ = strconv.Atoi(match[2])
+		templateErr.Message = match[3]
+	}
+
+	return templateErr
+}
+
+/*
+Returned when every recipient of an email is on the suppression list so nothing was sent
+*/
+type SuppressedError struct {
+	Addresses []string `json:"addresses"`
+}
+
+// Error implements the error interface for SuppressedError
+func (e *SuppressedError) Error() string {
+	return fmt.Sprintf("Recipient is suppressed after bounces or complaints: %s", strings.Join(e.Addresses, ", "))
+}
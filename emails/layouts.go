@@ -0,0 +1,252 @@
+package emails
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
+)
+
+/*
+The brand variables a layout can use as {{ .Brand.X }}
+
+Empty values on a layout record fall back to the defaults below
+*/
+type Brand struct {
+	AppName         string
+	AppURL          string
+	LogoURL         string
+	PrimaryColor    string
+	BackgroundColor string
+	TextColor       string
+	FontFamily      string
+	FontURL         string
+	MaxWidth        string
+	Footer          template.HTML
+}
+
+/*
+What a layout is executed with
+
+Content is the rendered template, Slots holds anything the template set with {{ define "name" }}
+*/
+type LayoutData struct {
+	Content         template.HTML
+	Slots           map[string]template.HTML
+	Brand           Brand
+	Locale          string
+	UnsubscribeURL  string
+	UnsubscribeText string
+}
+
+/*
+A parsed email_layouts record
+*/
+type Layout struct {
+	Name     string
+	Template *template.Template
+	Brand    Brand
+}
+
+const DefaultLayoutName = "default"
+
+/*
+The layout used when a template has none and there is no default record in email_layouts
+*/
+const defaultLayout = `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html dir="ltr" lang="{{ .Locale }}">
+<head>
+    <meta content="width=device-width" name="viewport" />
+    {{- if .Brand.LogoURL }}
+    <link rel="preload" as="image" href="{{ .Brand.LogoURL }}" />
+    {{- end }}
+    <meta content="text/html; charset=UTF-8" http-equiv="Content-Type" />
+    <meta content="IE=edge" http-equiv="X-UA-Compatible" />
+    <meta name="x-apple-disable-message-reformatting" />
+    <meta content="telephone=no,address=no,email=no,date=no,url=no" name="format-detection" />
+    <meta content="light" name="color-scheme" />
+    <meta content="light" name="supported-color-schemes" />
+    {{ if .Slots.head }}{{ .Slots.head }}{{ end }}
+    <style>
+        {{- if .Brand.FontURL }}
+        @font-face {
+            font-family: '{{ .Brand.FontFamily }}';
+            font-style: normal;
+            font-weight: 400;
+            mso-font-alt: 'sans-serif';
+            src: url({{ .Brand.FontURL }}) format('woff2');
+        }
+        {{- end }}
+        * {
+            font-family: '{{ .Brand.FontFamily }}', sans-serif;
+        }
+        a {
+            color: {{ .Brand.PrimaryColor }};
+        }
+    </style>
+    <style>
+        blockquote, h1, h2, h3, img, li, ol, p, ul {
+            margin-top: 1em;
+            margin-bottom: 1em;
+        }
+    </style>
+</head>
+<body style="margin: 0; padding: 0; background-color: {{ .Brand.BackgroundColor }};">
+    {{ if .Slots.preheader }}<div style="display: none; max-height: 0; overflow: hidden;">{{ .Slots.preheader }}</div>{{ end }}
+    <table role="presentation" style="width: 100%; border-collapse: collapse; margin: 0; padding: 0; background-color: {{ .Brand.BackgroundColor }};">
+        <tr>
+            <td align="center" style="padding: 20px 0;">
+                <table role="presentation" style="max-width: {{ .Brand.MaxWidth }}; width: 100%; border-collapse: collapse; background-color: {{ .Brand.BackgroundColor }}; margin: 0 auto;">
+                    {{- if .Brand.LogoURL }}
+                    <tr>
+                        <td style="padding: 20px 20px 0 20px; text-align: left;">
+                            <a href="{{ .Brand.AppURL }}"><img src="{{ .Brand.LogoURL }}" alt="{{ .Brand.AppName }}" height="32" /></a>
+                        </td>
+                    </tr>
+                    {{- end }}
+                    <tr>
+                        <td style="padding: 20px; text-align: left; font-family: Arial, sans-serif; font-size: 16px; color: {{ .Brand.TextColor }};">
+                            {{ .Content }}
+                        </td>
+                    </tr>
+                    {{- if or .Slots.footer .Brand.Footer .UnsubscribeURL }}
+                    <tr>
+                        <td style="padding: 0 20px 20px 20px; text-align: left; font-family: Arial, sans-serif; font-size: 12px; color: {{ .Brand.TextColor }};">
+                            {{ if .Slots.footer }}{{ .Slots.footer }}{{ else }}{{ .Brand.Footer }}{{ end }}
+                            {{- if .UnsubscribeURL }}
+                            <p><a href="{{ .UnsubscribeURL }}">{{ .UnsubscribeText }}</a></p>
+                            {{- end }}
+                        </td>
+                    </tr>
+                    {{- end }}
+                </table>
+            </td>
+        </tr>
+    </table>
+</body>
+</html>`
+
+/*
+Loads the layout by name from email_layouts
+
+Falls back to the default record, then the built in layout, so emails always send
+*/
+func loadLayout(app *pocketbase.PocketBase, name string) (*Layout, error) {
+	if name == "" {
+		name = DefaultLayoutName
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter("email_layouts", "name = {:name}", dbx.Params{"name": name})
+	if err != nil && name != DefaultLayoutName {
+		record, err = app.Dao().FindFirstRecordByFilter("email_layouts", "name = {:name}", dbx.Params{"name": DefaultLayoutName})
+	}
+	if err != nil {
+		return builtInLayout(app)
+	}
+
+	return parseLayout(app, record)
+}
+
+func parseLayout(app *pocketbase.PocketBase, record *models.Record) (*Layout, error) {
+	source := record.GetString("html")
+	if strings.TrimSpace(source) == "" {
+		source = defaultLayout
+	}
+
+	layoutTemplate, err := template.New("layout").Parse(source)
+	if err != nil {
+		return nil, newTemplateError("parse", "layout", err)
+	}
+
+	brand := defaultBrand(app)
+	setIfNotEmpty(&brand.LogoURL, record.GetString("logo_url"))
+	setIfNotEmpty(&brand.PrimaryColor, record.GetString("primary_color"))
+	setIfNotEmpty(&brand.BackgroundColor, record.GetString("background_color"))
+	setIfNotEmpty(&brand.TextColor, record.GetString("text_color"))
+	setIfNotEmpty(&brand.FontFamily, record.GetString("font_family"))
+	setIfNotEmpty(&brand.FontURL, record.GetString("font_url"))
+	setIfNotEmpty(&brand.MaxWidth, record.GetString("max_width"))
+	if footer := record.GetString("footer"); footer != "" {
+		brand.Footer = template.HTML(footer)
+	}
+
+	return &Layout{
+		Name:     record.GetString("name"),
+		Template: layoutTemplate,
+		Brand:    brand,
+	}, nil
+}
+
+func builtInLayout(app *pocketbase.PocketBase) (*Layout, error) {
+	layoutTemplate, err := template.New("layout").Parse(defaultLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Layout{
+		Name:     DefaultLayoutName,
+		Template: layoutTemplate,
+		Brand:    defaultBrand(app),
+	}, nil
+}
+
+/*
+Neutral defaults with the name and url from the pocketbase settings
+*/
+func defaultBrand(app *pocketbase.PocketBase) Brand {
+	return Brand{
+		AppName:         app.Settings().Meta.AppName,
+		AppURL:          app.Settings().Meta.AppUrl,
+		PrimaryColor:    "#2563eb",
+		BackgroundColor: "#ffffff",
+		TextColor:       "#333333",
+		FontFamily:      "Inter",
+		FontURL:         "https://rsms.me/inter/font-files/Inter-Regular.woff2?v=3.19",
+		MaxWidth:        "540px",
+	}
+}
+
+/*
+Puts the rendered content and any named slots from the template into the layout
+*/
+func (layout *Layout) render(content string, emailTemplate *template.Template, data map[string]interface{}, locale string, unsubscribeURL string) (string, error) {
+	slots := make(map[string]template.HTML)
+	for _, slot := range emailTemplate.Templates() {
+		if slot.Name() == emailTemplate.Name() {
+			continue
+		}
+
+		var slotBuffer bytes.Buffer
+		if err := slot.Execute(&slotBuffer, data); err != nil {
+			return "", newTemplateError("execute", "email_rich", err)
+		}
+		slots[slot.Name()] = template.HTML(slotBuffer.String())
+	}
+
+	var layoutBuffer bytes.Buffer
+	err := layout.Template.Execute(&layoutBuffer, LayoutData{
+		Content:         template.HTML(content),
+		Slots:           slots,
+		Brand:           layout.Brand,
+		Locale:          locale,
+		UnsubscribeURL:  unsubscribeURL,
+		UnsubscribeText: i18n.T(locale, "Unsubscribe"),
+	})
+	if err != nil {
+		return "", newTemplateError("execute", "layout", err)
+	}
+
+	return layoutBuffer.String(), nil
+}
+
+//Extra helper functions:
+
+func setIfNotEmpty(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
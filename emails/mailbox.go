@@ -0,0 +1,112 @@
+package emails
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+/*
+Lists the captured emails
+
+Filter to one address with ?to=
+*/
+func listCapturedEmails(c echo.Context) error {
+	to := strings.ToLower(c.QueryParam("to"))
+
+	items := make([]CapturedEmail, 0)
+	for _, email := range CapturedEmails() {
+		if to != "" && !strings.Contains(strings.ToLower(strings.Join(email.To, ",")), to) {
+			continue
+		}
+		items = append(items, email)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["emails"] = items
+
+	return c.JSON(200, res)
+}
+
+/*
+Returns the rendered html of one captured email (?id=)
+
+The html is served sandboxed so scripts in it can't run with the admins session
+*/
+func viewCapturedEmail(c echo.Context) error {
+	email, found := FindCapturedEmail(c.QueryParam("id"))
+	if !found {
+		return apis.NewNotFoundError("Email not found", nil)
+	}
+
+	c.Response().Header().Set("Content-Security-Policy", "sandbox")
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	c.Response().Header().Set("Referrer-Policy", "no-referrer")
+	return c.HTML(http.StatusOK, email.HTML)
+}
+
+func clearCapturedEmails(c echo.Context) error {
+	ClearCapturedEmails()
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Mailbox cleared"
+
+	return c.JSON(200, res)
+}
+
+var mailboxTemplate = template.Must(template.New("mailbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8" />
+    <title>Mailbox</title>
+    <style>
+        body { font-family: sans-serif; margin: 0; color: #333333; }
+        details { border-bottom: 1px solid #dddddd; padding: 12px 20px; }
+        summary { cursor: pointer; }
+        table { border-collapse: collapse; margin: 12px 0; font-size: 13px; }
+        td { padding: 2px 12px 2px 0; vertical-align: top; }
+        iframe { width: 100%; height: 600px; border: 1px solid #dddddd; }
+        pre { white-space: pre-wrap; background: #f6f6f6; padding: 12px; }
+    </style>
+</head>
+<body>
+    <h1 style="padding: 0 20px;">Mailbox ({{ len . }})</h1>
+    {{ range . }}
+    <details>
+        <summary><strong>{{ .Subject }}</strong> to {{ range $i, $to := .To }}{{ if $i }}, {{ end }}{{ $to }}{{ end }} at {{ .Created.Format "2006-01-02 15:04:05" }}</summary>
+        <table>
+            <tr><td>From</td><td>{{ .From }}</td></tr>
+            <tr><td>To</td><td>{{ range .To }}{{ . }} {{ end }}</td></tr>
+            {{ if .Cc }}<tr><td>Cc</td><td>{{ range .Cc }}{{ . }} {{ end }}</td></tr>{{ end }}
+            {{ if .Bcc }}<tr><td>Bcc</td><td>{{ range .Bcc }}{{ . }} {{ end }}</td></tr>{{ end }}
+            {{ range $key, $value := .Headers }}<tr><td>{{ $key }}</td><td>{{ $value }}</td></tr>{{ end }}
+        </table>
+        <iframe sandbox srcdoc="{{ .HTML }}"></iframe>
+        <pre>{{ .Text }}</pre>
+    </details>
+    {{ end }}
+</body>
+</html>`))
+
+/*
+A simple page with every captured email, their headers and the rendered html
+
+Each email is shown in a sandboxed iframe and the page itself can't run scripts
+*/
+func mailboxPage(c echo.Context) error {
+	var page strings.Builder
+	if err := mailboxTemplate.Execute(&page, CapturedEmails()); err != nil {
+		return apis.NewApiError(500, "Unable to render the mailbox", nil)
+	}
+
+	// Emails can load their images, nothing else
+	c.Response().Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src * data:; frame-src 'self'")
+	c.Response().Header().Set("Referrer-Policy", "no-referrer")
+
+	return c.HTML(http.StatusOK, page.String())
+}
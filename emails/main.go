@@ -8,7 +8,31 @@ import (
 	"github.com/pocketbase/pocketbase/tools/mailer"
 )
 
-func SendCustomEmail(subject string, recp []mail.Address, data string, app *pocketbase.PocketBase) error {
+/*
+Sends an email straight away with a plain text part
+
+If text is empty it is made from the html
+*/
+func SendCustomEmail(subject string, recp []mail.Address, data string, text string, app *pocketbase.PocketBase) error {
+	return SendEmail(app, subject, recp, RenderedEmail{HTML: data, Text: text})
+}
+
+/*
+Sends a rendered email straight away
+
+Emails with an unsubscribe link get the RFC 8058 one click headers.
+Suppressed addresses are left out, if that leaves nobody a SuppressedError is returned
+*/
+func SendEmail(app *pocketbase.PocketBase, subject string, recp []mail.Address, email RenderedEmail) error {
+	recp, suppressed := deliverableRecipients(app, recp)
+	if len(recp) == 0 && len(suppressed) > 0 {
+		return &SuppressedError{Addresses: suppressed}
+	}
+
+	if email.Text == "" {
+		email.Text = HTMLToText(email.HTML)
+	}
+
 	message := &mailer.Message{
 		From: mail.Address{
 			Address: app.Settings().Meta.SenderAddress,
@@ -16,11 +40,44 @@ func SendCustomEmail(subject string, recp []mail.Address, data string, app *pock
 		},
 		To:      recp,
 		Subject: subject,
-		HTML:    data,
-		// bcc, cc, attachments and custom headers are also supported...
+		HTML:    email.HTML,
+		Text:    email.Text,
+		Headers: map[string]string{},
 	}
 
-	err := app.NewMailClient().Send(message)
+	applyMessageOptions(app, message, email.MessageOptions)
+	message.Cc, _ = deliverableRecipients(app, message.Cc)
+	message.Bcc, _ = deliverableRecipients(app, message.Bcc)
+
+	if email.UnsubscribeURL != "" {
+		message.Headers["List-Unsubscribe"] = "<" + email.UnsubscribeURL + ">"
+		message.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	}
+
+	return deliver(app, message)
+}
+
+/*
+Sends the message, or keeps it in the local mailbox when capture mode is on
+*/
+func deliver(app *pocketbase.PocketBase, message *mailer.Message) error {
+	signer, err := LoadDKIMSigner(message.From.Address)
+	if err != nil {
+		app.Logger().Error("Unable to load the DKIM key, sending unsigned", "details", err)
+	}
+
+	if CaptureEnabled() {
+		captureEmail(message, signer)
+		app.Logger().Info("Captured email", "subject", message.Subject, "to", message.To)
+		return nil
+	}
+
+	// The pocketbase mailer can't sign, so signed mail goes through our own smtp client
+	if signer != nil && app.Settings().Smtp.Enabled {
+		err = sendSigned(app, message, signer)
+	} else {
+		err = app.NewMailClient().Send(message)
+	}
 
 	if err != nil {
 		log.Println(err)
@@ -0,0 +1,294 @@
+package emails
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+A small Markdown to email html converter for the email_markdown field
+
+Go template placeholders ({{ .token }}, {{ if .x }} etc) are left alone so the result is still a template.
+Everything gets inline styles as a lot of email clients drop <style> tags.
+
+Supported:
+
+- # headings, paragraphs, **bold**, *italic*, `code`, [links](url), > quotes, --- rules
+
+- "- " lists and "1. " lists. Template lines right next to the items stay in the list so {{ range }} makes one list
+
+- Buttons with double brackets: [[Sign in]]({{ .buttonLink }})
+
+Lines starting with < are kept as html
+*/
+func MarkdownToHTML(source string, brand Brand) string {
+	converter := &markdownConverter{brand: brand}
+	return converter.convert(source)
+}
+
+var (
+	templateActionRegex = regexp.MustCompile(`{{.*?}}`)
+	templateOpenRegex   = regexp.MustCompile(`{{-?\s*(if|range|with|block|define)\b`)
+	templateEndRegex    = regexp.MustCompile(`{{-?\s*end\b`)
+	headingRegex        = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	unorderedItemRegex  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	orderedItemRegex    = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	ruleRegex           = regexp.MustCompile(`^\s*([-*_])(\s*([-*_])){2,}\s*$`)
+	buttonLineRegex     = regexp.MustCompile(`^\s*\[\[([^\]]+)\]\]\(((?:{{.*?}}|[^)\s])+)\)\s*$`)
+
+	inlineButtonRegex = regexp.MustCompile(`\[\[([^\]]+)\]\]\(([^)\s]+)\)`)
+	linkRegex         = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	boldRegex         = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	italicRegex       = regexp.MustCompile(`\*([^*]+?)\*|\b_([^_]+?)_\b`)
+	codeRegex         = regexp.MustCompile("`([^`]+)`")
+	placeholderRegex  = regexp.MustCompile("\x00(\\d+)\x00")
+	stashRegex        = regexp.MustCompile("\x01(\\d+)\x01")
+)
+
+var headingSizes = map[int]string{1: "24px", 2: "20px", 3: "18px", 4: "16px", 5: "14px", 6: "13px"}
+
+type markdownConverter struct {
+	brand     Brand
+	output    strings.Builder
+	paragraph []string
+	list      string
+	listDepth int
+	depth     int
+	quote     []string
+}
+
+func (m *markdownConverter) convert(source string) string {
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			m.closeBlocks()
+		case isTemplateLine(trimmed) && (m.depth > m.listDepth && m.list != "" || nextListItem(lines[i+1:]) != ""):
+			// Template lines around list items stay in the list so {{ range }} makes one list
+			m.closeParagraph()
+			m.closeQuote()
+			if tag := nextListItem(lines[i+1:]); m.list == "" || m.depth == m.listDepth && tag != m.list {
+				m.closeList()
+				m.openList(tag)
+			}
+			m.depth += templateDepth(trimmed)
+			m.output.WriteString(trimmed + "\n")
+		case isTemplateLine(trimmed) || strings.HasPrefix(trimmed, "<"):
+			m.closeBlocks()
+			m.depth += templateDepth(trimmed)
+			m.output.WriteString(trimmed + "\n")
+		case strings.HasPrefix(trimmed, ">"):
+			m.closeParagraph()
+			m.closeList()
+			m.quote = append(m.quote, strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))
+		case headingRegex.MatchString(trimmed):
+			m.closeBlocks()
+			match := headingRegex.FindStringSubmatch(trimmed)
+			level := len(match[1])
+			m.output.WriteString(fmt.Sprintf(
+				`<h%d style="margin: 24px 0 12px 0; font-size: %s; line-height: 1.3; color: %s;">%s</h%d>`+"\n",
+				level, headingSizes[level], m.brand.TextColor, m.inline(match[2]), level,
+			))
+		case ruleRegex.MatchString(trimmed):
+			m.closeBlocks()
+			m.output.WriteString(`<hr style="border: none; border-top: 1px solid #e5e5e5; margin: 24px 0;" />` + "\n")
+		case buttonLineRegex.MatchString(trimmed):
+			m.closeBlocks()
+			match := buttonLineRegex.FindStringSubmatch(trimmed)
+			m.output.WriteString(m.button(match[1], match[2]) + "\n")
+		case unorderedItemRegex.MatchString(line):
+			m.listItem("ul", unorderedItemRegex.FindStringSubmatch(line)[1])
+		case orderedItemRegex.MatchString(line):
+			m.listItem("ol", orderedItemRegex.FindStringSubmatch(line)[1])
+		default:
+			m.closeList()
+			m.closeQuote()
+			m.paragraph = append(m.paragraph, line)
+		}
+	}
+	m.closeBlocks()
+
+	return strings.TrimSpace(m.output.String())
+}
+
+func (m *markdownConverter) listItem(tag string, content string) {
+	m.closeParagraph()
+	m.closeQuote()
+	if m.list != tag {
+		m.closeList()
+		m.openList(tag)
+	}
+	m.output.WriteString(`<li style="margin: 0 0 4px 0; line-height: 1.5;">` + m.inline(content) + "</li>\n")
+}
+
+func (m *markdownConverter) openList(tag string) {
+	m.list = tag
+	m.listDepth = m.depth
+	m.output.WriteString(fmt.Sprintf(`<%s style="margin: 0 0 16px 0; padding-left: 24px;">`+"\n", tag))
+}
+
+func (m *markdownConverter) closeBlocks() {
+	m.closeParagraph()
+	m.closeList()
+	m.closeQuote()
+}
+
+func (m *markdownConverter) closeParagraph() {
+	if len(m.paragraph) == 0 {
+		return
+	}
+
+	var lines []string
+	for i, line := range m.paragraph {
+		// Two trailing spaces or a backslash is a line break
+		hardBreak := strings.HasSuffix(line, "  ") || strings.HasSuffix(line, `\`)
+		line = m.inline(strings.TrimSuffix(strings.TrimSpace(line), `\`))
+		if hardBreak && i < len(m.paragraph)-1 {
+			line += "<br />"
+		}
+		lines = append(lines, line)
+	}
+
+	m.output.WriteString(`<p style="margin: 0 0 16px 0; line-height: 1.5;">` + strings.Join(lines, "\n") + "</p>\n")
+	m.paragraph = nil
+}
+
+func (m *markdownConverter) closeList() {
+	if m.list == "" {
+		return
+	}
+	m.output.WriteString("</" + m.list + ">\n")
+	m.list = ""
+}
+
+func (m *markdownConverter) closeQuote() {
+	if len(m.quote) == 0 {
+		return
+	}
+
+	var lines []string
+	for _, line := range m.quote {
+		lines = append(lines, m.inline(line))
+	}
+
+	m.output.WriteString(`<blockquote style="margin: 0 0 16px 0; padding: 0 0 0 12px; border-left: 3px solid #e5e5e5; color: #666666;">` +
+		strings.Join(lines, "<br />\n") + "</blockquote>\n")
+	m.quote = nil
+}
+
+/*
+A table based button as that is what renders the same in every client
+*/
+func (m *markdownConverter) button(label string, url string) string {
+	return fmt.Sprintf(
+		`<table role="presentation" cellspacing="0" cellpadding="0" style="margin: 16px 0;"><tr><td style="border-radius: 6px; background-color: %s;">`+
+			`<a href="%s" style="display: inline-block; padding: 12px 24px; color: #ffffff; font-weight: bold; text-decoration: none; border-radius: 6px;">%s</a>`+
+			`</td></tr></table>`,
+		m.brand.PrimaryColor, escapeKeepingActions(url), m.inline(label),
+	)
+}
+
+/*
+Inline markup
+
+Template actions, code and links are swapped out for markers as they are made so later rules don't touch them
+*/
+func (m *markdownConverter) inline(text string) string {
+	var actions []string
+	text = templateActionRegex.ReplaceAllStringFunc(text, func(action string) string {
+		actions = append(actions, action)
+		return "\x00" + strconv.Itoa(len(actions)-1) + "\x00"
+	})
+
+	text = html.EscapeString(text)
+
+	var stashed []string
+	stash := func(snippet string) string {
+		stashed = append(stashed, snippet)
+		return "\x01" + strconv.Itoa(len(stashed)-1) + "\x01"
+	}
+
+	text = codeRegex.ReplaceAllStringFunc(text, func(match string) string {
+		return stash(`<code style="font-family: monospace; background-color: #f4f4f4; padding: 2px 4px; border-radius: 3px;">` + codeRegex.FindStringSubmatch(match)[1] + `</code>`)
+	})
+	text = inlineButtonRegex.ReplaceAllStringFunc(text, func(match string) string {
+		parts := inlineButtonRegex.FindStringSubmatch(match)
+		return stash(fmt.Sprintf(
+			`<a href="%s" style="display: inline-block; padding: 8px 16px; background-color: %s; color: #ffffff; font-weight: bold; text-decoration: none; border-radius: 6px;">%s</a>`,
+			parts[2], m.brand.PrimaryColor, emphasis(parts[1]),
+		))
+	})
+	text = linkRegex.ReplaceAllStringFunc(text, func(match string) string {
+		parts := linkRegex.FindStringSubmatch(match)
+		return stash(fmt.Sprintf(`<a href="%s" style="color: %s;">%s</a>`, parts[2], m.brand.PrimaryColor, emphasis(parts[1])))
+	})
+
+	text = emphasis(text)
+
+	text = stashRegex.ReplaceAllStringFunc(text, func(match string) string {
+		index, _ := strconv.Atoi(stashRegex.FindStringSubmatch(match)[1])
+		return stashed[index]
+	})
+
+	return placeholderRegex.ReplaceAllStringFunc(text, func(match string) string {
+		index, _ := strconv.Atoi(placeholderRegex.FindStringSubmatch(match)[1])
+		return actions[index]
+	})
+}
+
+//Extra helper functions:
+
+func escapeKeepingActions(text string) string {
+	var escaped strings.Builder
+	last := 0
+	for _, match := range templateActionRegex.FindAllStringIndex(text, -1) {
+		escaped.WriteString(html.EscapeString(text[last:match[0]]))
+		escaped.WriteString(text[match[0]:match[1]])
+		last = match[1]
+	}
+	escaped.WriteString(html.EscapeString(text[last:]))
+	return escaped.String()
+}
+
+func emphasis(text string) string {
+	text = boldRegex.ReplaceAllString(text, "<strong>$1$2</strong>")
+	return italicRegex.ReplaceAllString(text, "<em>$1$2</em>")
+}
+
+/*
+Returns ul or ol if the next line that isn't a template line is a list item
+*/
+func nextListItem(lines []string) string {
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed != "" && isTemplateLine(trimmed):
+		case unorderedItemRegex.MatchString(line):
+			return "ul"
+		case orderedItemRegex.MatchString(line):
+			return "ol"
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+/*
+How much a template line changes the nesting, +1 for {{ if }}, {{ range }} etc and -1 for {{ end }}
+*/
+func templateDepth(line string) int {
+	return len(templateOpenRegex.FindAllString(line, -1)) - len(templateEndRegex.FindAllString(line, -1))
+}
+
+/*
+A line that is only template actions, like {{ if .x }} or {{ end }}
+*/
+func isTemplateLine(line string) bool {
+	return strings.HasPrefix(line, "{{") && strings.TrimSpace(templateActionRegex.ReplaceAllString(line, "")) == ""
+}
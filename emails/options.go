@@ -0,0 +1,178 @@
+package emails
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/list"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+type Attachment struct {
+	Name    string `json:"name"`
+	Content []byte `json:"content"`
+}
+
+/*
+Everything about a message other than its content
+
+Set from the custom_emails record and can be changed by callers before queueing
+*/
+type MessageOptions struct {
+	From        mail.Address      `json:"from"`
+	ReplyTo     mail.Address      `json:"reply_to"`
+	Cc          []mail.Address    `json:"cc"`
+	Bcc         []mail.Address    `json:"bcc"`
+	Headers     map[string]string `json:"headers"`
+	Attachments []Attachment      `json:"attachments"`
+}
+
+/*
+Headers that are set from the message itself and can't be replaced
+*/
+var protectedHeaders = []string{
+	"from", "to", "cc", "bcc", "subject", "reply-to", "date", "mime-version",
+	"content-type", "content-transfer-encoding", "dkim-signature",
+}
+
+/*
+Reads the reply_to, from, cc, bcc, headers and attachments fields of a custom_emails record
+*/
+func loadMessageOptions(app *pocketbase.PocketBase, record *models.Record) (MessageOptions, error) {
+	options := MessageOptions{Headers: map[string]string{}}
+
+	if from := strings.TrimSpace(record.GetString("from")); from != "" {
+		address, err := mail.ParseAddress(from)
+		if err != nil {
+			return options, NewEmailError("Invalid from address %s", from)
+		}
+		options.From = *address
+	}
+
+	if replyTo := strings.TrimSpace(record.GetString("reply_to")); replyTo != "" {
+		address, err := mail.ParseAddress(replyTo)
+		if err != nil {
+			return options, NewEmailError("Invalid reply_to address %s", replyTo)
+		}
+		options.ReplyTo = *address
+	}
+
+	var err error
+	if options.Cc, err = parseAddressList(record.GetString("cc")); err != nil {
+		return options, NewEmailError("Invalid cc addresses")
+	}
+	if options.Bcc, err = parseAddressList(record.GetString("bcc")); err != nil {
+		return options, NewEmailError("Invalid bcc addresses")
+	}
+
+	// The field is optional so a missing or empty value is fine
+	_ = record.UnmarshalJSONField("headers", &options.Headers)
+	if options.Headers == nil {
+		options.Headers = map[string]string{}
+	}
+
+	files := record.GetStringSlice("attachments")
+	if len(files) == 0 {
+		return options, nil
+	}
+
+	fs, err := app.NewFilesystem()
+	if err != nil {
+		return options, err
+	}
+	defer fs.Close()
+
+	for _, name := range files {
+		file, err := fs.GetFile(record.BaseFilesPath() + "/" + name)
+		if err != nil {
+			return options, NewEmailError("Unable to load attachment %s", name)
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return options, NewEmailError("Unable to load attachment %s", name)
+		}
+
+		options.Attachments = append(options.Attachments, Attachment{Name: name, Content: content})
+	}
+
+	return options, nil
+}
+
+/*
+Copies the options onto the message
+
+The reply to defaults to the email_reply_to env
+*/
+func applyMessageOptions(app *pocketbase.PocketBase, message *mailer.Message, options MessageOptions) {
+	if options.From.Address != "" {
+		message.From = options.From
+	}
+
+	message.Cc = append(message.Cc, options.Cc...)
+	message.Bcc = append(message.Bcc, options.Bcc...)
+
+	for key, value := range options.Headers {
+		if list.ExistInSlice(strings.ToLower(key), protectedHeaders) || strings.ContainsAny(key+value, "\r\n") {
+			app.Logger().Warn("Skipping email header", "header", key)
+			continue
+		}
+		message.Headers[key] = value
+	}
+
+	replyTo := options.ReplyTo
+	if replyTo.Address == "" {
+		if envReplyTo, found := os.LookupEnv("email_reply_to"); found && envReplyTo != "" {
+			replyTo = mail.Address{Address: envReplyTo}
+		}
+	}
+	if replyTo.Address != "" {
+		message.Headers["Reply-To"] = replyTo.String()
+	}
+
+	if len(options.Attachments) > 0 {
+		message.Attachments = make(map[string]io.Reader, len(options.Attachments))
+		for _, attachment := range options.Attachments {
+			message.Attachments[attachment.Name] = bytes.NewReader(attachment.Content)
+		}
+	}
+}
+
+//Extra helper functions:
+
+/*
+Cached templates share their options so every send gets its own copy to change
+*/
+func (options MessageOptions) copy() MessageOptions {
+	copied := options
+	copied.Cc = append([]mail.Address(nil), options.Cc...)
+	copied.Bcc = append([]mail.Address(nil), options.Bcc...)
+	copied.Attachments = append([]Attachment(nil), options.Attachments...)
+	copied.Headers = make(map[string]string, len(options.Headers))
+	for key, value := range options.Headers {
+		copied.Headers[key] = value
+	}
+	return copied
+}
+
+func parseAddressList(addresses string) ([]mail.Address, error) {
+	if strings.TrimSpace(addresses) == "" {
+		return nil, nil
+	}
+
+	parsed, err := mail.ParseAddressList(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]mail.Address, 0, len(parsed))
+	for _, address := range parsed {
+		result = append(result, *address)
+	}
+	return result, nil
+}
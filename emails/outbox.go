@@ -0,0 +1,373 @@
+package emails
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+/*
+Lower numbers are sent first
+*/
+const (
+	PriorityLogin     = 0
+	PriorityDefault   = 5
+	PriorityWelcome   = 10
+	PriorityScheduled = 10
+	PriorityDigest    = 20
+)
+
+const (
+	StatusPending = "pending"
+	StatusSending = "sending"
+	StatusSent    = "sent"
+	StatusDead    = "dead"
+	StatusSkipped = "skipped"
+)
+
+var (
+	outboxMaxAttempts  = 8
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = 1 * time.Hour
+	outboxPollInterval = 10 * time.Second
+	outboxBatchSize    = 20
+
+	// Finished emails are deleted after this long
+	outboxRetention = 30 * 24 * time.Hour
+
+	outboxWake = make(chan struct{}, 1)
+)
+
+/*
+Saves the email to the email_outbox collection for the worker to send
+
+If the collection is missing the email is sent straight away like before so nothing gets dropped.
+Returns a SuppressedError if every recipient is on the suppression list
+
+The rendered email can contain sign in links and codes, so it is removed once the email is sent or skipped.
+Dead emails keep it so they can be retried, until the cleanup cron deletes them
+*/
+func QueueEmail(app *pocketbase.PocketBase, subject string, recp []mail.Address, email RenderedEmail, priority int) error {
+	recp, suppressed := deliverableRecipients(app, subscribedRecipients(app, recp, email.Category))
+	if len(recp) == 0 {
+		if len(suppressed) > 0 {
+			return &SuppressedError{Addresses: suppressed}
+		}
+		return nil
+	}
+
+	outboxCollection, err := app.Dao().FindCollectionByNameOrId("email_outbox")
+	if err != nil {
+		app.Logger().Error("email_outbox Collection was not found. Please create it to use this feature. Sending directly")
+		go SendEmail(app, subject, recp, email)
+		return nil
+	}
+
+	record := models.NewRecord(outboxCollection)
+	record.Set("subject", subject)
+	record.Set("recipients", recp)
+	record.Set("html", email.HTML)
+	record.Set("text", email.Text)
+	record.Set("template", email.Template)
+	record.Set("template_version", email.Version)
+	record.Set("category", email.Category)
+	record.Set("unsubscribe", email.UnsubscribeURL)
+	record.Set("options", email.MessageOptions)
+	record.Set("message_id", newMessageId(app))
+	record.Set("priority", priority)
+	record.Set("status", StatusPending)
+	record.Set("attempts", 0)
+	record.Set("next_attempt", types.NowDateTime())
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return err
+	}
+
+	wakeOutbox()
+	return nil
+}
+
+/*
+Starts the outbox worker in the background
+
+Anything left as sending from a previous run is put back in the queue first
+*/
+func StartOutboxWorker(app *pocketbase.PocketBase) {
+	outboxCollection, err := app.Dao().FindCollectionByNameOrId("email_outbox")
+	if err != nil {
+		app.Logger().Error("email_outbox Collection was not found. Please create it to use this feature.")
+		return
+	}
+	if outboxCollection.Schema.GetFieldByName("message_id") == nil {
+		app.Logger().Warn("email_outbox has no message_id field. Add a message_id text field so bounce reports can be matched to sent emails, they are ignored until then")
+	}
+
+	_, err = app.Dao().DB().
+		NewQuery("UPDATE email_outbox SET status = {:pending} WHERE status = {:sending}").
+		Bind(dbx.Params{"pending": StatusPending, "sending": StatusSending}).
+		Execute()
+	if err != nil {
+		app.Logger().Error("Failed to reset interrupted outbox emails", "details", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+
+		for {
+			processOutbox(app)
+
+			select {
+			case <-ticker.C:
+			case <-outboxWake:
+			}
+		}
+	}()
+}
+
+/*
+Puts a dead lettered email back in the queue with its attempts reset
+*/
+func RetryEmail(app *pocketbase.PocketBase, id string) error {
+	record, err := app.Dao().FindRecordById("email_outbox", id)
+	if err != nil {
+		return NewEmailError("Email not found")
+	}
+	if record.GetString("status") != StatusDead {
+		return NewEmailError("Only dead emails can be retried")
+	}
+	if record.GetString("html") == "" && record.GetString("text") == "" {
+		return NewEmailError("The content of this email has been removed so it can't be retried")
+	}
+
+	record.Set("status", StatusPending)
+	record.Set("attempts", 0)
+	record.Set("next_attempt", types.NowDateTime())
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return err
+	}
+
+	wakeOutbox()
+	return nil
+}
+
+/*
+Counts the outbox emails in each status
+*/
+func OutboxStats(app *pocketbase.PocketBase) (map[string]int, error) {
+	rows := []struct {
+		Status string `db:"status"`
+		Total  int    `db:"total"`
+	}{}
+
+	err := app.Dao().DB().
+		NewQuery("SELECT status, COUNT(*) AS total FROM email_outbox GROUP BY status").
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]int{StatusPending: 0, StatusSending: 0, StatusSent: 0, StatusDead: 0, StatusSkipped: 0}
+	for _, row := range rows {
+		stats[row.Status] = row.Total
+	}
+
+	return stats, nil
+}
+
+/*
+Deletes sent, skipped and dead emails once they are older than outboxRetention, checked once a day
+
+Also clears the content of any sent or skipped emails that still have it, eg. ones from before it was cleared when they finished.
+Dead emails keep theirs so they can still be retried
+*/
+func EnableOutboxCleanupCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	if _, err := app.Dao().FindCollectionByNameOrId("email_outbox"); err != nil {
+		return nil
+	}
+
+	scheduler.MustAdd("OutboxCleanup", "15 4 * * *", func() {
+		params := dbx.Params{"sent": StatusSent, "skipped": StatusSkipped, "dead": StatusDead}
+
+		_, err := app.Dao().DB().
+			NewQuery("UPDATE email_outbox SET html = '', text = '' WHERE status IN ({:sent}, {:skipped}) AND (html != '' OR text != '')").
+			Bind(dbx.Params{"sent": StatusSent, "skipped": StatusSkipped}).
+			Execute()
+		if err != nil {
+			app.Logger().Error("Failed to clear finished outbox emails", "details", err)
+		}
+
+		cutoff, _ := types.ParseDateTime(time.Now().UTC().Add(-outboxRetention))
+		params["cutoff"] = cutoff.String()
+		_, err = app.Dao().DB().
+			NewQuery("DELETE FROM email_outbox WHERE status IN ({:sent}, {:skipped}, {:dead}) AND updated < {:cutoff}").
+			Bind(params).
+			Execute()
+		if err != nil {
+			app.Logger().Error("Failed to remove old outbox emails", "details", err)
+		}
+	})
+	return nil
+}
+
+//Extra helper functions:
+
+/*
+Drops anyone who has opted out of the category
+*/
+func subscribedRecipients(app *pocketbase.PocketBase, recp []mail.Address, category string) []mail.Address {
+	subscribed := make([]mail.Address, 0, len(recp))
+	for _, address := range recp {
+		if IsUnsubscribed(app, address.Address, category) {
+			continue
+		}
+		subscribed = append(subscribed, address)
+	}
+	return subscribed
+}
+
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func processOutbox(app *pocketbase.PocketBase) {
+	for {
+		records, err := app.Dao().FindRecordsByFilter(
+			"email_outbox", "status = {:status} && next_attempt <= {:now}",
+			"priority,created", outboxBatchSize, 0,
+			dbx.Params{"status": StatusPending, "now": types.NowDateTime().String()},
+		)
+		if err != nil {
+			app.Logger().Error("Failed to load the email outbox", "details", err)
+			return
+		}
+		if len(records) == 0 {
+			return
+		}
+
+		for _, record := range records {
+			sendOutboxEmail(app, record)
+		}
+	}
+}
+
+func sendOutboxEmail(app *pocketbase.PocketBase, record *models.Record) {
+	record.Set("status", StatusSending)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		app.Logger().Error("Failed to claim outbox email", "id", record.Id, "details", err)
+		return
+	}
+
+	var recp []mail.Address
+	err := record.UnmarshalJSONField("recipients", &recp)
+	if err == nil {
+		// They might have unsubscribed while it was waiting
+		recp = subscribedRecipients(app, recp, record.GetString("category"))
+		if len(recp) == 0 {
+			record.Set("status", StatusSkipped)
+			clearOutboxContent(record)
+			if err := app.Dao().SaveRecord(record); err != nil {
+				app.Logger().Error("Failed to update outbox email", "id", record.Id, "details", err)
+			}
+			return
+		}
+
+		var options MessageOptions
+		_ = record.UnmarshalJSONField("options", &options)
+		setMessageId(&options, record.GetString("message_id"))
+
+		err = SendEmail(app, record.GetString("subject"), recp, RenderedEmail{
+			MessageOptions: options,
+			HTML:           record.GetString("html"),
+			Text:           record.GetString("text"),
+			Category:       record.GetString("category"),
+			UnsubscribeURL: record.GetString("unsubscribe"),
+		})
+	}
+
+	attempts := record.GetInt("attempts") + 1
+	record.Set("attempts", attempts)
+
+	var suppressedErr *SuppressedError
+	if err == nil {
+		record.Set("status", StatusSent)
+		record.Set("sent_at", types.NowDateTime())
+		record.Set("last_error", "")
+		clearOutboxContent(record)
+	} else if errors.As(err, &suppressedErr) {
+		// They bounced while it was waiting, retrying won't help
+		record.Set("status", StatusSkipped)
+		record.Set("last_error", err.Error())
+		clearOutboxContent(record)
+	} else if attempts >= outboxMaxAttempts {
+		record.Set("status", StatusDead)
+		record.Set("last_error", err.Error())
+		app.Logger().Error("Outbox email dead lettered", "id", record.Id, "attempts", attempts, "details", err)
+	} else {
+		next, _ := types.ParseDateTime(time.Now().UTC().Add(backoff(attempts)))
+		record.Set("status", StatusPending)
+		record.Set("next_attempt", next)
+		record.Set("last_error", err.Error())
+	}
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		app.Logger().Error("Failed to update outbox email", "id", record.Id, "details", err)
+	}
+}
+
+/*
+Bounce reports are matched to outbox emails by this, so it has to be hard to guess
+*/
+func newMessageId(app *pocketbase.PocketBase) string {
+	domain := "localhost"
+	if _, senderDomain, found := strings.Cut(app.Settings().Meta.SenderAddress, "@"); found {
+		domain = senderDomain
+	}
+	return fmt.Sprintf("<%s@%s>", security.RandomString(32), domain)
+}
+
+/*
+Uses the outbox Message-ID in place of any the template set, retries keep the same one
+*/
+func setMessageId(options *MessageOptions, messageId string) {
+	if messageId == "" {
+		return
+	}
+	headers := map[string]string{}
+	for key, value := range options.Headers {
+		if !strings.EqualFold(key, "Message-ID") {
+			headers[key] = value
+		}
+	}
+	headers["Message-ID"] = messageId
+	options.Headers = headers
+}
+
+func clearOutboxContent(record *models.Record) {
+	record.Set("html", "")
+	record.Set("text", "")
+}
+
+/*
+30s, 1m, 2m, 4m... capped at an hour
+*/
+func backoff(attempts int) time.Duration {
+	delay := time.Duration(float64(outboxBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if delay > outboxMaxBackoff || delay <= 0 {
+		return outboxMaxBackoff
+	}
+	return delay
+}
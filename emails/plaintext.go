@@ -0,0 +1,242 @@
+package emails
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	whitespaceRegex = regexp.MustCompile(`\s+`)
+	blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+)
+
+var skippedTags = map[string]bool{
+	"head": true, "style": true, "script": true, "title": true, "img": true,
+	"svg": true, "iframe": true, "object": true, "form": true, "input": true,
+	"button": true, "select": true, "textarea": true, "template": true,
+}
+
+// Blocks and how many line breaks go around them
+var blockTags = map[string]int{
+	"p": 2, "blockquote": 2, "table": 2, "pre": 2,
+	"div": 1, "tr": 1, "td": 1, "th": 1, "section": 1, "article": 1,
+	"header": 1, "footer": 1, "center": 1,
+}
+
+/*
+Converts an email's html into a plain text version
+
+- Links are kept as numbered footnotes at the bottom
+- Headings are underlined
+- List items start with "- " or their number
+*/
+func HTMLToText(htmlDocument string) string {
+	doc, err := html.Parse(strings.NewReader(htmlDocument))
+	if err != nil {
+		return ""
+	}
+
+	w := &textWriter{footnoteIndex: make(map[string]int)}
+	w.walk(doc)
+
+	text := strings.TrimSpace(blankLinesRegex.ReplaceAllString(w.builder.String(), "\n\n"))
+
+	if len(w.footnotes) > 0 {
+		text += "\n\n"
+		for i, link := range w.footnotes {
+			text += fmt.Sprintf("[%d] %s\n", i+1, link)
+		}
+	}
+
+	return strings.TrimSpace(text)
+}
+
+type textWriter struct {
+	builder       strings.Builder
+	pending       int
+	lists         []int
+	footnotes     []string
+	footnoteIndex map[string]int
+}
+
+/*
+Asks for at least n line breaks before the next bit of text
+*/
+func (w *textWriter) block(n int) {
+	if n > w.pending {
+		w.pending = n
+	}
+}
+
+func (w *textWriter) atLineStart() bool {
+	current := w.builder.String()
+	return len(current) == 0 || strings.HasSuffix(current, "\n") || strings.HasSuffix(current, " ")
+}
+
+func (w *textWriter) write(txt string) {
+	if w.pending > 0 || w.atLineStart() {
+		txt = strings.TrimLeft(txt, " ")
+	}
+	if txt == "" {
+		return
+	}
+
+	w.flush()
+	w.builder.WriteString(txt)
+}
+
+/*
+Writes out any line breaks that are waiting
+*/
+func (w *textWriter) flush() {
+	if w.pending > 0 && w.builder.Len() > 0 {
+		w.builder.WriteString(strings.Repeat("\n", w.pending))
+	}
+	w.pending = 0
+}
+
+func (w *textWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.write(whitespaceRegex.ReplaceAllString(n.Data, " "))
+		return
+	case html.ElementNode:
+		if skippedTags[n.Data] {
+			return
+		}
+
+		switch n.Data {
+		case "br":
+			w.builder.WriteString("\n")
+			return
+		case "hr":
+			w.block(2)
+			w.write(strings.Repeat("-", 40))
+			w.block(2)
+			return
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			w.heading(n)
+			return
+		case "a":
+			w.link(n)
+			return
+		case "ul", "ol":
+			// Nested lists sit straight under their item
+			if len(w.lists) > 0 {
+				w.block(1)
+			} else {
+				w.block(2)
+			}
+			if n.Data == "ul" {
+				w.lists = append(w.lists, -1)
+			} else {
+				w.lists = append(w.lists, 0)
+			}
+		case "li":
+			w.listItem()
+		}
+	}
+
+	if breaks, ok := blockTags[n.Data]; ok && n.Type == html.ElementNode {
+		w.block(breaks)
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+
+	if n.Type == html.ElementNode {
+		if n.Data == "ul" || n.Data == "ol" {
+			w.lists = w.lists[:len(w.lists)-1]
+			if len(w.lists) == 0 {
+				w.block(2)
+			} else {
+				w.block(1)
+			}
+		}
+		if breaks, ok := blockTags[n.Data]; ok {
+			w.block(breaks)
+		}
+	}
+}
+
+func (w *textWriter) heading(n *html.Node) {
+	sub := &textWriter{footnoteIndex: w.footnoteIndex, footnotes: w.footnotes}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sub.walk(c)
+	}
+	w.footnotes = sub.footnotes
+
+	title := strings.TrimSpace(sub.builder.String())
+	if title == "" {
+		return
+	}
+
+	underline := "-"
+	if n.Data == "h1" {
+		underline = "="
+	}
+
+	w.block(2)
+	w.write(title)
+	w.builder.WriteString("\n" + strings.Repeat(underline, len([]rune(title))))
+	w.block(2)
+}
+
+func (w *textWriter) listItem() {
+	w.block(1)
+	w.flush()
+	if len(w.lists) == 0 {
+		w.builder.WriteString("- ")
+		return
+	}
+
+	depth := len(w.lists) - 1
+	indent := strings.Repeat("  ", depth)
+	if w.lists[depth] < 0 {
+		w.builder.WriteString(indent + "- ")
+		return
+	}
+
+	w.lists[depth]++
+	w.builder.WriteString(fmt.Sprintf("%s%d. ", indent, w.lists[depth]))
+}
+
+/*
+Writes the link text with a footnote number, or just the url if there is no text
+*/
+func (w *textWriter) link(n *html.Node) {
+	var href string
+	for _, a := range n.Attr {
+		if a.Key == "href" {
+			href = strings.TrimSpace(a.Val)
+		}
+	}
+
+	before := w.builder.Len()
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+	label := strings.TrimSpace(w.builder.String()[before:])
+
+	if href == "" || strings.HasPrefix(href, "#") || label == href || label == strings.TrimPrefix(href, "mailto:") {
+		return
+	}
+
+	if label == "" {
+		w.write(" " + href)
+		return
+	}
+
+	index, ok := w.footnoteIndex[href]
+	if !ok {
+		w.footnotes = append(w.footnotes, href)
+		index = len(w.footnotes)
+		w.footnoteIndex[href] = index
+	}
+
+	w.builder.WriteString(fmt.Sprintf(" [%d]", index))
+}
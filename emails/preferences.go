@@ -0,0 +1,200 @@
+package emails
+
+import (
+	"encoding/base64"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/list"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+/*
+Every email belongs to a category. Security emails can't be unsubscribed from
+*/
+const (
+	CategorySecurity = "security"
+	CategoryProduct  = "product"
+	CategoryDigests  = "digests"
+)
+
+var Categories = []string{CategorySecurity, CategoryProduct, CategoryDigests}
+
+/*
+The built in emails that are always security, whatever their category field says
+*/
+var securityTemplates = []string{"emailAuth", "newDevice", "emailChange", "emailChangeNotice", "oauthLink"}
+
+/*
+Templates without a category field use these, anything else is treated as security
+*/
+var defaultTemplateCategories = map[string]string{
+	"welcome":      CategoryProduct,
+	"weeklyDigest": CategoryDigests,
+}
+
+/*
+Works out the category of a custom_emails record
+*/
+func templateCategory(record *models.Record) string {
+	name := record.GetString("name")
+	if list.ExistInSlice(name, securityTemplates) {
+		return CategorySecurity
+	}
+
+	if category := record.GetString("category"); list.ExistInSlice(category, Categories) {
+		return category
+	}
+	if category, ok := defaultTemplateCategories[name]; ok {
+		return category
+	}
+
+	return CategorySecurity
+}
+
+/*
+Checks if the address has opted out of the category
+
+Security emails are never opted out of
+*/
+func IsUnsubscribed(app *pocketbase.PocketBase, email string, category string) bool {
+	if category == "" || category == CategorySecurity {
+		return false
+	}
+
+	record, err := findPreferences(app, email)
+	if err != nil {
+		return false
+	}
+
+	return list.ExistInSlice(category, unsubscribedCategories(record))
+}
+
+/*
+Returns if the address gets each category
+*/
+func Preferences(app *pocketbase.PocketBase, email string) map[string]bool {
+	preferences := make(map[string]bool)
+	for _, category := range Categories {
+		preferences[category] = !IsUnsubscribed(app, email, category)
+	}
+	return preferences
+}
+
+/*
+Opts the address in or out of a category
+*/
+func SetSubscribed(app *pocketbase.PocketBase, email string, category string, subscribed bool) error {
+	if !list.ExistInSlice(category, Categories) {
+		return NewEmailError("Unknown category %s", category)
+	}
+	if category == CategorySecurity {
+		return NewEmailError("Security emails can't be turned off")
+	}
+
+	record, err := findPreferences(app, email)
+	if err != nil {
+		preferencesCollection, err := app.Dao().FindCollectionByNameOrId("email_preferences")
+		if err != nil {
+			return NewEmailError("email_preferences Collection was not found. Please create it to use this feature.")
+		}
+		record = models.NewRecord(preferencesCollection)
+		record.Set("email", strings.ToLower(email))
+	}
+
+	unsubscribed := unsubscribedCategories(record)
+	if subscribed {
+		unsubscribed = list.SubtractSlice(unsubscribed, []string{category})
+	} else if !list.ExistInSlice(category, unsubscribed) {
+		unsubscribed = append(unsubscribed, category)
+	}
+	record.Set("unsubscribed", unsubscribed)
+
+	return app.Dao().SaveRecord(record)
+}
+
+/*
+Moves the preferences when a user changes their email
+*/
+func MovePreferences(dao *daos.Dao, oldEmail string, newEmail string) error {
+	record, err := findPreferencesWith(dao, oldEmail)
+	if err != nil {
+		return nil
+	}
+
+	if existing, err := findPreferencesWith(dao, newEmail); err == nil {
+		if err := dao.DeleteRecord(existing); err != nil {
+			return err
+		}
+	}
+
+	record.Set("email", strings.ToLower(newEmail))
+	return dao.SaveRecord(record)
+}
+
+/*
+Makes a signed one click unsubscribe link for the address and category
+*/
+func UnsubscribeURL(app *pocketbase.PocketBase, email string, category string) string {
+	query := url.Values{}
+	query.Set("email", base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(email))))
+	query.Set("category", category)
+	query.Set("sig", unsubscribeSignature(app, strings.ToLower(email), category))
+
+	return strings.TrimSuffix(app.Settings().Meta.AppUrl, "/") + "/api/unsubscribe?" + query.Encode()
+}
+
+/*
+Checks the link values and returns the address they are for
+*/
+func VerifyUnsubscribe(app *pocketbase.PocketBase, encodedEmail string, category string, sig string) (string, error) {
+	emailBytes, err := base64.RawURLEncoding.DecodeString(encodedEmail)
+	if err != nil {
+		return "", NewEmailError("Invalid unsubscribe link")
+	}
+	email := string(emailBytes)
+
+	if !security.Equal(unsubscribeSignature(app, email, category), sig) {
+		return "", NewEmailError("Invalid unsubscribe link")
+	}
+
+	return email, nil
+}
+
+//Extra helper functions:
+
+func findPreferences(app *pocketbase.PocketBase, email string) (*models.Record, error) {
+	return findPreferencesWith(app.Dao(), email)
+}
+
+func findPreferencesWith(dao *daos.Dao, email string) (*models.Record, error) {
+	return dao.FindFirstRecordByFilter(
+		"email_preferences", "email = {:email}",
+		dbx.Params{"email": strings.ToLower(email)},
+	)
+}
+
+func unsubscribedCategories(record *models.Record) []string {
+	var unsubscribed []string
+	if err := record.UnmarshalJSONField("unsubscribed", &unsubscribed); err != nil {
+		return []string{}
+	}
+	return unsubscribed
+}
+
+/*
+Uses the unsubscribe_secret env, or the auth token secret so links keep working after a restart
+*/
+func unsubscribeSignature(app *pocketbase.PocketBase, email string, category string) string {
+	secret, found := os.LookupEnv("unsubscribe_secret")
+	if !found || secret == "" {
+		secret = app.Settings().RecordAuthToken.Secret
+	}
+
+	return security.HS256(email+"|"+category, secret)
+}
@@ -0,0 +1,87 @@
+package emails
+
+import (
+	"net/mail"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"suddsy.dev/m/v2/app/tools/i18n"
+)
+
+/*
+Placeholder values for everything the built in emails use
+
+Used when previewing a template without any data
+*/
+func SampleEmailData(app *pocketbase.PocketBase, locale string) map[string]interface{} {
+	if locale == "" {
+		locale = i18n.DefaultLocale()
+	}
+
+	data := make(map[string]interface{})
+	data["subject"] = "Sample subject"
+	data["locale"] = locale
+	data["token"] = "123456"
+	data["recp"] = "someone@example.com"
+	data["recpName"] = "someone"
+	data["replyTo"] = app.Settings().Meta.SenderAddress
+	data["buttonLink"] = app.Settings().Meta.AppUrl
+	data["device"] = "Firefox on Linux"
+	data["ip"] = "203.0.113.0/24"
+	data["time"] = time.Now().UTC().Format(time.RFC1123)
+	data["provider"] = "github"
+	data["since"] = time.Now().UTC().AddDate(0, 0, -7).Format("2 Jan 2006")
+	data["until"] = time.Now().UTC().Format("2 Jan 2006")
+	data["edited"] = []map[string]interface{}{
+		{"title": "Meeting notes", "link": app.Settings().Meta.AppUrl},
+		{"title": "Reading list", "link": app.Settings().Meta.AppUrl},
+	}
+	data["editedMore"] = 3
+	data["shared"] = []map[string]interface{}{
+		{"title": "Project plan", "link": app.Settings().Meta.AppUrl},
+	}
+	data["sharedMore"] = 0
+
+	return data
+}
+
+/*
+Renders a template straight from the db, skipping the cache so edits show up right away
+*/
+func PreviewEmail(app *pocketbase.PocketBase, emailName string, locale string, data map[string]interface{}) (RenderedEmail, error) {
+	record, err := findEmailTemplate(app, emailName, locale)
+	if err != nil {
+		return RenderedEmail{}, NewEmailError("Template not found")
+	}
+
+	cachedEmail, err := parseEmailTemplate(app, record)
+	if err != nil {
+		return RenderedEmail{}, err
+	}
+
+	return executeEmailTemplate(app, cachedEmail, data)
+}
+
+/*
+Renders a template and sends it to the address right away, without the outbox
+
+The error from the mail server is returned so it can be shown
+*/
+func SendTestEmail(app *pocketbase.PocketBase, emailName string, locale string, data map[string]interface{}, to string) error {
+	address, err := mail.ParseAddress(to)
+	if err != nil {
+		return NewEmailError("Invalid email address")
+	}
+
+	email, err := PreviewEmail(app, emailName, locale, data)
+	if err != nil {
+		return err
+	}
+
+	subject, _ := data["subject"].(string)
+	if subject == "" {
+		subject = emailName
+	}
+
+	return SendEmail(app, "[Test] "+subject, []mail.Address{*address}, email)
+}
@@ -0,0 +1,462 @@
+package emails
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+/*
+Admin only routes to see and manage the email outbox, templates and scheduled emails
+
+The unsubscribe links are public, they are checked with their signature instead.
+The bounce webhook is public too and checked with bounce_webhook_secret
+
+The mailbox pages are opened in a browser, which can't send the Authorization header.
+They also accept an admin token as ?token=, eg. /api/mailbox/inbox?token=<admin token from the dashboard>
+*/
+func RegisterEmailRoutes(e *core.ServeEvent, app *pocketbase.PocketBase) {
+	e.Router.GET("/api/unsubscribe", func(c echo.Context) error {
+		return unsubscribePage(app, c)
+	})
+	e.Router.POST("/api/unsubscribe", func(c echo.Context) error {
+		return unsubscribe(app, c)
+	})
+	e.Router.POST("/api/bounces", func(c echo.Context) error {
+		return bounceWebhook(app, c)
+	})
+
+	e.Router.GET("/api/outbox/:method", func(c echo.Context) error {
+		return handleGetMethodAssign(c, app)
+	}, apis.RequireAdminAuth())
+	e.Router.POST("/api/outbox/:method", func(c echo.Context) error {
+		return handlePostMethodAssign(c, app)
+	}, apis.RequireAdminAuth())
+	e.Router.GET("/api/mailbox/:method", func(c echo.Context) error {
+		return handleMailboxGetMethodAssign(c, app)
+	}, adminTokenFromQuery(app), apis.RequireAdminAuth(), requireCapture)
+	e.Router.POST("/api/mailbox/:method", func(c echo.Context) error {
+		return handleMailboxPostMethodAssign(c, app)
+	}, apis.RequireAdminAuth(), requireCapture)
+	e.Router.GET("/api/emails/:method", func(c echo.Context) error {
+		return handleTemplateGetMethodAssign(c, app)
+	}, apis.RequireAdminAuth())
+	e.Router.POST("/api/emails/:method", func(c echo.Context) error {
+		return handleTemplateMethodAssign(c, app)
+	}, apis.RequireAdminAuth())
+}
+
+func handleGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "stats":
+		return outboxStats(app, c)
+	case "list":
+		return listOutbox(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handlePostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "retry":
+		return retryOutboxEmail(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handleTemplateGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "versions":
+		return listTemplateVersions(app, c)
+	case "scheduled":
+		return listScheduledEmails(app, c)
+	case "suppressions":
+		return listSuppressions(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handleTemplateMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "preview":
+		return previewTemplate(app, c)
+	case "test":
+		return sendTestTemplate(app, c)
+	case "rollback":
+		return rollbackTemplate(app, c)
+	case "schedule":
+		return scheduleEmail(app, c)
+	case "unschedule":
+		return unscheduleEmail(app, c)
+	case "suppress":
+		return suppressAddress(app, c)
+	case "unsuppress":
+		return unsuppressAddress(app, c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handleMailboxGetMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "list":
+		return listCapturedEmails(c)
+	case "view":
+		return viewCapturedEmail(c)
+	case "inbox":
+		return mailboxPage(c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func handleMailboxPostMethodAssign(c echo.Context, app *pocketbase.PocketBase) error {
+	switch c.PathParam("method") {
+	case "clear":
+		return clearCapturedEmails(c)
+	}
+	return apis.NewNotFoundError("Method not found", nil)
+}
+
+func outboxStats(app *pocketbase.PocketBase, c echo.Context) error {
+	stats, err := OutboxStats(app)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load the outbox", nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["stats"] = stats
+
+	return c.JSON(200, res)
+}
+
+/*
+Lists the outbox without the email bodies
+
+Filter with ?status=dead etc
+*/
+func listOutbox(app *pocketbase.PocketBase, c echo.Context) error {
+	filter := "id != ''"
+	params := dbx.Params{}
+	if status := c.QueryParam("status"); status != "" {
+		filter = "status = {:status}"
+		params["status"] = status
+	}
+
+	records, err := app.Dao().FindRecordsByFilter("email_outbox", filter, "-created", 100, 0, params)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load the outbox", nil)
+	}
+
+	items := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		items = append(items, map[string]interface{}{
+			"id":               record.Id,
+			"subject":          record.GetString("subject"),
+			"recipients":       record.Get("recipients"),
+			"template":         record.GetString("template"),
+			"template_version": record.GetInt("template_version"),
+			"priority":         record.GetInt("priority"),
+			"status":           record.GetString("status"),
+			"attempts":         record.GetInt("attempts"),
+			"next_attempt":     record.GetDateTime("next_attempt"),
+			"last_error":       record.GetString("last_error"),
+			"sent_at":          record.GetDateTime("sent_at"),
+			"created":          record.Created,
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["emails"] = items
+
+	return c.JSON(200, res)
+}
+
+func retryOutboxEmail(app *pocketbase.PocketBase, c echo.Context) error {
+	if err := RetryEmail(app, c.FormValue("id")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Email queued"
+
+	return c.JSON(200, res)
+}
+
+/*
+Renders the template with the name, locale and data (json) form values
+
+Without data the sample data is used
+*/
+func previewTemplate(app *pocketbase.PocketBase, c echo.Context) error {
+	data, err := templateRequestData(app, c)
+	if err != nil {
+		return err
+	}
+
+	email, err := PreviewEmail(app, c.FormValue("name"), c.FormValue("locale"), data)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["html"] = email.HTML
+	res["text"] = email.Text
+	res["version"] = email.Version
+
+	return c.JSON(200, res)
+}
+
+func sendTestTemplate(app *pocketbase.PocketBase, c echo.Context) error {
+	data, err := templateRequestData(app, c)
+	if err != nil {
+		return err
+	}
+
+	err = SendTestEmail(app, c.FormValue("name"), c.FormValue("locale"), data, c.FormValue("to"))
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Test email sent to: " + c.FormValue("to")
+
+	return c.JSON(200, res)
+}
+
+/*
+Lists the old versions of the template given by ?template=<custom_emails id>
+*/
+func listTemplateVersions(app *pocketbase.PocketBase, c echo.Context) error {
+	record, err := app.Dao().FindRecordById("custom_emails", c.QueryParam("template"))
+	if err != nil {
+		return apis.NewNotFoundError("Template not found", nil)
+	}
+
+	versions, err := TemplateVersions(app, record.Id)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load the template versions", nil)
+	}
+
+	items := make([]map[string]interface{}, 0, len(versions))
+	for _, version := range versions {
+		items = append(items, map[string]interface{}{
+			"version":        version.GetInt("version"),
+			"email_rich":     version.GetString("email_rich"),
+			"email_markdown": version.GetString("email_markdown"),
+			"email_text":     version.GetString("email_text"),
+			"created":        version.Created,
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["current"] = currentVersion(record)
+	res["versions"] = items
+
+	return c.JSON(200, res)
+}
+
+func rollbackTemplate(app *pocketbase.PocketBase, c echo.Context) error {
+	version, err := strconv.Atoi(c.FormValue("version"))
+	if err != nil || version < 1 {
+		return apis.NewBadRequestError("Invalid or missing version", nil)
+	}
+
+	record, err := RollbackTemplate(app, c.FormValue("template"), version)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Template rolled back"
+	res["version"] = record.GetInt("version")
+
+	return c.JSON(200, res)
+}
+
+/*
+Lists scheduled emails, soonest first
+
+Filter with ?status=scheduled etc
+*/
+func listScheduledEmails(app *pocketbase.PocketBase, c echo.Context) error {
+	filter := "id != ''"
+	params := dbx.Params{}
+	if status := c.QueryParam("status"); status != "" {
+		filter = "status = {:status}"
+		params["status"] = status
+	}
+
+	records, err := app.Dao().FindRecordsByFilter("email_schedule", filter, "send_at", 100, 0, params)
+	if err != nil {
+		return apis.NewApiError(500, "Unable to load the scheduled emails", nil)
+	}
+
+	items := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		items = append(items, map[string]interface{}{
+			"id":         record.Id,
+			"key":        record.GetString("key"),
+			"template":   record.GetString("template"),
+			"subject":    record.GetString("subject"),
+			"locale":     record.GetString("locale"),
+			"recipients": record.Get("recipients"),
+			"send_at":    record.GetDateTime("send_at"),
+			"status":     record.GetString("status"),
+			"queued_at":  record.GetDateTime("queued_at"),
+			"last_error": record.GetString("last_error"),
+		})
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["emails"] = items
+
+	return c.JSON(200, res)
+}
+
+/*
+Schedules a template with the template, to (comma separated), send_at (RFC 3339) and optional subject, locale, data (json) and key form values
+*/
+func scheduleEmail(app *pocketbase.PocketBase, c echo.Context) error {
+	recipients, err := mail.ParseAddressList(c.FormValue("to"))
+	if err != nil {
+		return apis.NewBadRequestError("Invalid or missing email", nil)
+	}
+
+	sendAt, err := time.Parse(time.RFC3339, c.FormValue("send_at"))
+	if err != nil {
+		return apis.NewBadRequestError("send_at must be an RFC 3339 date", nil)
+	}
+
+	data := make(map[string]interface{})
+	if raw := c.FormValue("data"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return apis.NewBadRequestError("data must be a json object", nil)
+		}
+	}
+
+	email := ScheduledEmail{
+		Key:      c.FormValue("key"),
+		Template: c.FormValue("template"),
+		Subject:  c.FormValue("subject"),
+		Locale:   c.FormValue("locale"),
+		Data:     data,
+		SendAt:   sendAt,
+	}
+	for _, recipient := range recipients {
+		email.Recipients = append(email.Recipients, *recipient)
+	}
+
+	record, err := ScheduleEmail(app, email)
+	if err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["id"] = record.Id
+	res["status"] = record.GetString("status")
+
+	return c.JSON(200, res)
+}
+
+func unscheduleEmail(app *pocketbase.PocketBase, c echo.Context) error {
+	if err := CancelScheduledEmail(app, c.FormValue("id")); err != nil {
+		return apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	res := make(map[string]interface{})
+	res["code"] = 200
+	res["message"] = "Email cancelled"
+
+	return c.JSON(200, res)
+}
+
+//Extra helper functions:
+
+/*
+The mailbox only exists while capture mode is on
+*/
+func requireCapture(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !CaptureEnabled() {
+			return apis.NewNotFoundError("Email capture is not enabled", nil)
+		}
+		return next(c)
+	}
+}
+
+/*
+Signs in an admin from the ?token= query param when there is no Authorization header
+*/
+func adminTokenFromQuery(app *pocketbase.PocketBase) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := c.QueryParam("token")
+			if token == "" || c.Get(apis.ContextAdminKey) != nil {
+				return next(c)
+			}
+
+			admin, err := app.Dao().FindAdminByToken(token, app.Settings().AdminAuthToken.Secret)
+			if err == nil && admin != nil {
+				c.Set(apis.ContextAdminKey, admin)
+			}
+			return next(c)
+		}
+	}
+}
+
+func templateRequestData(app *pocketbase.PocketBase, c echo.Context) (map[string]interface{}, error) {
+	if c.FormValue("name") == "" {
+		return nil, apis.NewBadRequestError("Invalid or missing name", nil)
+	}
+
+	data := SampleEmailData(app, c.FormValue("locale"))
+
+	raw := c.FormValue("data")
+	if raw == "" {
+		return data, nil
+	}
+
+	supplied := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(raw), &supplied); err != nil {
+		return nil, apis.NewBadRequestError("data must be a json object", nil)
+	}
+	// Supplied values replace the sample ones so partial data still renders
+	for key, value := range supplied {
+		data[key] = value
+	}
+
+	return data, nil
+}
+
+/*
+Template errors come back with where they happened, anything else is a plain bad request
+*/
+func templateErrorResponse(c echo.Context, err error) error {
+	var templateErr *TemplateError
+	if errors.As(err, &templateErr) {
+		res := make(map[string]interface{})
+		res["code"] = 400
+		res["message"] = templateErr.Error()
+		res["error"] = templateErr
+
+		return c.JSON(400, res)
+	}
+
+	return apis.NewBadRequestError(err.Error(), nil)
+}
@@ -0,0 +1,201 @@
+package emails
+
+import (
+	"net/mail"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	ScheduleStatusScheduled = "scheduled"
+	ScheduleStatusQueued    = "queued"
+	ScheduleStatusFailed    = "failed"
+	ScheduleStatusCancelled = "cancelled"
+)
+
+var scheduleBatchSize = 50
+
+/*
+An email to send later. The template is rendered when it is due so any edits made in between are used
+
+Key is optional, scheduling the same key twice keeps the first one so callers can safely retry
+*/
+type ScheduledEmail struct {
+	Key        string                 `json:"key"`
+	Template   string                 `json:"template"`
+	Subject    string                 `json:"subject"`
+	Locale     string                 `json:"locale"`
+	Recipients []mail.Address         `json:"recipients"`
+	Data       map[string]interface{} `json:"data"`
+	SendAt     time.Time              `json:"send_at"`
+}
+
+/*
+Saves an email to the email_schedule collection to be queued once send_at has passed
+*/
+func ScheduleEmail(app *pocketbase.PocketBase, email ScheduledEmail) (*models.Record, error) {
+	if email.Template == "" || len(email.Recipients) == 0 {
+		return nil, NewEmailError("A template and at least one recipient are required")
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("email_schedule")
+	if err != nil {
+		return nil, NewEmailError("email_schedule Collection was not found. Please create it to use this feature.")
+	}
+
+	if email.Key != "" {
+		existing, err := app.Dao().FindFirstRecordByFilter("email_schedule", "key = {:key}", dbx.Params{"key": email.Key})
+		if err == nil {
+			return existing, nil
+		}
+	}
+
+	if email.SendAt.IsZero() {
+		email.SendAt = time.Now().UTC()
+	}
+	if email.Data == nil {
+		email.Data = make(map[string]interface{})
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("key", email.Key)
+	record.Set("template", email.Template)
+	record.Set("subject", email.Subject)
+	record.Set("locale", email.Locale)
+	record.Set("recipients", email.Recipients)
+	record.Set("data", email.Data)
+	record.Set("send_at", email.SendAt.UTC())
+	record.Set("status", ScheduleStatusScheduled)
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+/*
+Stops a scheduled email from being sent if it hasn't been queued yet
+*/
+func CancelScheduledEmail(app *pocketbase.PocketBase, id string) error {
+	result, err := app.Dao().DB().
+		NewQuery("UPDATE email_schedule SET status = {:cancelled}, updated = {:now} WHERE id = {:id} AND status = {:scheduled}").
+		Bind(dbx.Params{
+			"cancelled": ScheduleStatusCancelled,
+			"scheduled": ScheduleStatusScheduled,
+			"now":       types.NowDateTime().String(),
+			"id":        id,
+		}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NewEmailError("Only scheduled emails can be cancelled")
+	}
+	return nil
+}
+
+/*
+Checks for due scheduled emails every minute and puts them in the outbox
+*/
+func EnableScheduledEmailCron(app *pocketbase.PocketBase, scheduler *cron.Cron) error {
+	if _, err := app.Dao().FindCollectionByNameOrId("email_schedule"); err != nil {
+		app.Logger().Error("email_schedule Collection was not found. Please create it to use this feature.")
+		return nil
+	}
+
+	scheduler.MustAdd("ScheduledEmails", "* * * * *", func() {
+		processScheduledEmails(app)
+	})
+	return nil
+}
+
+//Extra helper functions:
+
+func processScheduledEmails(app *pocketbase.PocketBase) {
+	records, err := app.Dao().FindRecordsByFilter(
+		"email_schedule", "status = {:scheduled} && send_at <= {:now}",
+		"send_at", scheduleBatchSize, 0,
+		dbx.Params{"scheduled": ScheduleStatusScheduled, "now": types.NowDateTime().String()},
+	)
+	if err != nil {
+		return
+	}
+
+	for _, record := range records {
+		if !claimScheduledEmail(app, record) {
+			continue
+		}
+
+		if err := queueScheduledEmail(app, record); err != nil {
+			app.Logger().Error("Failed to queue a scheduled email", "id", record.Id, "details", err)
+			record.Set("status", ScheduleStatusFailed)
+			record.Set("last_error", err.Error())
+		} else {
+			record.Set("status", ScheduleStatusQueued)
+			record.Set("queued_at", types.NowDateTime())
+		}
+
+		if err := app.Dao().SaveRecord(record); err != nil {
+			app.Logger().Error("Failed to update a scheduled email", "id", record.Id, "details", err)
+		}
+	}
+}
+
+/*
+Moves the email out of scheduled in one statement so it is only ever queued once, even across restarts
+
+Anything interrupted between claiming and queueing is left as failed rather than sent twice
+*/
+func claimScheduledEmail(app *pocketbase.PocketBase, record *models.Record) bool {
+	result, err := app.Dao().DB().
+		NewQuery("UPDATE email_schedule SET status = {:failed}, last_error = {:interrupted} WHERE id = {:id} AND status = {:scheduled}").
+		Bind(dbx.Params{
+			"failed":      ScheduleStatusFailed,
+			"interrupted": "Interrupted before it was queued",
+			"scheduled":   ScheduleStatusScheduled,
+			"id":          record.Id,
+		}).
+		Execute()
+	if err != nil {
+		return false
+	}
+
+	rows, _ := result.RowsAffected()
+	return rows == 1
+}
+
+func queueScheduledEmail(app *pocketbase.PocketBase, record *models.Record) error {
+	var recipients []mail.Address
+	if err := record.UnmarshalJSONField("recipients", &recipients); err != nil {
+		return err
+	}
+
+	data := make(map[string]interface{})
+	if err := record.UnmarshalJSONField("data", &data); err != nil {
+		return err
+	}
+	if _, ok := data["recp"]; !ok && len(recipients) == 1 {
+		data["recp"] = recipients[0].Address
+		data["recpName"] = recipients[0].Name
+	}
+
+	email, err := RenderEmail(app, record.GetString("template"), record.GetString("locale"), data)
+	if err != nil {
+		return err
+	}
+
+	subject := record.GetString("subject")
+	if subject == "" {
+		subject = record.GetString("template")
+	}
+
+	return QueueEmail(app, subject, recipients, email, PriorityScheduled)
+}
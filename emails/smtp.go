@@ -0,0 +1,195 @@
+package emails
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strings"
+
+	"github.com/domodwyer/mailyak/v3"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+/*
+Builds the raw message the same way the pocketbase mailer does, so it can be signed before sending
+*/
+func buildRawMessage(message *mailer.Message) ([]byte, error) {
+	yak := mailyak.New("", nil)
+
+	if message.From.Name != "" {
+		yak.FromName(message.From.Name)
+	}
+	yak.From(message.From.Address)
+	yak.Subject(message.Subject)
+	yak.HTML().Set(message.HTML)
+	yak.Plain().Set(message.Text)
+
+	if len(message.To) > 0 {
+		yak.To(addressStrings(message.To)...)
+	}
+	if len(message.Cc) > 0 {
+		yak.Cc(addressStrings(message.Cc)...)
+	}
+
+	for name, data := range message.Attachments {
+		yak.Attach(name, data)
+	}
+
+	var hasMessageId bool
+	for key, value := range message.Headers {
+		if strings.EqualFold(key, "Message-ID") {
+			hasMessageId = true
+		}
+		yak.AddHeader(key, value)
+	}
+	if !hasMessageId {
+		if _, domain, found := strings.Cut(message.From.Address, "@"); found {
+			yak.AddHeader("Message-ID", fmt.Sprintf("<%s@%s>", security.PseudorandomString(15), domain))
+		}
+	}
+
+	buf, err := yak.MimeBuf()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Signs the message and sends it through the smtp settings from the admin UI
+*/
+func sendSigned(app *pocketbase.PocketBase, message *mailer.Message, signer *DKIMSigner) error {
+	settings := app.Settings().Smtp
+
+	raw, err := buildRawMessage(message)
+	if err != nil {
+		return err
+	}
+	raw, err = signer.Sign(raw)
+	if err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", settings.Host, settings.Port)
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+
+	var client *smtp.Client
+	if settings.Tls {
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		client, err = smtp.NewClient(conn, settings.Host)
+		if err != nil {
+			return err
+		}
+	} else {
+		client, err = smtp.Dial(addr)
+		if err != nil {
+			return err
+		}
+	}
+	defer client.Close()
+
+	if settings.LocalName != "" {
+		if err := client.Hello(settings.LocalName); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !settings.Tls {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if settings.Username != "" || settings.Password != "" {
+		var auth smtp.Auth
+		if settings.AuthMethod == mailer.SmtpAuthLogin {
+			auth = &loginAuth{settings.Username, settings.Password}
+		} else {
+			auth = smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+		}
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(message.From.Address); err != nil {
+		return err
+	}
+	for _, group := range [][]string{addressOnly(message.To), addressOnly(message.Cc), addressOnly(message.Bcc)} {
+		for _, address := range group {
+			if err := client.Rcpt(address); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(raw); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+//Extra helper functions:
+
+func addressStrings(addresses []mail.Address) []string {
+	result := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if address.Name != "" {
+			result = append(result, address.String())
+		} else {
+			result = append(result, address.Address)
+		}
+	}
+	return result
+}
+
+func addressOnly(addresses []mail.Address) []string {
+	result := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, address.Address)
+	}
+	return result
+}
+
+/*
+AUTH LOGIN for servers like outlook that don't take PLAIN, only sent over TLS
+*/
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
@@ -0,0 +1,202 @@
+package emails
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+/*
+The kinds of bounce reports
+*/
+const (
+	BounceHard      = "hard"
+	BounceSoft      = "soft"
+	BounceComplaint = "complaint"
+)
+
+/*
+Why an address was suppressed
+*/
+const (
+	SuppressionHardBounce = "hard_bounce"
+	SuppressionSoftBounce = "soft_bounce"
+	SuppressionComplaint  = "complaint"
+	SuppressionManual     = "manual"
+)
+
+/*
+Soft bounces (full mailbox, greylisting etc) only suppress an address once there have been softBounceLimit of them,
+each within softBounceWindow of the last. The count starts again after a quiet spell
+*/
+var (
+	softBounceLimit  = 5
+	softBounceWindow = 7 * 24 * time.Hour
+)
+
+/*
+A bounce or complaint for one address, from a webhook or a delivery status notification
+*/
+type BounceEvent struct {
+	Email      string `json:"email"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Diagnostic string `json:"diagnostic"`
+	Source     string `json:"source"`
+}
+
+/*
+Checks if an address is on the suppression list. Nothing is sent to suppressed addresses
+*/
+func IsSuppressed(app *pocketbase.PocketBase, email string) bool {
+	record, err := findSuppression(app, email)
+	return err == nil && record.GetBool("suppressed")
+}
+
+/*
+Saves a bounce or complaint to the email_suppressions collection
+
+Hard bounces and complaints suppress the address straight away, soft bounces once there are softBounceLimit of them
+*/
+func RecordBounce(app *pocketbase.PocketBase, event BounceEvent) error {
+	address, err := mail.ParseAddress(event.Email)
+	if err != nil {
+		return NewEmailError("Invalid email address")
+	}
+	email := strings.ToLower(address.Address)
+
+	record, err := findOrNewSuppression(app, email)
+	if err != nil {
+		return err
+	}
+
+	wasSuppressed := record.GetBool("suppressed")
+	switch event.Type {
+	case BounceHard:
+		record.Set("suppressed", true)
+		record.Set("reason", SuppressionHardBounce)
+	case BounceComplaint:
+		record.Set("suppressed", true)
+		record.Set("reason", SuppressionComplaint)
+	case BounceSoft:
+		softBounces := record.GetInt("soft_bounces")
+		// An old soft bounce has most likely cleared up by now
+		if time.Since(record.GetDateTime("last_event").Time()) > softBounceWindow {
+			softBounces = 0
+		}
+		softBounces++
+		record.Set("soft_bounces", softBounces)
+		if softBounces >= softBounceLimit && !wasSuppressed {
+			record.Set("suppressed", true)
+			record.Set("reason", SuppressionSoftBounce)
+		}
+	default:
+		return NewEmailError("Unknown bounce type: %s", event.Type)
+	}
+
+	record.Set("status", event.Status)
+	record.Set("diagnostic", truncate(event.Diagnostic, 1000))
+	record.Set("source", event.Source)
+	record.Set("last_event", types.NowDateTime())
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return err
+	}
+
+	if !wasSuppressed && record.GetBool("suppressed") {
+		app.Logger().Warn("Email address suppressed", "email", email, "reason", record.GetString("reason"), "status", event.Status)
+	}
+	return nil
+}
+
+/*
+Adds an address to the suppression list by hand
+*/
+func Suppress(app *pocketbase.PocketBase, email string, diagnostic string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return NewEmailError("Invalid email address")
+	}
+
+	record, err := findOrNewSuppression(app, strings.ToLower(address.Address))
+	if err != nil {
+		return err
+	}
+
+	record.Set("suppressed", true)
+	record.Set("reason", SuppressionManual)
+	record.Set("diagnostic", diagnostic)
+	record.Set("source", "admin")
+	record.Set("last_event", types.NowDateTime())
+
+	return app.Dao().SaveRecord(record)
+}
+
+/*
+Takes an address off the suppression list, eg. once the user has fixed their mailbox
+*/
+func Unsuppress(app *pocketbase.PocketBase, email string) error {
+	record, err := findSuppression(app, email)
+	if err != nil {
+		return NewEmailError("Address is not suppressed")
+	}
+
+	record.Set("suppressed", false)
+	record.Set("soft_bounces", 0)
+
+	return app.Dao().SaveRecord(record)
+}
+
+//Extra helper functions:
+
+/*
+Splits out the suppressed recipients
+*/
+func deliverableRecipients(app *pocketbase.PocketBase, recp []mail.Address) ([]mail.Address, []string) {
+	deliverable := make([]mail.Address, 0, len(recp))
+	var suppressed []string
+	for _, address := range recp {
+		if IsSuppressed(app, address.Address) {
+			suppressed = append(suppressed, address.Address)
+			continue
+		}
+		deliverable = append(deliverable, address)
+	}
+	return deliverable, suppressed
+}
+
+func findSuppression(app *pocketbase.PocketBase, email string) (*models.Record, error) {
+	return app.Dao().FindFirstRecordByFilter(
+		"email_suppressions", "email = {:email}",
+		dbx.Params{"email": strings.ToLower(strings.TrimSpace(email))},
+	)
+}
+
+func findOrNewSuppression(app *pocketbase.PocketBase, email string) (*models.Record, error) {
+	if record, err := findSuppression(app, email); err == nil {
+		return record, nil
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("email_suppressions")
+	if err != nil {
+		return nil, NewEmailError("email_suppressions Collection was not found. Please create it to use this feature.")
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("email", email)
+	record.Set("suppressed", false)
+	record.Set("soft_bounces", 0)
+	return record, nil
+}
+
+func truncate(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+	return value[:length]
+}
@@ -3,119 +3,259 @@ package emails
 import (
 	"bytes"
 	"html/template"
+	"strings"
 	"sync"
+	texttemplate "text/template"
 	"time"
 
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"suddsy.dev/m/v2/app/tools/i18n"
 )
 
 type CachedEmail struct {
-	Template *template.Template
-	StoredAt time.Time
+	Template     *template.Template
+	TextTemplate *texttemplate.Template
+	Layout       *Layout
+	SourceField  string
+	Name         string
+	Locale       string
+	Category     string
+	Options      MessageOptions
+	Version      int
+	StoredAt     time.Time
+}
+
+/*
+A rendered email and the template version it came from
+*/
+type RenderedEmail struct {
+	MessageOptions
+
+	HTML           string
+	Text           string
+	Template       string
+	Version        int
+	Category       string
+	UnsubscribeURL string
 }
 
 var (
 	cache      = make(map[string]CachedEmail)
 	cacheMutex sync.Mutex
+
+	missingLocaleOnce sync.Once
+
+	// Saves clear the cache through the custom_emails hooks, this only catches edits made around the app
+	cacheLifetime = 1 * time.Hour
 )
 
-func LoadEmailDataToHTML(app *pocketbase.PocketBase, emailName string, data map[string]interface{}) (string, error) {
+/*
+Renders a custom_emails template in the given locale
+
+If there is no template for the locale the base language and then the default locale are used
+*/
+func LoadEmailDataToHTML(app *pocketbase.PocketBase, emailName string, locale string, data map[string]interface{}) (string, error) {
+	email, err := RenderEmail(app, emailName, locale, data)
+	return email.HTML, err
+}
+
+/*
+Renders both the html and plain text versions of a custom_emails template
+
+The text comes from the optional email_text field, otherwise it is made from the rendered html
+*/
+func RenderEmail(app *pocketbase.PocketBase, emailName string, locale string, data map[string]interface{}) (RenderedEmail, error) {
+	cachedEmail, err := loadEmailTemplate(app, emailName, locale)
+	if err != nil {
+		return RenderedEmail{}, err
+	}
+
+	return executeEmailTemplate(app, cachedEmail, data)
+}
+
+/*
+Loads the parsed templates from the cache or the db
+*/
+func loadEmailTemplate(app *pocketbase.PocketBase, emailName string, locale string) (CachedEmail, error) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
-	var emailTemplate *template.Template
+	cacheKey := emailName + "|" + locale
 
-	// Check if the email template is already cached and within the 5-minute validity period
-	if cachedEmail, ok := cache[emailName]; ok && time.Since(cachedEmail.StoredAt) <= 1*time.Minute {
-		emailTemplate = cachedEmail.Template
-	} else {
-		// If not cached or cache expired, fetch from the database
-		record, err := app.Dao().FindFirstRecordByData("custom_emails", "name", emailName)
-		if err != nil {
-			return "", err
+	// Check if the email template is already cached and still valid
+	if cachedEmail, ok := cache[cacheKey]; ok && time.Since(cachedEmail.StoredAt) <= cacheLifetime {
+		return cachedEmail, nil
+	}
+
+	// If not cached or cache expired, fetch from the database
+	record, err := findEmailTemplate(app, emailName, locale)
+	if err != nil {
+		return CachedEmail{}, err
+	}
+
+	cachedEmail, err := parseEmailTemplate(app, record)
+	if err != nil {
+		return CachedEmail{}, err
+	}
+
+	// Update the cache with the new templates, dropping any that have expired
+	for key, cached := range cache {
+		if time.Since(cached.StoredAt) > cacheLifetime {
+			delete(cache, key)
 		}
+	}
+	cache[cacheKey] = cachedEmail
+
+	return cachedEmail, nil
+}
+
+/*
+Parses the html and optional text templates from a custom_emails record along with its layout
+
+When email_markdown is set it is used instead of email_rich
+*/
+func parseEmailTemplate(app *pocketbase.PocketBase, record *models.Record) (CachedEmail, error) {
+	emailName := record.GetString("name")
+
+	layout, err := loadLayout(app, record.GetString("layout"))
+	if err != nil {
+		return CachedEmail{}, err
+	}
+
+	source, sourceField := record.GetString("email_rich"), "email_rich"
+	if markdown := record.GetString("email_markdown"); strings.TrimSpace(markdown) != "" {
+		source, sourceField = MarkdownToHTML(markdown, layout.Brand), "email_markdown"
+	}
 
-		emailHtmlString := record.GetString("email_rich")
+	// Parse the HTML string as a template
+	emailTemplate, err := template.New(emailName).Parse(source)
+	if err != nil {
+		return CachedEmail{}, newTemplateError("parse", sourceField, err)
+	}
 
-		// Parse the HTML string as a template
-		emailTemplate, err = template.New(emailName).Parse(emailHtmlString)
+	var textTemplate *texttemplate.Template
+	if emailText := record.GetString("email_text"); strings.TrimSpace(emailText) != "" {
+		textTemplate, err = texttemplate.New(emailName).Parse(emailText)
 		if err != nil {
-			return "", err
+			return CachedEmail{}, newTemplateError("parse", "email_text", err)
 		}
+	}
 
-		// Update the cache with the new template and HTML string
-		cache[emailName] = CachedEmail{
-			Template: emailTemplate,
-			StoredAt: time.Now().UTC(),
-		}
+	options, err := loadMessageOptions(app, record)
+	if err != nil {
+		return CachedEmail{}, err
+	}
+
+	locale := record.GetString("locale")
+	if locale == "" {
+		locale = i18n.DefaultLocale()
+	}
+
+	return CachedEmail{
+		Template:     emailTemplate,
+		TextTemplate: textTemplate,
+		Layout:       layout,
+		SourceField:  sourceField,
+		Name:         emailName,
+		Locale:       locale,
+		Category:     templateCategory(record),
+		Options:      options,
+		Version:      currentVersion(record),
+		StoredAt:     time.Now().UTC(),
+	}, nil
+}
+
+/*
+Applies the data to the templates and wraps the html
+
+Non security emails sent to data["recp"] get an unsubscribe link as {{ .unsubscribeLink }}
+*/
+func executeEmailTemplate(app *pocketbase.PocketBase, cachedEmail CachedEmail, emailData map[string]interface{}) (RenderedEmail, error) {
+	data := make(map[string]interface{}, len(emailData)+1)
+	for key, value := range emailData {
+		data[key] = value
+	}
+
+	var unsubscribeURL string
+	if recp, _ := data["recp"].(string); recp != "" && cachedEmail.Category != CategorySecurity {
+		unsubscribeURL = UnsubscribeURL(app, recp, cachedEmail.Category)
+		data["unsubscribeLink"] = unsubscribeURL
 	}
 
 	var modifiedHTMLBuffer bytes.Buffer
 
 	// Apply the dynamic data to the template and write the result to the buffer
-	err := emailTemplate.Execute(&modifiedHTMLBuffer, data)
+	err := cachedEmail.Template.Execute(&modifiedHTMLBuffer, data)
+	if err != nil {
+		return RenderedEmail{}, newTemplateError("execute", cachedEmail.SourceField, err)
+	}
+
+	var text string
+	if cachedEmail.TextTemplate != nil {
+		var textBuffer bytes.Buffer
+		if err := cachedEmail.TextTemplate.Execute(&textBuffer, data); err != nil {
+			return RenderedEmail{}, newTemplateError("execute", "email_text", err)
+		}
+		text = textBuffer.String()
+	} else {
+		text = HTMLToText(modifiedHTMLBuffer.String())
+	}
+
+	html, err := cachedEmail.Layout.render(modifiedHTMLBuffer.String(), cachedEmail.Template, data, cachedEmail.Locale, unsubscribeURL)
 	if err != nil {
-		return "", err
+		return RenderedEmail{}, err
 	}
 
 	// Get the final HTML string with dynamic content
-	return centerEmailContent(modifiedHTMLBuffer.String()), nil
+	return RenderedEmail{
+		MessageOptions: cachedEmail.Options.copy(),
+		HTML:           html,
+		Text:           text,
+		Template:       cachedEmail.Name,
+		Version:        cachedEmail.Version,
+		Category:       cachedEmail.Category,
+		UnsubscribeURL: unsubscribeURL,
+	}, nil
 }
 
 /*
-Center an email horizontaly using a table
+Finds the template for the first locale that has one
 
-Sets max width to 600px also
+Templates without a locale are treated as being in the default locale, and the built in templates are used when there is no record.
+custom_emails collections from before translations have no locale text field, their templates are found by name until it is added
 */
-func centerEmailContent(htmlString string) string {
-	centeredTable := `
-<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
-<html dir="ltr" lang="en">
-<head>
-    <meta content="width=device-width" name="viewport" />
-    <link rel="preload" as="image" href="https://note.suddsy.dev/logo-small-email.png" />
-    <meta content="text/html; charset=UTF-8" http-equiv="Content-Type" />
-    <meta content="IE=edge" http-equiv="X-UA-Compatible" />
-    <meta name="x-apple-disable-message-reformatting" />
-    <meta content="telephone=no,address=no,email=no,date=no,url=no" name="format-detection" />
-    <meta content="light" name="color-scheme" />
-    <meta content="light" name="supported-color-schemes" />
-    <style>
-        @font-face {
-            font-family: 'Inter';
-            font-style: normal;
-            font-weight: 400;
-            mso-font-alt: 'sans-serif';
-            src: url(https://rsms.me/inter/font-files/Inter-Regular.woff2?v=3.19) format('woff2');
-        }
-        * {
-            font-family: 'Inter', sans-serif;
-        }
-    </style>
-    <style>
-        blockquote, h1, h2, h3, img, li, ol, p, ul {
-            margin-top: 1em;
-            margin-bottom: 1em;
-        }
-    </style>
-</head>
-<body style="margin: 0; padding: 0; background-color: #ffffff;">
-    <table role="presentation" style="width: 100%; border-collapse: collapse; margin: 0; padding: 0; background-color: #ffffff;">
-        <tr>
-            <td align="center" style="padding: 20px 0;">
-                <table role="presentation" style="max-width: 540px; width: 100%; border-collapse: collapse; background-color: #ffffff; margin: 0 auto;">
-                    <tr>
-                        <td style="padding: 20px; text-align: left; font-family: Arial, sans-serif; font-size: 16px; color: #333333;">
-                            ` + htmlString + `
-                        </td>
-                    </tr>
-                </table>
-            </td>
-        </tr>
-    </table>
-</body>
-</html>`
-
-	// Output or use the final HTML content
-	return centeredTable
+func findEmailTemplate(app *pocketbase.PocketBase, emailName string, locale string) (*models.Record, error) {
+	if collection, err := app.Dao().FindCollectionByNameOrId("custom_emails"); err == nil && collection.Schema.GetFieldByName("locale") == nil {
+		missingLocaleOnce.Do(func() {
+			app.Logger().Warn("custom_emails has no locale field, templates are used for every locale. Add a locale text field to translate them")
+		})
+
+		record, err := app.Dao().FindFirstRecordByData("custom_emails", "name", emailName)
+		if err == nil {
+			return record, nil
+		}
+		return defaultTemplateRecord(app, emailName, locale)
+	}
+
+	for _, candidate := range i18n.Candidates(locale) {
+		record, err := app.Dao().FindFirstRecordByFilter(
+			"custom_emails", "name = {:name} && locale = {:locale}",
+			dbx.Params{"name": emailName, "locale": candidate},
+		)
+		if err == nil {
+			return record, nil
+		}
+	}
+
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"custom_emails", "name = {:name} && locale = ''",
+		dbx.Params{"name": emailName},
+	)
+	if err == nil {
+		return record, nil
+	}
+
+	return defaultTemplateRecord(app, emailName, locale)
 }
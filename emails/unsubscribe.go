@@ -0,0 +1,88 @@
+package emails
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"suddsy.dev/m/v2/app/tools/i18n"
+)
+
+var unsubscribeTemplate = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html lang="{{ .Locale }}">
+<head>
+    <meta charset="utf-8" />
+    <meta content="width=device-width" name="viewport" />
+    <title>{{ .Title }}</title>
+</head>
+<body style="font-family: sans-serif; color: #333333; max-width: 540px; margin: 40px auto; padding: 0 20px;">
+    <h1>{{ .Title }}</h1>
+    <p>{{ .Message }}</p>
+    {{ if .Confirm }}
+    <form method="post">
+        <button type="submit">{{ .Confirm }}</button>
+    </form>
+    {{ end }}
+</body>
+</html>`))
+
+/*
+Opening the link shows a confirm button so link scanners don't unsubscribe people,
+mail clients using List-Unsubscribe-Post skip straight to the POST
+*/
+func unsubscribePage(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	if _, err := verifyUnsubscribeRequest(app, c); err != nil {
+		return renderUnsubscribePage(c, locale, i18n.T(locale, "Invalid unsubscribe link"), "", "")
+	}
+
+	return renderUnsubscribePage(c, locale,
+		i18n.T(locale, "Unsubscribe"),
+		i18n.Tf(locale, "Stop receiving %s emails?", c.QueryParam("category")),
+		i18n.T(locale, "Unsubscribe"),
+	)
+}
+
+func unsubscribe(app *pocketbase.PocketBase, c echo.Context) error {
+	locale := i18n.FromRequest(c)
+
+	email, err := verifyUnsubscribeRequest(app, c)
+	if err != nil {
+		return renderUnsubscribePage(c, locale, i18n.T(locale, "Invalid unsubscribe link"), "", "")
+	}
+
+	if err := SetSubscribed(app, email, c.QueryParam("category"), false); err != nil {
+		app.Logger().Error("Failed to unsubscribe", "details", err)
+		return renderUnsubscribePage(c, locale, i18n.T(locale, "An error occured processing your request"), "", "")
+	}
+
+	return renderUnsubscribePage(c, locale,
+		i18n.T(locale, "Unsubscribed"),
+		i18n.Tf(locale, "You will no longer receive %s emails.", c.QueryParam("category")),
+		"",
+	)
+}
+
+//Extra helper functions:
+
+func verifyUnsubscribeRequest(app *pocketbase.PocketBase, c echo.Context) (string, error) {
+	return VerifyUnsubscribe(app, c.QueryParam("email"), c.QueryParam("category"), c.QueryParam("sig"))
+}
+
+func renderUnsubscribePage(c echo.Context, locale string, title string, message string, confirm string) error {
+	var page strings.Builder
+	err := unsubscribeTemplate.Execute(&page, map[string]string{
+		"Locale":  locale,
+		"Title":   title,
+		"Message": message,
+		"Confirm": confirm,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.HTML(http.StatusOK, page.String())
+}
@@ -0,0 +1,141 @@
+package emails
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+/*
+The custom_emails fields that make up a version of a template
+*/
+var versionedFields = []string{"email_rich", "email_markdown", "email_text", "layout", "from", "reply_to", "cc", "bcc", "headers"}
+
+/*
+Sets the first version on a new custom_emails record
+*/
+func HandleTemplateCreate(app *pocketbase.PocketBase, e *core.ModelEvent) error {
+	record, ok := e.Model.(*models.Record)
+	if !ok {
+		return nil
+	}
+
+	if record.GetInt("version") < 1 {
+		record.Set("version", 1)
+	}
+	return nil
+}
+
+/*
+Keeps a copy of the old template in custom_email_versions and bumps the version
+
+Nothing happens if none of the template fields changed
+*/
+func HandleTemplateUpdate(app *pocketbase.PocketBase, e *core.ModelEvent) error {
+	record, ok := e.Model.(*models.Record)
+	if !ok {
+		return nil
+	}
+
+	original := record.OriginalCopy()
+	if !templateChanged(original, record) {
+		record.Set("version", original.GetInt("version"))
+		return nil
+	}
+
+	historyCollection, err := e.Dao.FindCollectionByNameOrId("custom_email_versions")
+	if err != nil {
+		app.Logger().Error("custom_email_versions Collection was not found. Please create it to use this feature.")
+	} else {
+		history := models.NewRecord(historyCollection)
+		history.Set("template", original.Id)
+		history.Set("name", original.GetString("name"))
+		history.Set("locale", original.GetString("locale"))
+		history.Set("version", currentVersion(original))
+		for _, field := range versionedFields {
+			history.Set(field, original.Get(field))
+		}
+
+		if err := e.Dao.SaveRecord(history); err != nil {
+			return err
+		}
+	}
+
+	record.Set("version", currentVersion(original)+1)
+	return nil
+}
+
+/*
+Drops every cached template so the next send loads the saved one and its layout
+*/
+func InvalidateTemplateCache() {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cache = make(map[string]CachedEmail)
+}
+
+/*
+Lists the saved versions of a template, newest first
+*/
+func TemplateVersions(app *pocketbase.PocketBase, templateId string) ([]*models.Record, error) {
+	return app.Dao().FindRecordsByFilter(
+		"custom_email_versions", "template = {:template}", "-version", 0, 0,
+		dbx.Params{"template": templateId},
+	)
+}
+
+/*
+Copies an old version back onto the template
+
+This saves as a new version so the rollback can be undone too
+*/
+func RollbackTemplate(app *pocketbase.PocketBase, templateId string, version int) (*models.Record, error) {
+	record, err := app.Dao().FindRecordById("custom_emails", templateId)
+	if err != nil {
+		return nil, NewEmailError("Template not found")
+	}
+
+	history, err := app.Dao().FindFirstRecordByFilter(
+		"custom_email_versions", "template = {:template} && version = {:version}",
+		dbx.Params{"template": templateId, "version": version},
+	)
+	if err != nil {
+		return nil, NewEmailError("Version %d not found", version)
+	}
+
+	// Make sure the old version still parses before putting it live
+	if _, err := parseEmailTemplate(app, history); err != nil {
+		return nil, err
+	}
+
+	for _, field := range versionedFields {
+		record.Set(field, history.Get(field))
+	}
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+//Extra helper functions:
+
+func templateChanged(original *models.Record, record *models.Record) bool {
+	for _, field := range versionedFields {
+		if original.GetString(field) != record.GetString(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// Templates saved before versioning have no version so count as the first
+func currentVersion(record *models.Record) int {
+	if version := record.GetInt("version"); version > 0 {
+		return version
+	}
+	return 1
+}
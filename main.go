@@ -5,11 +5,19 @@ import (
 	"os"
 
 	twofa "suddsy.dev/m/v2/app/auth/TwoFA"
+	"suddsy.dev/m/v2/app/auth/accesstokens"
+	"suddsy.dev/m/v2/app/auth/methods/deviceauth"
 	"suddsy.dev/m/v2/app/auth/methods/emailauth"
+	"suddsy.dev/m/v2/app/auth/oidc"
+	"suddsy.dev/m/v2/app/auth/pow"
+	"suddsy.dev/m/v2/app/auth/sessions"
 	"suddsy.dev/m/v2/app/tools/lifetime"
 	"suddsy.dev/m/v2/app/user"
 	"suddsy.dev/m/v2/app/user/account"
+	"suddsy.dev/m/v2/app/user/digests"
+	"suddsy.dev/m/v2/app/user/inbound"
 	"suddsy.dev/m/v2/app/user/pages"
+	"suddsy.dev/m/v2/emails"
 
 	"github.com/joho/godotenv"
 	"github.com/pocketbase/pocketbase"
@@ -29,12 +37,29 @@ func main() {
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		e.Router.GET("/*", apis.StaticDirectoryHandler(os.DirFS("./pb_public"), false))
 		emailauth.RegisterEmailAuthRoutes(e, app)
+		deviceauth.RegisterDeviceAuthRoutes(e, app)
+		oidc.RegisterOIDCRoutes(e, app)
 		pages.RegisterAccPagesRoutes(e, app)
 		account.HandleRegisterRoutes(e, app)
 		twofa.Register2FARoutes(e, app)
+		pow.RegisterPowRoutes(e, app)
+		sessions.RegisterSessionRoutes(e, app)
+		accesstokens.RegisterAccessTokenRoutes(e, app)
+		emails.RegisterEmailRoutes(e, app)
+		emails.StartOutboxWorker(app)
+		inbound.RegisterInboundRoutes(e, app)
+		inbound.StartInbound(app)
 
 		scheduler := cron.New()
 		lifetime.EnableAutoResetCron(app, scheduler)
+		sessions.EnableCleanupCron(app, scheduler)
+		pow.EnableCleanupCron(app, scheduler)
+		deviceauth.EnableCleanupCron(app, scheduler)
+		oidc.EnableKeyRotationCron(app, scheduler)
+		account.EnableGuestExpiryCron(app, scheduler)
+		emails.EnableScheduledEmailCron(app, scheduler)
+		emails.EnableOutboxCleanupCron(app, scheduler)
+		digests.EnableDigestCron(app, scheduler)
 		scheduler.Start()
 
 		return nil
@@ -44,6 +69,22 @@ func main() {
 		return user.HandleCreateEvent(e, app)
 	})
 
+	app.OnRecordBeforeUpdateRequest("files").Add(func(e *core.RecordUpdateEvent) error {
+		return user.HandleUpdateEvent(e, app)
+	})
+
+	app.OnModelBeforeCreate("files").Add(func(e *core.ModelEvent) error {
+		return user.HandleFileCreate(e)
+	})
+
+	app.OnModelBeforeUpdate("files").Add(func(e *core.ModelEvent) error {
+		return user.HandleFileUpdate(e)
+	})
+
+	app.OnModelBeforeDelete("files").Add(func(e *core.ModelEvent) error {
+		return user.HandleFileDelete(e)
+	})
+
 	app.OnRecordAfterUpdateRequest("pages").Add(func(e *core.RecordUpdateEvent) error {
 		go user.CheckFilesMatchBlocks(app, e)
 		return nil
@@ -53,6 +94,41 @@ func main() {
 		return account.NewAccountSetup(e, app)
 	})
 
+	app.OnRecordAuthRequest().Add(func(e *core.RecordAuthEvent) error {
+		return sessions.HandleAuthEvent(app, e)
+	})
+
+	app.OnRecordBeforeAuthWithOAuth2Request().Add(func(e *core.RecordAuthWithOAuth2Event) error {
+		return emailauth.HandleOAuth2Login(app, e)
+	})
+
+	app.OnRecordAfterAuthWithOAuth2Request().Add(func(e *core.RecordAuthWithOAuth2Event) error {
+		return emailauth.HandleOAuth2LoginComplete(app, e)
+	})
+
+	app.OnModelBeforeCreate("custom_emails").Add(func(e *core.ModelEvent) error {
+		return emails.HandleTemplateCreate(app, e)
+	})
+
+	app.OnModelBeforeUpdate("custom_emails").Add(func(e *core.ModelEvent) error {
+		return emails.HandleTemplateUpdate(app, e)
+	})
+
+	app.OnModelAfterCreate("custom_emails", "email_layouts").Add(func(e *core.ModelEvent) error {
+		emails.InvalidateTemplateCache()
+		return nil
+	})
+
+	app.OnModelAfterUpdate("custom_emails", "email_layouts").Add(func(e *core.ModelEvent) error {
+		emails.InvalidateTemplateCache()
+		return nil
+	})
+
+	app.OnModelAfterDelete("custom_emails", "email_layouts").Add(func(e *core.ModelEvent) error {
+		emails.InvalidateTemplateCache()
+		return nil
+	})
+
 	app.OnRecordAfterUnlinkExternalAuthRequest().Add(func(e *core.RecordUnlinkExternalAuthEvent) error {
 		return emailauth.EnableFromOAuthUnlink(app, e)
 	})
@@ -65,6 +141,10 @@ func main() {
 		return nil
 	})
 
+	app.RootCmd.AddCommand(emails.NewDKIMCommand(app))
+	app.RootCmd.AddCommand(emails.NewTemplatesCommand(app))
+	app.RootCmd.AddCommand(user.NewUsageCommand(app))
+
 	if err := app.Start(); err != nil {
 		log.Fatal(err)
 	}